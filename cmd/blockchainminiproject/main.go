@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"runtime"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/mining"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/resources"
 )
 
@@ -26,6 +31,112 @@ func main() {
 				Value:   10,
 				EnvVars: []string{"TIME_LIMIT"},
 			},
+			&cli.Int64Flag{
+				Name:    "transaction-retries",
+				Usage:   "The number of failed blocks a valid transaction can be requeued from before it is dropped",
+				Value:   3,
+				EnvVars: []string{"TRANSACTION_RETRIES"},
+			},
+			&cli.IntFlag{
+				Name:    "transaction-queue-size",
+				Usage:   "The number of transactions that can wait to be grouped into a block before intake answers 503",
+				Value:   100,
+				EnvVars: []string{"TRANSACTION_QUEUE_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "max-pending-transactions",
+				Usage:   "The number of transactions that can be pending or mining before intake answers 503",
+				Value:   1000,
+				EnvVars: []string{"MAX_PENDING_TRANSACTIONS"},
+			},
+			&cli.Int64Flag{
+				Name:    "retry-after",
+				Usage:   "The seconds clients are told to wait in the Retry-After header when intake answers 503",
+				Value:   30,
+				EnvVars: []string{"RETRY_AFTER"},
+			},
+			&cli.StringFlag{
+				Name:    "consensus",
+				Usage:   "The consensus engine that proposes, seals and finalizes blocks, \"pow\" for proof of work, \"pos\" for proof of stake or \"poa\" for proof of authority",
+				Value:   consensus.ProofOfWorkName,
+				EnvVars: []string{"CONSENSUS"},
+			},
+			&cli.Uint64Flag{
+				Name:    "difficulty",
+				Usage:   "The proof of work difficulty of the first blocks. The hash has to be at or below (2^256 - 1) / difficulty",
+				Value:   1 << 20,
+				EnvVars: []string{"DIFFICULTY"},
+			},
+			&cli.Int64Flag{
+				Name:    "difficulty-adjust-blocks",
+				Usage:   "The number of blocks between difficulty adjustments",
+				Value:   10,
+				EnvVars: []string{"DIFFICULTY_ADJUST_BLOCKS"},
+			},
+			&cli.Int64Flag{
+				Name:    "target-block-seconds",
+				Usage:   "The number of seconds between blocks that the difficulty adjusts toward",
+				Value:   60,
+				EnvVars: []string{"TARGET_BLOCK_SECONDS"},
+			},
+			&cli.IntFlag{
+				Name:    "pow-workers",
+				Usage:   "The number of goroutines that search for proof of work",
+				Value:   runtime.NumCPU(),
+				EnvVars: []string{"POW_WORKERS"},
+			},
+			&cli.Int64Flag{
+				Name:    "slot-seconds",
+				Usage:   "The number of seconds each proof of stake or proof of authority proposer gets to propose a block before the next one is picked",
+				Value:   10,
+				EnvVars: []string{"SLOT_SECONDS"},
+			},
+			&cli.StringFlag{
+				Name:    "validators-file",
+				Usage:   "The file of PEM public keys of the proof of authority validator nodes, in the order they take turns proposing",
+				EnvVars: []string{"VALIDATORS_FILE"},
+			},
+			&cli.Float64Flag{
+				Name:    "validator-signature-fraction",
+				Usage:   "The fraction of the proof of authority validators that have to sign a block",
+				Value:   0.66,
+				EnvVars: []string{"VALIDATOR_SIGNATURE_FRACTION"},
+			},
+			&cli.StringFlag{
+				Name:    "node-key-file",
+				Usage:   "The PEM private key file of the node, created when it doesn't exist. The node makes new keys every start without it",
+				EnvVars: []string{"NODE_KEY_FILE"},
+			},
+			&cli.Int64Flag{
+				Name:    "claim-tie-window",
+				Usage:   "The seconds after the first claim on the previous hash that a block with a lower hash can still take over the claim",
+				Value:   10,
+				EnvVars: []string{"CLAIM_TIE_WINDOW"},
+			},
+			&cli.Int64Flag{
+				Name:    "claim-lease-seconds",
+				Usage:   "The seconds a claim on the previous hash from a sign request lasts before it is released, unless the block is accepted first",
+				Value:   120,
+				EnvVars: []string{"CLAIM_LEASE_SECONDS"},
+			},
+			&cli.Int64Flag{
+				Name:    "sign-request-cache-minutes",
+				Usage:   "The minutes a sign request is remembered so that the same block can't be sent again to hold the claim on the previous hash",
+				Value:   20,
+				EnvVars: []string{"SIGN_REQUEST_CACHE_MINUTES"},
+			},
+			&cli.IntFlag{
+				Name:    "sign-request-cache-size",
+				Usage:   "The most sign requests remembered at once, the oldest are forgotten first",
+				Value:   10000,
+				EnvVars: []string{"SIGN_REQUEST_CACHE_SIZE"},
+			},
+			&cli.IntFlag{
+				Name:    "sign-requests-per-tip",
+				Usage:   fmt.Sprintf("The most signed sign requests each origin node can send on the same previous block hash, 0 for no limit. The default is the %d retries a node makes on a block", mining.MaxBlockRetries),
+				Value:   mining.MaxBlockRetries,
+				EnvVars: []string{"SIGN_REQUESTS_PER_TIP"},
+			},
 			&cli.StringFlag{
 				Name:    "host",
 				Usage:   "The host endpoint of the node (please include the port)",
@@ -37,8 +148,94 @@ func main() {
 				Value:   "written",
 				EnvVars: []string{"BLOCKCHAIN_FOLDER_NAME"},
 			},
+			&cli.StringFlag{
+				Name:    "block-store",
+				Usage:   "Where the written blocks are kept: \"file\" for a json file per block in the blockchain folder, \"segment\" to append the blocks to segment files in the blockchain folder, or \"memory\" to keep them in memory until the node stops",
+				Value:   "file",
+				EnvVars: []string{"BLOCK_STORE"},
+			},
+			&cli.Int64Flag{
+				Name:    "segment-max-bytes",
+				Usage:   "The size a segment file can grow to before the segment block store starts the next one",
+				Value:   64 << 20,
+				EnvVars: []string{"SEGMENT_MAX_BYTES"},
+			},
+			&cli.Int64Flag{
+				Name:    "snapshot-interval",
+				Usage:   "How many written blocks apart the signed snapshots of the account state are taken. 0 turns the snapshots off",
+				Value:   100,
+				EnvVars: []string{"SNAPSHOT_INTERVAL"},
+			},
+			&cli.StringFlag{
+				Name:    "snapshot-peer",
+				Usage:   "The url of a node, like http://127.0.0.1:8080, to start the account state from the latest snapshot of when this node doesn't have a snapshot yet",
+				EnvVars: []string{"SNAPSHOT_PEER"},
+			},
+			&cli.StringFlag{
+				Name:    "snapshot-peer-keys",
+				Usage:   "The file with the PEM public keys of the nodes whose snapshots are trusted for --snapshot-peer, in the same format as --validators-file",
+				EnvVars: []string{"SNAPSHOT_PEER_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:    "prune",
+				Usage:   "\"archival\" to keep every block whole, or prune the transaction bodies of the blocks older than --prune-retention with \"delete\" to delete them or \"gzip\" to keep them in gzip archives. Pruning needs the file block store and the snapshots",
+				Value:   "archival",
+				EnvVars: []string{"PRUNE"},
+			},
+			&cli.Int64Flag{
+				Name:    "prune-retention",
+				Usage:   "How many blocks back from the tip are kept whole when pruning",
+				Value:   1000,
+				EnvVars: []string{"PRUNE_RETENTION"},
+			},
 		},
 		Action: resources.Serve,
+		Commands: []*cli.Command{
+			{
+				Name:  "export",
+				Usage: "Write the chain in --blockchain-folder-name to a chain archive of newline delimited json blocks after a manifest. Stop the node first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "The chain archive file to write, or \"-\" for stdout",
+						Value: "-",
+					},
+				},
+				Action: resources.Export,
+			},
+			{
+				Name:  "import",
+				Usage: "Check each block of a chain archive with the --consensus engine and write it to --blockchain-folder-name, which can't have any blocks yet",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "The chain archive file to read, or \"-\" for stdin",
+						Value: "-",
+					},
+				},
+				Action: resources.Import,
+			},
+			{
+				Name:  "node-key",
+				Usage: "Print the public key of the --node-key-file, creating the key file if it doesn't exist, for listing the node in a --validators-file",
+				Action: func(ctx *cli.Context) error {
+					if ctx.String("node-key-file") == "" {
+						return fmt.Errorf("node-key needs --node-key-file")
+					}
+					_, publicKey, err := autograph.LoadOrCreateSig(ctx.String("node-key-file"))
+					if err != nil {
+						return err
+					}
+					fmt.Print(string(autograph.PublicKeyToBytes(publicKey)))
+					return nil
+				},
+			},
+			{
+				Name:   "verify",
+				Usage:  "Check the block files in --blockchain-folder-name, like written8080, offline with the --consensus engine and print a json report. Exits with an error if the chain doesn't pass",
+				Action: resources.Verify,
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -0,0 +1,378 @@
+package accountstate
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// Account is what the written blocks add up to for one user public key
+type Account struct {
+	Balance dto.Coin `json:"balance"`
+	// Nonce is the highest nonce of the transactions the user has sent in the written blocks
+	Nonce int64 `json:"nonce"`
+	// LastSeenHeight is the height of the last written block the user sent or received a transaction in
+	LastSeenHeight int64 `json:"lastSeenHeight"`
+	// Stakes is the coin the user has staked with each validator node, by the validator node public key
+	Stakes map[string]dto.Coin `json:"stakes,omitempty"`
+}
+
+// copy returns a copy of the account that doesn't share its stakes with the account
+func (account *Account) copy() *Account {
+	accountCopy := *account
+	if account.Stakes != nil {
+		accountCopy.Stakes = make(map[string]dto.Coin, len(account.Stakes))
+		for validatorPublicKey, staked := range account.Stakes {
+			accountCopy.Stakes[validatorPublicKey] = staked
+		}
+	}
+	return &accountCopy
+}
+
+// AccountState is the struct that keeps the account of every user in the written blocks up to date block by block, with a mutex lock,
+// so the balances don't have to be added up from the block files every time they are checked.
+// Every snapshotInterval blocks the accounts are saved as a signed snapshot, along with the height and hash of the block they are up to.
+type AccountState struct {
+	mx       *sync.Mutex
+	accounts map[string]*Account
+	height   int64
+	tipHash  string
+	// validatorStakes is the coin staked with each validator node by every user, added up from the accounts
+	validatorStakes map[string]dto.Coin
+
+	snapshotFolder   string
+	snapshotInterval int64
+	latestSnapshot   *Snapshot
+	privateKey       *rsa.PrivateKey
+	publicKey        *rsa.PublicKey
+	// snapshotHeights are the heights of the snapshots kept in the snapshot folder, oldest first
+	snapshotHeights []int64
+	// checking is set for the copy CheckBranch builds, which doesn't log where it starts from
+	checking bool
+	// bootstrapped is the snapshot from another node that Bootstrap started the account state from,
+	// kept until the account state is built up to its height from the blocks and checked against it
+	bootstrapped *Snapshot
+}
+
+// NewAccountState returns the account state from the latest snapshot in the snapshot folder, or an empty one if there isn't a snapshot yet.
+// A snapshot is taken every snapshotInterval blocks, or never when snapshotInterval is 0.
+// The snapshots are only kept in memory when snapshotFolder is "".
+func NewAccountState(snapshotFolder string, snapshotInterval int64) (*AccountState, error) {
+	a := &AccountState{
+		mx:               &sync.Mutex{},
+		accounts:         make(map[string]*Account),
+		validatorStakes:  make(map[string]dto.Coin),
+		snapshotFolder:   snapshotFolder,
+		snapshotInterval: snapshotInterval,
+	}
+
+	snapshots, err := loadSnapshots(snapshotFolder)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		a.snapshotHeights = append(a.snapshotHeights, snapshots[i].Height)
+	}
+	if len(snapshots) > 0 {
+		a.restore(snapshots[0])
+	}
+
+	return a, nil
+}
+
+// SetNodeKeys sets the node keys the snapshots are signed with. Snapshots aren't taken until the keys are set.
+func (a *AccountState) SetNodeKeys(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.privateKey = privateKey
+	a.publicKey = publicKey
+}
+
+// Bootstrap starts the account state from a snapshot served by another node instead of from the first block.
+// The snapshot has to match its state hash and be signed by one of the trusted node public keys.
+// It is saved to the snapshot folder and checked against the chain by CatchUp. Until the node has the snapshot's block,
+// CatchUp builds the accounts from the first block and keeps the snapshot, which is used once the node has the blocks up to it.
+// When the accounts are built up to the snapshot's height from the blocks, a snapshot that doesn't match them is removed.
+func (a *AccountState) Bootstrap(snapshot *Snapshot, trustedPublicKeys []string) error {
+	err := VerifySnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	trusted := false
+	for _, publicKey := range trustedPublicKeys {
+		if publicKey == snapshot.NodePublicKey {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("the snapshot is signed by a node that isn't one of the trusted snapshot keys")
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if snapshot.Height <= a.height {
+		return fmt.Errorf("the snapshot at height %d is not ahead of the account state at height %d", snapshot.Height, a.height)
+	}
+	err = a.saveSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	a.restore(snapshot)
+	a.bootstrapped = snapshot
+	return nil
+}
+
+// restore replaces the accounts with the ones in the snapshot. Call with the mutex locked.
+// The stakes in a verified snapshot were added up with overflow checks when it was taken, so the validator stakes can't overflow.
+func (a *AccountState) restore(snapshot *Snapshot) {
+	a.accounts = make(map[string]*Account)
+	a.validatorStakes = make(map[string]dto.Coin)
+	for userID, account := range snapshot.Accounts {
+		a.accounts[userID] = account.copy()
+		for validatorPublicKey, staked := range account.Stakes {
+			a.validatorStakes[validatorPublicKey] += staked
+		}
+	}
+	a.height = snapshot.Height
+	a.tipHash = snapshot.TipHash
+	a.latestSnapshot = snapshot
+}
+
+// GetAccount returns a copy of the account for the user public key
+func (a *AccountState) GetAccount(userID string) (*Account, error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	account, found := a.accounts[userID]
+	if !found {
+		return nil, fmt.Errorf("userID does not exist in the account state")
+	}
+
+	return account.copy(), nil
+}
+
+// GetWrittenUserBalance returns the balance of the user public key in the written blocks
+func (a *AccountState) GetWrittenUserBalance(userID string) (dto.Coin, error) {
+	account, err := a.GetAccount(userID)
+	if err != nil {
+		return 0, err
+	}
+	return account.Balance, nil
+}
+
+// Tip returns the height and hash of the block the account state is up to
+func (a *AccountState) Tip() (int64, string) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.height, a.tipHash
+}
+
+// ApplyBlock adds the transactions of the block written at the height to the accounts, and takes a snapshot when it is time to.
+// Either every transaction of the block is applied or none of them are.
+func (a *AccountState) ApplyBlock(height int64, block *dto.BlockRequest) error {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	err := a.apply(height, block)
+	if err != nil {
+		return err
+	}
+	return a.snapshotIfDue()
+}
+
+// CatchUp brings the account state up to the tip of the chain, which is every block on the main chain from the first block.
+// When the block the account state is up to is on the chain, only the blocks after it are applied.
+// Otherwise, like after a reorg, the accounts are built again from the latest snapshot in the snapshot folder that is on the chain,
+// or from the first block when none of them are.
+func (a *AccountState) CatchUp(chain []*dto.BlockRequest) error {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	_, err := a.catchUp(chain)
+	if err != nil {
+		return err
+	}
+	return a.snapshotIfDue()
+}
+
+// CheckBranch checks the accounts can be built up to the end of the branch the same way CatchUp would build them,
+// without changing the account state. branch is every block from the first block to the end of the branch.
+// CheckBranch returns the hash of the first block whose transactions can't be applied, like a sender spending more than their balance
+// or unstaking more than they have staked, along with the error. The hash is "" when the error isn't from a block.
+func (a *AccountState) CheckBranch(branch []*dto.BlockRequest) (invalidBlock string, err error) {
+	a.mx.Lock()
+	scratch := &AccountState{
+		mx:              &sync.Mutex{},
+		accounts:        make(map[string]*Account),
+		validatorStakes: make(map[string]dto.Coin),
+		height:          a.height,
+		tipHash:         a.tipHash,
+		snapshotFolder:  a.snapshotFolder,
+		latestSnapshot:  a.latestSnapshot,
+		checking:        true,
+	}
+	// the accounts are only copied when the branch builds on them, otherwise catchUp starts over from a snapshot or the first block
+	if isOnChain(branch, a.height, a.tipHash) {
+		for userID, account := range a.accounts {
+			scratch.accounts[userID] = account.copy()
+		}
+		for validatorPublicKey, staked := range a.validatorStakes {
+			scratch.validatorStakes[validatorPublicKey] = staked
+		}
+	}
+	a.mx.Unlock()
+
+	return scratch.catchUp(branch)
+}
+
+// catchUp applies the blocks of the chain after the block the account state is up to, starting over from a snapshot or the first block
+// when that block isn't on the chain. catchUp returns the hash of the block that couldn't be applied along with the error. Call with the mutex locked.
+func (a *AccountState) catchUp(chain []*dto.BlockRequest) (invalidBlock string, err error) {
+	if !isOnChain(chain, a.height, a.tipHash) {
+		snapshot, err := a.latestSnapshotOnChain(chain)
+		if err != nil {
+			return "", err
+		}
+		if snapshot != nil {
+			if !a.checking {
+				log.Printf("the account state at height %d is not on the chain, building it again from the snapshot at height %d", a.height, snapshot.Height)
+			}
+			a.restore(snapshot)
+		} else {
+			if a.bootstrapped != nil && int64(len(chain)) < a.bootstrapped.Height && !a.checking {
+				log.Printf("keeping the bootstrapped snapshot at height %d until the chain has its block, building the account state from the first block for now", a.bootstrapped.Height)
+			} else if !a.checking {
+				log.Printf("the account state at height %d is not on the chain, building it again from the first block", a.height)
+			}
+			a.accounts = make(map[string]*Account)
+			a.validatorStakes = make(map[string]dto.Coin)
+			a.height = 0
+			a.tipHash = ""
+			a.latestSnapshot = nil
+		}
+	}
+
+	for i := a.height; i < int64(len(chain)); i++ {
+		err := a.apply(i+1, chain[i])
+		if err != nil {
+			return chain[i].ProofOfWorkHash, err
+		}
+	}
+	return "", nil
+}
+
+// isOnChain returns if the block at the height with the tip hash is on the chain. Height 0 is before the first block, so it is always on the chain.
+func isOnChain(chain []*dto.BlockRequest, height int64, tipHash string) bool {
+	return height == 0 || (height <= int64(len(chain)) && chain[height-1].ProofOfWorkHash == tipHash)
+}
+
+// apply adds the transactions of the block to the accounts. Call with the mutex locked.
+func (a *AccountState) apply(height int64, block *dto.BlockRequest) error {
+	if height != a.height+1 {
+		return fmt.Errorf("block %s at height %d does not follow the account state at height %d", block.ProofOfWorkHash, height, a.height)
+	}
+
+	// the changed accounts are copies until every transaction has been added
+	changed := make(map[string]*Account)
+	account := func(userID string) *Account {
+		if changedAccount, found := changed[userID]; found {
+			return changedAccount
+		}
+		changedAccount := &Account{}
+		if existing, found := a.accounts[userID]; found {
+			changedAccount = existing.copy()
+		}
+		changed[userID] = changedAccount
+		return changedAccount
+	}
+	changedValidatorStakes := make(map[string]dto.Coin)
+	validatorStake := func(validatorPublicKey string) dto.Coin {
+		if staked, found := changedValidatorStakes[validatorPublicKey]; found {
+			return staked
+		}
+		return a.validatorStakes[validatorPublicKey]
+	}
+	usedNonces := make(map[string]bool)
+
+	for _, transactionSub := range block.Transactions {
+		if transactionSub.TransactionStatus == dto.StatusDropped {
+			// if the transaction was dropped then ignore its coin amount
+			continue
+		}
+		if transactionSub.TransactionStatus == dto.StatusPruned {
+			return fmt.Errorf("block %s at height %d is pruned, so the account state has to start from a snapshot after it", block.ProofOfWorkHash, height)
+		}
+
+		spend, err := transactionSub.Submitted.Spend()
+		if err != nil {
+			return err
+		}
+
+		// a nonce can only be used once, so a replaced or cancelled transaction can't be written after the nonce is
+		writtenNonce := int64(0)
+		if existing, found := a.accounts[transactionSub.Submitted.From]; found {
+			writtenNonce = existing.Nonce
+		}
+		err = useNonce(writtenNonce, usedNonces, transactionSub.Submitted)
+		if err != nil {
+			return fmt.Errorf("block %s at height %d: transaction %s: %s", block.ProofOfWorkHash, height, transactionSub.ID, err.Error())
+		}
+
+		sender := account(transactionSub.Submitted.From)
+		sender.Balance, err = sender.Balance.Sub(spend)
+		if err == nil && sender.Balance < 0 {
+			err = fmt.Errorf("transaction %s spends more than the balance of the sender", transactionSub.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("block %s at height %d: %s", block.ProofOfWorkHash, height, err.Error())
+		}
+		if transactionSub.Submitted.Nonce > sender.Nonce {
+			sender.Nonce = transactionSub.Submitted.Nonce
+		}
+		sender.LastSeenHeight = height
+
+		if transactionSub.Submitted.Type == dto.TransactionTypeStake || transactionSub.Submitted.Type == dto.TransactionTypeUnstake {
+			validatorPublicKey := transactionSub.Submitted.To
+			userStake, totalStake, err := addStake(sender.Stakes[validatorPublicKey], validatorStake(validatorPublicKey), transactionSub.Submitted)
+			if err != nil {
+				return fmt.Errorf("block %s at height %d: %s", block.ProofOfWorkHash, height, err.Error())
+			}
+			if sender.Stakes == nil {
+				sender.Stakes = make(map[string]dto.Coin)
+			}
+			sender.Stakes[validatorPublicKey] = userStake
+			if userStake == 0 {
+				delete(sender.Stakes, validatorPublicKey)
+			}
+			changedValidatorStakes[validatorPublicKey] = totalStake
+		}
+
+		receiver := account(transactionSub.Submitted.To)
+		receiver.Balance, err = receiver.Balance.Add(transactionSub.Submitted.Credit())
+		if err != nil {
+			return err
+		}
+		receiver.LastSeenHeight = height
+	}
+
+	for userID, changedAccount := range changed {
+		a.accounts[userID] = changedAccount
+	}
+	for validatorPublicKey, staked := range changedValidatorStakes {
+		a.validatorStakes[validatorPublicKey] = staked
+		if staked == 0 {
+			delete(a.validatorStakes, validatorPublicKey)
+		}
+	}
+	a.height = height
+	a.tipHash = block.ProofOfWorkHash
+
+	if a.bootstrapped != nil && a.bootstrapped.Height == height {
+		return a.checkBootstrapped()
+	}
+	return nil
+}
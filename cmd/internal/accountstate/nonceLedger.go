@@ -0,0 +1,63 @@
+package accountstate
+
+import (
+	"fmt"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// GetWrittenUserNonce returns the highest nonce of the transactions the user has sent in the written blocks
+func (a *AccountState) GetWrittenUserNonce(userID string) int64 {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	account, found := a.accounts[userID]
+	if !found {
+		return 0
+	}
+	return account.Nonce
+}
+
+// useNonce returns an error if the nonce of the transaction is not above the written nonce of the sender,
+// or if another transaction of the block already used it. Otherwise useNonce adds the nonce to the used nonces of the block.
+// Transactions without a nonce are ignored.
+func useNonce(writtenNonce int64, used map[string]bool, transaction *dto.Transaction) error {
+	if transaction.Nonce == 0 {
+		return nil
+	}
+	if transaction.Nonce <= writtenNonce {
+		return fmt.Errorf("nonce %d is not above the nonce %d of the sender in the written blocks", transaction.Nonce, writtenNonce)
+	}
+
+	key := fmt.Sprintf("%s|%d", transaction.From, transaction.Nonce)
+	if used[key] {
+		return fmt.Errorf("nonce %d is used by another transaction of the sender in the block", transaction.Nonce)
+	}
+	used[key] = true
+	return nil
+}
+
+// NonceLedger keeps track of the nonces used by the transactions of a block that is being checked, on top of the written nonces.
+type NonceLedger struct {
+	accountState *AccountState
+	// used are the nonces used in the block, by "<user>|<nonce>"
+	used map[string]bool
+}
+
+// NewNonceLedger returns an instance of the NonceLedger struct for checking the nonces of one block.
+func (a *AccountState) NewNonceLedger() *NonceLedger {
+	return &NonceLedger{
+		accountState: a,
+		used:         make(map[string]bool),
+	}
+}
+
+// Apply adds the nonce of the transaction to the ledger.
+// Apply returns an error and changes nothing if the nonce is at or below the nonce of the sender in the written blocks,
+// or if another transaction of the sender in the block already used it. Transactions without a nonce are ignored.
+func (l *NonceLedger) Apply(transaction *dto.Transaction) error {
+	if transaction.Nonce == 0 {
+		return nil
+	}
+	return useNonce(l.accountState.GetWrittenUserNonce(transaction.From), l.used, transaction)
+}
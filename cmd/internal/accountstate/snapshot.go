@@ -0,0 +1,319 @@
+package accountstate
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+)
+
+const (
+	// snapshotFileFormat is the file name of each snapshot in the snapshot folder. The height is zero padded so the file names sort in order.
+	snapshotFileFormat = "snapshot_%012d.json"
+	// snapshotsKept is how many of the latest snapshots are kept in the snapshot folder
+	snapshotsKept = 3
+	// snapshotVersion is the version of what the accounts in a snapshot keep. Version 1 added the stakes.
+	// Snapshots of another version are turned away, since restoring them would get the stakes wrong.
+	snapshotVersion = 1
+)
+
+// Snapshot is the account state at the block it is up to, signed by the node that took it.
+// The state hash covers the version, the height, the tip hash and the accounts, and the node signs the state hash.
+type Snapshot struct {
+	Version       int                 `json:"version"`
+	Height        int64               `json:"height"`
+	TipHash       string              `json:"tipHash"`
+	Accounts      map[string]*Account `json:"accounts"`
+	StateHash     string              `json:"stateHash"`
+	NodePublicKey string              `json:"nodePublicKey"`
+	Signature     string              `json:"signature"`
+}
+
+// stateHash returns the sha256 of the json of the version, height, tip hash and accounts.
+// encoding/json writes map keys in sorted order, so every node gets the same hash for the same state.
+func (s *Snapshot) stateHash() (string, error) {
+	stateBytes, err := json.Marshal(&Snapshot{
+		Version:  s.Version,
+		Height:   s.Height,
+		TipHash:  s.TipHash,
+		Accounts: s.Accounts,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(stateBytes)), nil
+}
+
+// VerifySnapshot returns an error if the snapshot isn't the version this node reads, the state hash doesn't match the state in the snapshot,
+// or the signature doesn't match the state hash. It checks the snapshot is whole, not that the node that signed it can be trusted.
+func VerifySnapshot(snapshot *Snapshot) error {
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("the snapshot is version %d, this node reads version %d", snapshot.Version, snapshotVersion)
+	}
+
+	stateHash, err := snapshot.stateHash()
+	if err != nil {
+		return err
+	}
+	if stateHash != snapshot.StateHash {
+		return fmt.Errorf("the snapshot state hash does not match the state in the snapshot")
+	}
+
+	publicKey := autograph.BytesToPublicKey([]byte(snapshot.NodePublicKey))
+	if publicKey == nil {
+		return fmt.Errorf("the snapshot node public key is not a Public RSA PEM string")
+	}
+	signatureBytes, err := autograph.SignedBodyToBytes(snapshot.Signature)
+	if err != nil {
+		return err
+	}
+	err = autograph.Verify([]byte(snapshot.StateHash), signatureBytes, publicKey)
+	if err != nil {
+		return fmt.Errorf("the snapshot signature does not match the state hash: %s", err.Error())
+	}
+	return nil
+}
+
+// LatestSnapshot returns the latest snapshot of the account state, or nil if there isn't one yet
+func (a *AccountState) LatestSnapshot() *Snapshot {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.latestSnapshot
+}
+
+// snapshotIfDue takes a snapshot when the account state is snapshotInterval blocks past the latest snapshot. Call with the mutex locked.
+func (a *AccountState) snapshotIfDue() error {
+	if a.snapshotInterval <= 0 || a.privateKey == nil || a.height == 0 {
+		return nil
+	}
+	if a.latestSnapshot != nil && a.height-a.latestSnapshot.Height < a.snapshotInterval {
+		return nil
+	}
+
+	snapshot := &Snapshot{
+		Version:       snapshotVersion,
+		Height:        a.height,
+		TipHash:       a.tipHash,
+		Accounts:      make(map[string]*Account),
+		NodePublicKey: string(autograph.PublicKeyToBytes(a.publicKey)),
+	}
+	for userID, account := range a.accounts {
+		snapshot.Accounts[userID] = account.copy()
+	}
+
+	var err error
+	snapshot.StateHash, err = snapshot.stateHash()
+	if err != nil {
+		return err
+	}
+	signature, err := autograph.Sign(a.privateKey, []byte(snapshot.StateHash))
+	if err != nil {
+		return err
+	}
+	snapshot.Signature = fmt.Sprintf("%x", signature)
+
+	err = a.saveSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	a.latestSnapshot = snapshot
+	return nil
+}
+
+// saveSnapshot writes the snapshot to the snapshot folder and removes the old ones. Call with the mutex locked.
+func (a *AccountState) saveSnapshot(snapshot *Snapshot) error {
+	if a.snapshotFolder == "" {
+		return nil
+	}
+
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(a.snapshotFolder, 0744)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteFileAtomic(filepath.Join(a.snapshotFolder, fmt.Sprintf(snapshotFileFormat, snapshot.Height)), snapshotBytes)
+	if err != nil {
+		return err
+	}
+
+	fileNames, err := snapshotFileNames(a.snapshotFolder)
+	if err != nil {
+		return err
+	}
+	for i := snapshotsKept; i < len(fileNames); i++ {
+		err = os.Remove(fileNames[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// the heights follow the files, a snapshot taken again at the same height after a reorg replaces the file
+	heights := []int64{snapshot.Height}
+	for _, height := range a.snapshotHeights {
+		if height != snapshot.Height {
+			heights = append(heights, height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	if len(heights) > snapshotsKept {
+		heights = heights[len(heights)-snapshotsKept:]
+	}
+	a.snapshotHeights = heights
+	return nil
+}
+
+// snapshotFileNames returns the snapshot files in the folder, latest first
+func snapshotFileNames(snapshotFolder string) ([]string, error) {
+	fileNames, err := filepath.Glob(filepath.Join(snapshotFolder, "snapshot_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(fileNames)))
+	return fileNames, nil
+}
+
+// loadSnapshots returns the snapshots in the folder that can be read and verified, latest first
+func loadSnapshots(snapshotFolder string) ([]*Snapshot, error) {
+	snapshots := make([]*Snapshot, 0)
+	if snapshotFolder == "" {
+		return snapshots, nil
+	}
+
+	fileNames, err := snapshotFileNames(snapshotFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileName := range fileNames {
+		snapshotBytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot := &Snapshot{}
+		err = json.Unmarshal(snapshotBytes, snapshot)
+		if err == nil {
+			err = VerifySnapshot(snapshot)
+		}
+		if err != nil {
+			log.Printf("skipping snapshot %s: %s", fileName, err.Error())
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// latestSnapshotOnChain returns the latest snapshot in the snapshot folder whose block is on the chain, or nil if none of them are.
+// Without a snapshot folder the bootstrapped snapshot is the only one kept. Call with the mutex locked.
+func (a *AccountState) latestSnapshotOnChain(chain []*dto.BlockRequest) (*Snapshot, error) {
+	snapshots, err := loadSnapshots(a.snapshotFolder)
+	if err != nil {
+		return nil, err
+	}
+	if a.snapshotFolder == "" && a.bootstrapped != nil {
+		snapshots = append(snapshots, a.bootstrapped)
+	}
+	for _, snapshot := range snapshots {
+		if isOnChain(chain, snapshot.Height, snapshot.TipHash) {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkBootstrapped compares the accounts built up to the height of the bootstrapped snapshot from the blocks with the snapshot.
+// A snapshot that doesn't match is taken out of the snapshot folder so it is never started from again. Call with the mutex locked.
+func (a *AccountState) checkBootstrapped() error {
+	bootstrapped := a.bootstrapped
+	a.bootstrapped = nil
+
+	built := &Snapshot{
+		Version:  snapshotVersion,
+		Height:   a.height,
+		TipHash:  a.tipHash,
+		Accounts: a.accounts,
+	}
+	stateHash, err := built.stateHash()
+	if err != nil {
+		return err
+	}
+	if stateHash == bootstrapped.StateHash {
+		log.Printf("the bootstrapped snapshot at height %d matches the accounts built from the blocks", bootstrapped.Height)
+		return nil
+	}
+
+	log.Printf("the bootstrapped snapshot at height %d does not match the accounts built from the blocks, removing it", bootstrapped.Height)
+	if a.latestSnapshot == bootstrapped {
+		a.latestSnapshot = nil
+	}
+	heights := make([]int64, 0, len(a.snapshotHeights))
+	for _, height := range a.snapshotHeights {
+		if height != bootstrapped.Height {
+			heights = append(heights, height)
+		}
+	}
+	a.snapshotHeights = heights
+	if a.snapshotFolder == "" {
+		return nil
+	}
+	err = os.Remove(filepath.Join(a.snapshotFolder, fmt.Sprintf(snapshotFileFormat, bootstrapped.Height)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// OldestSnapshotHeight returns the height of the oldest snapshot kept in the snapshot folder, or 0 if there isn't one.
+// The blocks after it are the ones the account state can still be built again from after a reorg, so a pruning node keeps them whole.
+func (a *AccountState) OldestSnapshotHeight() int64 {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if len(a.snapshotHeights) == 0 {
+		return 0
+	}
+	return a.snapshotHeights[0]
+}
+
+// FetchSnapshot gets the latest snapshot from the node at the url and verifies it
+func FetchSnapshot(nodeURL string) (*Snapshot, error) {
+	resp, err := http.Get(nodeURL + "/state/snapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get a snapshot from %s: %s", nodeURL, string(respBodyBytes))
+	}
+
+	snapshot := &Snapshot{}
+	err = json.Unmarshal(respBodyBytes, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = VerifySnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
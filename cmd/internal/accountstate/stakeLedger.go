@@ -0,0 +1,100 @@
+package accountstate
+
+import (
+	"fmt"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// GetWrittenUserStake returns the coin the user has staked with the validator node in the written blocks
+func (a *AccountState) GetWrittenUserStake(userID, validatorPublicKey string) dto.Coin {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	account, found := a.accounts[userID]
+	if !found {
+		return 0
+	}
+	return account.Stakes[validatorPublicKey]
+}
+
+// GetWrittenValidatorStake returns the coin every user has staked with the validator node in the written blocks
+func (a *AccountState) GetWrittenValidatorStake(validatorPublicKey string) dto.Coin {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.validatorStakes[validatorPublicKey]
+}
+
+// addStake returns the stake of the user with the validator and the total stake of the validator after the stake or unstake transaction.
+// addStake returns an error if the user would unstake more than they have staked with the validator, or if either stake would overflow.
+func addStake(userStake, validatorStake dto.Coin, transaction *dto.Transaction) (newUserStake, newValidatorStake dto.Coin, err error) {
+	if transaction.Type == dto.TransactionTypeStake {
+		newUserStake, err = userStake.Add(transaction.CoinAmount)
+		if err != nil {
+			return 0, 0, err
+		}
+		newValidatorStake, err = validatorStake.Add(transaction.CoinAmount)
+		if err != nil {
+			return 0, 0, fmt.Errorf("the stake of the validator would overflow: %s", err.Error())
+		}
+		return newUserStake, newValidatorStake, nil
+	}
+
+	newUserStake, err = userStake.Sub(transaction.CoinAmount)
+	if err == nil && newUserStake < 0 {
+		err = fmt.Errorf("can't unstake more coin than is staked with the validator")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	newValidatorStake, err = validatorStake.Sub(transaction.CoinAmount)
+	if err != nil {
+		return 0, 0, err
+	}
+	return newUserStake, newValidatorStake, nil
+}
+
+// StakeLedger keeps track of the stakes changed by the transactions of a block that is being checked, on top of the written stakes.
+type StakeLedger struct {
+	accountState *AccountState
+	// userStakes are the coin staked by a user with a validator, by "<user>|<validator>"
+	userStakes      map[string]dto.Coin
+	validatorStakes map[string]dto.Coin
+}
+
+// NewStakeLedger returns an instance of the StakeLedger struct for checking the stake and unstake transactions of one block.
+func (a *AccountState) NewStakeLedger() *StakeLedger {
+	return &StakeLedger{
+		accountState:    a,
+		userStakes:      make(map[string]dto.Coin),
+		validatorStakes: make(map[string]dto.Coin),
+	}
+}
+
+// Apply adds the coin of a stake transaction to the ledger and takes away the coin of an unstake transaction.
+// Apply returns an error and changes nothing if the from-user would unstake more than they have staked with the validator,
+// or if the stake of the user or the validator would overflow. Other transactions are ignored.
+func (l *StakeLedger) Apply(transaction *dto.Transaction) error {
+	if transaction.Type != dto.TransactionTypeStake && transaction.Type != dto.TransactionTypeUnstake {
+		return nil
+	}
+
+	key := transaction.From + "|" + transaction.To
+	userStake, found := l.userStakes[key]
+	if !found {
+		userStake = l.accountState.GetWrittenUserStake(transaction.From, transaction.To)
+	}
+	validatorStake, found := l.validatorStakes[transaction.To]
+	if !found {
+		validatorStake = l.accountState.GetWrittenValidatorStake(transaction.To)
+	}
+
+	userStake, validatorStake, err := addStake(userStake, validatorStake, transaction)
+	if err != nil {
+		return err
+	}
+
+	l.userStakes[key] = userStake
+	l.validatorStakes[transaction.To] = validatorStake
+	return nil
+}
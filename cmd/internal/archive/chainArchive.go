@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/integrity"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+)
+
+// ArchiveFormat is the format of the chain archives this version writes and reads, so a future change to the format can be told apart
+const ArchiveFormat = "blockchain-miniproject-chain/1"
+
+// ErrNotEmpty is returned by ImportChain when the block store already has blocks
+var ErrNotEmpty = errors.New("the block store already has blocks, import into an empty block store")
+
+// Manifest is the first line of a chain archive. It says what chain the blocks on the lines after it make up,
+// so the chain can be checked once the last block is read.
+type Manifest struct {
+	Format      string `json:"format"`
+	Consensus   string `json:"consensus"`
+	GenesisHash string `json:"genesisHash"`
+	TipHash     string `json:"tipHash"`
+	BlockCount  int64  `json:"blockCount"`
+	// MerkleRoot is the root of the merkle tree over the block hashes from the first block to the tip
+	MerkleRoot string `json:"merkleRoot"`
+}
+
+// ExportChain writes the chain in the block store to w as a chain archive: the manifest on the first line and then each block of the chain
+// on its own line from the first block to the tip, as newline delimited json. Dropped blocks aren't on the chain, so they aren't exported.
+// The block store is read twice, once for the manifest and once for the blocks, so it shouldn't be written to while it is exported.
+func ExportChain(blockStore storage.BlockStore, consensusName string, w io.Writer) (*Manifest, error) {
+	height, _, err := blockStore.Tip()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, height)
+	err = blockStore.Iterate(1, height, func(height int64, block *dto.BlockRequest) error {
+		hashes = append(hashes, block.ProofOfWorkHash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Format:     ArchiveFormat,
+		Consensus:  consensusName,
+		BlockCount: height,
+		MerkleRoot: dto.MerkleRoot(hashes),
+	}
+	if height > 0 {
+		manifest.GenesisHash = hashes[0]
+		manifest.TipHash = hashes[height-1]
+	}
+
+	bufferedWriter := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bufferedWriter)
+	err = encoder.Encode(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = blockStore.Iterate(1, height, func(height int64, block *dto.BlockRequest) error {
+		if block.ProofOfWorkHash != hashes[height-1] {
+			return fmt.Errorf("the block at height %d changed while the chain was exported", height)
+		}
+		return encoder.Encode(block)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = bufferedWriter.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ImportChain reads a chain archive from r and puts each block in the block store, which has to be empty.
+// Each block is checked the way a node checks a block it is sent, with the engine replayed from the first block, before it is put in the block store.
+// That includes the node signatures written with the block, and the blocks written before the header had a difficulty or the signatures were kept,
+// the same way as the verify command, see integrity.ChainChecker.
+// The chain is checked against the manifest once the last block is read. The blocks are put in the block store as they are read,
+// so when ImportChain returns an error the blocks before the one that failed are already in the block store.
+func ImportChain(r io.Reader, blockStore storage.BlockStore, engine consensus.Engine) (*Manifest, error) {
+	height, _, err := blockStore.Tip()
+	if err != nil {
+		return nil, err
+	}
+	if height != 0 {
+		return nil, ErrNotEmpty
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	manifest := &Manifest{}
+	err = decoder.Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the manifest of the chain archive: %s", err.Error())
+	}
+	if manifest.Format != ArchiveFormat {
+		return nil, fmt.Errorf("unknown chain archive format %q, expected %q", manifest.Format, ArchiveFormat)
+	}
+	if manifest.Consensus != engine.Name() {
+		return nil, fmt.Errorf("the chain archive was written with the %q consensus engine, not %q", manifest.Consensus, engine.Name())
+	}
+
+	checker := integrity.NewChainChecker(engine)
+	hashes := make([]string, 0, manifest.BlockCount)
+	for decoder.More() {
+		height++
+		if height > manifest.BlockCount {
+			return nil, fmt.Errorf("the chain archive has more blocks than the %d in its manifest", manifest.BlockCount)
+		}
+
+		block := &dto.BlockRequest{}
+		err = decoder.Decode(block)
+		if err != nil {
+			return nil, fmt.Errorf("could not read block %d of the chain archive: %s", height, err.Error())
+		}
+
+		err = checker.CheckBlock(block)
+		if err != nil {
+			return nil, fmt.Errorf("block %d %s of the chain archive is not valid: %s", height, block.ProofOfWorkHash, err.Error())
+		}
+
+		_, err = blockStore.Put(block)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, block.ProofOfWorkHash)
+	}
+
+	if height != manifest.BlockCount {
+		return nil, fmt.Errorf("the chain archive has %d blocks, its manifest says %d", height, manifest.BlockCount)
+	}
+	if height > 0 && (hashes[0] != manifest.GenesisHash || hashes[height-1] != manifest.TipHash) {
+		return nil, fmt.Errorf("the first block or the tip of the chain archive don't match its manifest")
+	}
+	if dto.MerkleRoot(hashes) != manifest.MerkleRoot {
+		return nil, fmt.Errorf("the merkle root of the blocks in the chain archive doesn't match its manifest")
+	}
+	return manifest, nil
+}
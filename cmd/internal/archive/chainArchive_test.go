@@ -0,0 +1,264 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+)
+
+// testDifficulty keeps sealing the blocks after the baseline blocks quick
+const testDifficulty = 1 << 8
+
+// the baseline types are the block json before the header had a difficulty or a height, the coin amounts were float64 and the node signatures weren't kept
+
+type baselineTransaction struct {
+	Key        string  `json:"key"`
+	Value      string  `json:"value"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	CoinAmount float64 `json:"coinAmount"`
+}
+
+type baselineTransactionSubmission struct {
+	ID                string               `json:"id"`
+	Timestamp         string               `json:"timestamp"`
+	TransactionStatus string               `json:"transactionStatus"`
+	DroppedReason     string               `json:"droppedReason"`
+	BodySigned        string               `json:"bodySigned"`
+	Submitted         *baselineTransaction `json:"submit"`
+}
+
+type baselineHeader struct {
+	PrevBlockHash    string `json:"prev-block-hash"`
+	TransactionsHash string `json:"transactions-hash"`
+	Time             string `json:"time"`
+	Nonce            string `json:"nonce"`
+}
+
+type baselineBlock struct {
+	OriginNodePublicKey string                           `json:"originNodePublicKey"`
+	ProofOfWorkHash     string                           `json:"proofOfWorkHash"`
+	Header              *baselineHeader                  `json:"header"`
+	Transactions        []*baselineTransactionSubmission `json:"transactions"`
+}
+
+// testNode is a node key, the public key is formatted the way nodes send it
+type testNode struct {
+	privateKey *rsa.PrivateKey
+	publicKey  string
+}
+
+func newTestNode(t *testing.T) *testNode {
+	privateKey, publicKey, err := autograph.NewSig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testNode{privateKey: privateKey, publicKey: string(autograph.PublicKeyToBytes(publicKey))}
+}
+
+func (n *testNode) sign(t *testing.T, body []byte) string {
+	signature, err := autograph.Sign(n.privateKey, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%x", signature)
+}
+
+func transactionsHash(t *testing.T, transactions interface{}) string {
+	transactionsBytes, err := json.Marshal(transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(transactionsBytes))
+}
+
+// baselineChain seals blocks the way the baseline wrote them, each with a transaction of 0 coin signed by the user
+func baselineChain(t *testing.T, engine consensus.Engine, origin, user *testNode, count int) []*baselineBlock {
+	chain := make([]*baselineBlock, 0, count)
+	prevBlockHash := ""
+	for i := 0; i < count; i++ {
+		submitted := &baselineTransaction{
+			Key:   "key",
+			Value: fmt.Sprintf("value %d", i),
+			From:  user.publicKey,
+			To:    origin.publicKey,
+		}
+		submittedBytes, err := json.Marshal(submitted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transactions := []*baselineTransactionSubmission{{
+			ID:                fmt.Sprintf("transaction-%d", i),
+			Timestamp:         strconv.Itoa(1000 + i),
+			TransactionStatus: "accepted",
+			BodySigned:        user.sign(t, submittedBytes),
+			Submitted:         submitted,
+		}}
+
+		// without a difficulty the proof of work hash has to start with 5 zeros like it did then
+		header := &dto.BlockHeader{
+			PrevBlockHash:    prevBlockHash,
+			TransactionsHash: transactionsHash(t, transactions),
+			Time:             strconv.Itoa(1000 + i),
+		}
+		blockHash, err := engine.Seal(header, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(blockHash, "00000") {
+			t.Fatalf("the baseline block hash %s doesn't start with 5 zeros", blockHash)
+		}
+
+		chain = append(chain, &baselineBlock{
+			OriginNodePublicKey: origin.publicKey,
+			ProofOfWorkHash:     blockHash,
+			Header: &baselineHeader{
+				PrevBlockHash:    header.PrevBlockHash,
+				TransactionsHash: header.TransactionsHash,
+				Time:             header.Time,
+				Nonce:            header.Nonce,
+			},
+			Transactions: transactions,
+		})
+		prevBlockHash = blockHash
+	}
+	return chain
+}
+
+// signedBlock proposes and seals an empty block after the previous block, and signs it with the origin node and the other signers
+func signedBlock(t *testing.T, engine consensus.Engine, prevBlockHash string, blockTime int64, origin *testNode, signers ...*testNode) *dto.BlockRequest {
+	transactions := make([]*dto.TransactionSubmission, 0)
+	header := &dto.BlockHeader{
+		PrevBlockHash:    prevBlockHash,
+		TransactionsHash: transactionsHash(t, transactions),
+		Time:             strconv.FormatInt(blockTime, 10),
+	}
+	err := engine.Propose(header, origin.publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHash, err := engine.Seal(header, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &dto.BlockRequest{
+		OriginNodePublicKey: origin.publicKey,
+		ProofOfWorkHash:     blockHash,
+		Header:              header,
+		Transactions:        transactions,
+	}
+	signedBlockBytes, err := dto.SignedBlockBytes(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range append([]*testNode{origin}, signers...) {
+		block.NodeSignatures = append(block.NodeSignatures, &dto.NodeSignature{
+			PublicKey:          signer.publicKey,
+			SignedBlockRequest: signer.sign(t, signedBlockBytes),
+		})
+	}
+	return block
+}
+
+// chainArchive writes the blocks as a chain archive with a manifest for them
+func chainArchive(t *testing.T, blocks []interface{}, hashes []string) *bytes.Buffer {
+	archive := &bytes.Buffer{}
+	encoder := json.NewEncoder(archive)
+	err := encoder.Encode(&Manifest{
+		Format:      ArchiveFormat,
+		Consensus:   consensus.ProofOfWorkName,
+		GenesisHash: hashes[0],
+		TipHash:     hashes[len(hashes)-1],
+		BlockCount:  int64(len(hashes)),
+		MerkleRoot:  dto.MerkleRoot(hashes),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		err = encoder.Encode(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return archive
+}
+
+func TestImportBaselineChain(t *testing.T) {
+	origin := newTestNode(t)
+	signer := newTestNode(t)
+	user := newTestNode(t)
+
+	// the engine that seals the blocks is replayed along with them, so the blocks after the baseline blocks get the difficulty the import expects
+	sealEngine := consensus.NewProofOfWorkEngine(testDifficulty, 0, 0, 1)
+	legacyBlocks := baselineChain(t, sealEngine, origin, user, 2)
+
+	blocks := make([]interface{}, 0)
+	hashes := make([]string, 0)
+	for _, block := range legacyBlocks {
+		blocks = append(blocks, block)
+		hashes = append(hashes, block.ProofOfWorkHash)
+
+		blockRequest := &dto.BlockRequest{Header: &dto.BlockHeader{Time: block.Header.Time}}
+		sealEngine.BlockWritten(blockRequest)
+	}
+	signed := signedBlock(t, sealEngine, hashes[len(hashes)-1], 2000, origin, signer)
+	blocks = append(blocks, signed)
+	hashes = append(hashes, signed.ProofOfWorkHash)
+	sealEngine.BlockWritten(signed)
+	next := signedBlock(t, sealEngine, signed.ProofOfWorkHash, 2001, origin, signer)
+
+	blockStore := storage.NewMemoryBlockStore()
+	manifest, err := ImportChain(chainArchive(t, append(blocks, next), append(hashes, next.ProofOfWorkHash)), blockStore, consensus.NewProofOfWorkEngine(testDifficulty, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BlockCount != 4 {
+		t.Fatalf("imported %d blocks instead of 4", manifest.BlockCount)
+	}
+	height, tip, err := blockStore.Tip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 4 || tip.ProofOfWorkHash != next.ProofOfWorkHash {
+		t.Fatalf("the block store is at height %d with tip %s after the import", height, tip.ProofOfWorkHash)
+	}
+
+	// the first node signature has to be a valid one from the origin node, and a block after a signed block has to be signed too
+	forged := *next
+	forged.NodeSignatures = []*dto.NodeSignature{{PublicKey: origin.publicKey, SignedBlockRequest: next.NodeSignatures[1].SignedBlockRequest}}
+	unsigned := *next
+	unsigned.NodeSignatures = nil
+	for _, badBlock := range []*dto.BlockRequest{&forged, &unsigned} {
+		_, err = ImportChain(chainArchive(t, append(blocks, badBlock), append(hashes, next.ProofOfWorkHash)), storage.NewMemoryBlockStore(), consensus.NewProofOfWorkEngine(testDifficulty, 0, 0, 1))
+		if err == nil || !strings.Contains(err.Error(), "block 4 ") {
+			t.Fatalf("the chain archive was imported with node signatures %v on the last block: %v", badBlock.NodeSignatures, err)
+		}
+	}
+
+	// a pruned block keeps its node signatures and the hash of the json they sign
+	pruned, err := dto.PruneBlock(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportChain(chainArchive(t, append(blocks, pruned), append(hashes, next.ProofOfWorkHash)), storage.NewMemoryBlockStore(), consensus.NewProofOfWorkEngine(testDifficulty, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("the pruned block was not imported: %s", err.Error())
+	}
+	pruned.SignedBlockHash = fmt.Sprintf("%x", sha256.Sum256([]byte("another block")))
+	_, err = ImportChain(chainArchive(t, append(blocks, pruned), append(hashes, next.ProofOfWorkHash)), storage.NewMemoryBlockStore(), consensus.NewProofOfWorkEngine(testDifficulty, 0, 0, 1))
+	if err == nil {
+		t.Fatal("the pruned block was imported with a signed block hash its node signatures don't sign")
+	}
+}
@@ -0,0 +1,77 @@
+package autograph
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// LoadOrCreateSig reads the RSA private key from the PEM key file, or creates a new key and saves it to the file when the file doesn't exist yet.
+// Keeping the key in a file lets a node keep the same public key across restarts, so other nodes can know it as a validator.
+func LoadOrCreateSig(keyFile string) (privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey, err error) {
+	keyBytes, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		privateKey, publicKey, err = NewSig()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ioutil.WriteFile(keyFile, PrivateKeyToBytes(privateKey), 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, publicKey, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM key found in %s", keyFile)
+	}
+	privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, &privateKey.PublicKey, nil
+}
+
+// ReadPublicKeysFile reads the PEM public keys of nodes from the file, in the order they are in the file.
+// The keys are formatted the same way nodes send their public keys so that they can be compared as strings.
+func ReadPublicKeysFile(keysFile string) ([]string, error) {
+	fileBytes, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeys := make([]string, 0)
+	rest := fileBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		publicKey := BytesToPublicKey(pem.EncodeToMemory(block))
+		if publicKey == nil {
+			return nil, fmt.Errorf("key %d in %s is not an RSA public key", len(publicKeys)+1, keysFile)
+		}
+		publicKeys = append(publicKeys, string(PublicKeyToBytes(publicKey)))
+	}
+
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", keysFile)
+	}
+	return publicKeys, nil
+}
+
+// PrivateKeyToBytes converts the private key to bytes as a PEM key, the same format testsignature takes for -private-key
+func PrivateKeyToBytes(priv *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+}
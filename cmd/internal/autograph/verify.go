@@ -17,6 +17,11 @@ func Verify(body, signedBody []byte, publicKey *rsa.PublicKey) error {
 
 	hashed := hash.Sum(nil)
 
+	return VerifyHashed(hashed, signedBody, publicKey)
+}
+
+// VerifyHashed verifies the result of Sign() when only the SHA256 hash of the body is kept. Errors when verifying fails.
+func VerifyHashed(hashed, signedBody []byte, publicKey *rsa.PublicKey) error {
 	err := rsa.VerifyPSS(publicKey, crypto.SHA256, hashed, signedBody, nil)
 	if err != nil {
 		return err
@@ -0,0 +1,242 @@
+package blocktree
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// maxRecentReorgs is how many reorg events are kept for the chain reorgs endpoint
+const maxRecentReorgs = 100
+
+// ReorgEvent describes the node switching its main chain to a heavier branch
+type ReorgEvent struct {
+	Time                 string   `json:"time"`
+	OldTip               string   `json:"oldTip"`
+	NewTip               string   `json:"newTip"`
+	CommonAncestor       string   `json:"commonAncestor"`
+	RolledBack           []string `json:"rolledBack"`
+	Applied              []string `json:"applied"`
+	OrphanedTransactions int      `json:"orphanedTransactions"`
+}
+
+// BlockTree is the struct that keeps every block the node has accepted, on the main chain and on side branches, with a mutex lock.
+// Each block knows its height and the cumulative weight of its branch, so the node can tell when a side branch has become heavier than the main chain.
+// The root of the tree is the empty previous hash that the first block builds on.
+type BlockTree struct {
+	mx          *sync.Mutex
+	blocks      map[string]*treeBlock
+	tip         string
+	reorgs      []*ReorgEvent
+	subscribers []chan *ReorgEvent
+}
+
+type treeBlock struct {
+	block  *dto.BlockRequest
+	parent string
+	height int64
+	weight *big.Int
+}
+
+// NewBlockTree returns an instance of the BlockTree struct with only the root.
+func NewBlockTree() *BlockTree {
+	return &BlockTree{
+		mx: &sync.Mutex{},
+		blocks: map[string]*treeBlock{
+			"": {
+				weight: new(big.Int),
+			},
+		},
+	}
+}
+
+// Tip returns the hash of the last block on the main chain
+func (t *BlockTree) Tip() string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.tip
+}
+
+// HasBlock returns if the block hash is in the tree on any branch
+func (t *BlockTree) HasBlock(blockHash string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	_, found := t.blocks[blockHash]
+	return found
+}
+
+// Height returns the height of the block in the tree. The first block is height 1.
+func (t *BlockTree) Height(blockHash string) (int64, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	node, found := t.blocks[blockHash]
+	if !found {
+		return 0, false
+	}
+	return node.height, true
+}
+
+// Add puts the block in the tree under its previous block with the weight the consensus engine gave it.
+// Add returns an error when the previous block isn't known, the block is already in the tree or the block height isn't one more than the previous block.
+func (t *BlockTree) Add(block *dto.BlockRequest, weight uint64) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if _, found := t.blocks[block.ProofOfWorkHash]; found {
+		return fmt.Errorf("block %s is already in the block tree", block.ProofOfWorkHash)
+	}
+	parent, found := t.blocks[block.Header.PrevBlockHash]
+	if !found {
+		return fmt.Errorf("the previous block %s is not in the block tree", block.Header.PrevBlockHash)
+	}
+	// blocks written before the header had a height take the height of where they are in the tree
+	if block.Header.Height != 0 && block.Header.Height != parent.height+1 {
+		return fmt.Errorf("block %s has height %d but the previous block is at height %d", block.ProofOfWorkHash, block.Header.Height, parent.height)
+	}
+
+	t.blocks[block.ProofOfWorkHash] = &treeBlock{
+		block:  block,
+		parent: block.Header.PrevBlockHash,
+		height: parent.height + 1,
+		weight: new(big.Int).Add(parent.weight, new(big.Int).SetUint64(weight)),
+	}
+	return nil
+}
+
+// Remove takes the block and every block that builds on it out of the tree, for a side branch that turned out to be invalid.
+// Remove returns an error for a block on the main chain.
+func (t *BlockTree) Remove(blockHash string) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if _, found := t.blocks[blockHash]; !found || blockHash == "" {
+		return fmt.Errorf("block %s is not in the block tree", blockHash)
+	}
+	for hash := t.tip; hash != ""; hash = t.blocks[hash].parent {
+		if hash == blockHash {
+			return fmt.Errorf("block %s is on the main chain", blockHash)
+		}
+	}
+
+	removed := map[string]bool{blockHash: true}
+	for removedMore := true; removedMore; {
+		removedMore = false
+		for hash, node := range t.blocks {
+			if !removed[hash] && removed[node.parent] && hash != "" {
+				removed[hash] = true
+				removedMore = true
+			}
+		}
+	}
+	for hash := range removed {
+		delete(t.blocks, hash)
+	}
+	return nil
+}
+
+// IsHeavierThanTip returns if the branch ending at the block has more cumulative weight than the main chain.
+// A branch with the same weight doesn't win, so the node sticks with the chain it already has.
+func (t *BlockTree) IsHeavierThanTip(blockHash string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	node, found := t.blocks[blockHash]
+	if !found {
+		return false
+	}
+	return node.weight.Cmp(t.blocks[t.tip].weight) > 0
+}
+
+// Branches returns the common ancestor of the main chain and the branch ending at newTip,
+// the main chain blocks to roll back from the tip down, and the branch blocks to apply from the ancestor up.
+func (t *BlockTree) Branches(newTip string) (commonAncestor string, rollBack []*dto.BlockRequest, apply []*dto.BlockRequest, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if _, found := t.blocks[newTip]; !found {
+		return "", nil, nil, fmt.Errorf("block %s is not in the block tree", newTip)
+	}
+
+	onMainChain := make(map[string]bool)
+	for hash := t.tip; hash != ""; hash = t.blocks[hash].parent {
+		onMainChain[hash] = true
+	}
+
+	apply = make([]*dto.BlockRequest, 0)
+	commonAncestor = newTip
+	for commonAncestor != "" && !onMainChain[commonAncestor] {
+		apply = append(apply, t.blocks[commonAncestor].block)
+		commonAncestor = t.blocks[commonAncestor].parent
+	}
+	// apply from the ancestor up
+	for i, j := 0, len(apply)-1; i < j; i, j = i+1, j-1 {
+		apply[i], apply[j] = apply[j], apply[i]
+	}
+
+	rollBack = make([]*dto.BlockRequest, 0)
+	for hash := t.tip; hash != commonAncestor; hash = t.blocks[hash].parent {
+		rollBack = append(rollBack, t.blocks[hash].block)
+	}
+
+	return commonAncestor, rollBack, apply, nil
+}
+
+// MainChain returns the blocks of the main chain from the first block to the tip
+func (t *BlockTree) MainChain() []*dto.BlockRequest {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	chain := make([]*dto.BlockRequest, 0)
+	for hash := t.tip; hash != ""; hash = t.blocks[hash].parent {
+		chain = append(chain, t.blocks[hash].block)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// SetTip makes the block the tip of the main chain. Only the block writer should set the tip.
+func (t *BlockTree) SetTip(blockHash string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.tip = blockHash
+}
+
+// Subscribe returns a channel that gets every reorg event from now on.
+// Events are skipped for a subscriber that isn't keeping up instead of holding up the block writer.
+func (t *BlockTree) Subscribe() <-chan *ReorgEvent {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	subscriber := make(chan *ReorgEvent, 10)
+	t.subscribers = append(t.subscribers, subscriber)
+	return subscriber
+}
+
+// EmitReorg records the reorg event for RecentReorgs and sends it to the subscribers
+func (t *BlockTree) EmitReorg(event *ReorgEvent) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.reorgs = append(t.reorgs, event)
+	if len(t.reorgs) > maxRecentReorgs {
+		t.reorgs = t.reorgs[len(t.reorgs)-maxRecentReorgs:]
+	}
+
+	for _, subscriber := range t.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// RecentReorgs returns the last reorg events, oldest first
+func (t *BlockTree) RecentReorgs() []*ReorgEvent {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return append([]*ReorgEvent{}, t.reorgs...)
+}
@@ -0,0 +1,184 @@
+package consensus
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// maxTarget is the largest sha256 hash. The target for a difficulty is maxTarget / difficulty,
+// so a difficulty of 1048576 (2^20) needs the same 5 leading hex zeros the original proof of work asked for.
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// legacyDifficulty is the difficulty of the blocks written before the header had a difficulty, which have 0 in the header.
+// Its target is exactly the hashes starting with the 5 hex zeros those blocks were mined to.
+const legacyDifficulty = 1 << 20
+
+// maxFutureBlockSeconds is how far the header time of a new block can be ahead of this node's clock,
+// so a miner can't stretch the adjustment window to bring the difficulty down
+const maxFutureBlockSeconds = 5 * 60
+
+// maxAdjustFactor keeps a single adjustment from moving the difficulty more than 4 times up or down,
+// so a long quiet stretch with no transactions doesn't drop the difficulty to nothing in one step
+const maxAdjustFactor = 4
+
+// TargetForDifficulty returns the numeric target a proof of work hash has to be at or below for the difficulty.
+// A difficulty of 0 is a block from before the header had a difficulty, see legacyDifficulty.
+func TargetForDifficulty(difficulty uint64) *big.Int {
+	if difficulty == 0 {
+		difficulty = legacyDifficulty
+	}
+	return new(big.Int).Div(maxTarget, new(big.Int).SetUint64(difficulty))
+}
+
+// HashMeetsDifficulty returns if the hex encoded proof of work hash is at or below the target for the difficulty.
+func HashMeetsDifficulty(proofOfWorkHash string, difficulty uint64) bool {
+	hashValue, ok := new(big.Int).SetString(proofOfWorkHash, 16)
+	if !ok {
+		return false
+	}
+	return hashValue.Cmp(TargetForDifficulty(difficulty)) <= 0
+}
+
+// DifficultyRunner is the struct that works out the difficulty the next block must commit to in its header, with a mutex lock.
+// Every adjustEvery written blocks the difficulty is recalculated from how long those blocks took compared to targetBlockSeconds.
+// Every node writes the same blocks in the same order, so every node calculates the same difficulty.
+type DifficultyRunner struct {
+	mx                 *sync.Mutex
+	initialDifficulty  uint64
+	difficulty         uint64
+	adjustEvery        int64
+	targetBlockSeconds int64
+	blocksInWindow     int64
+	windowStartTime    int64
+	// committed is if a written block has committed to a difficulty, after which blocks without a difficulty aren't valid anymore
+	committed bool
+	// lastBlockTime is the header time of the last written block, and 0 before the first block
+	lastBlockTime int64
+}
+
+// NewDifficultyRunner returns an instance of the DifficultyRunner struct starting at the initial difficulty.
+func NewDifficultyRunner(initialDifficulty uint64, adjustEvery, targetBlockSeconds int64) *DifficultyRunner {
+	if initialDifficulty == 0 {
+		initialDifficulty = 1
+	}
+	return &DifficultyRunner{
+		mx:                 &sync.Mutex{},
+		initialDifficulty:  initialDifficulty,
+		difficulty:         initialDifficulty,
+		adjustEvery:        adjustEvery,
+		targetBlockSeconds: targetBlockSeconds,
+	}
+}
+
+// GetDifficulty will use the mutex lock to return the difficulty the next block has to commit to.
+func (d *DifficultyRunner) GetDifficulty() uint64 {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.difficulty
+}
+
+// reset goes back to the initial difficulty with an empty adjustment window, so the chain can be recorded again from the first block
+func (d *DifficultyRunner) reset() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.difficulty = d.initialDifficulty
+	d.blocksInWindow = 0
+	d.windowStartTime = 0
+	d.committed = false
+	d.lastBlockTime = 0
+}
+
+// acceptsLegacy returns if a block without a difficulty can still be written, which is only until a written block commits to one
+func (d *DifficultyRunner) acceptsLegacy() bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return !d.committed
+}
+
+// getLastBlockTime will use the mutex lock to return the header time of the last written block, or 0 before the first block
+func (d *DifficultyRunner) getLastBlockTime() int64 {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.lastBlockTime
+}
+
+// validateTime returns an error if the header time of the next block can't be parsed or isn't after the last written block,
+// and, when now isn't 0, if it is more than maxFutureBlockSeconds ahead of now.
+// Blocks without a difficulty were mined by nodes that didn't check the time against the block before, so they are only checked against now.
+func (d *DifficultyRunner) validateTime(blockHeader *dto.BlockHeader, now int64) error {
+	blockTime, err := strconv.ParseInt(blockHeader.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse the block header time: %s", err.Error())
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if blockHeader.Difficulty != 0 && blockTime <= d.lastBlockTime {
+		return fmt.Errorf("the block header time %d is not after the time %d of the block before it", blockTime, d.lastBlockTime)
+	}
+	if now != 0 && blockTime > now+maxFutureBlockSeconds {
+		return fmt.Errorf("the block header time is %d seconds ahead of this node's time", blockTime-now)
+	}
+	return nil
+}
+
+// recordBlock counts a written block toward the current adjustment window and adjusts the difficulty at the end of the window.
+// don't export so that only the engine can record blocks when they are written
+func (d *DifficultyRunner) recordBlock(blockHeader *dto.BlockHeader) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if blockHeader.Difficulty != 0 {
+		d.committed = true
+	}
+
+	blockTime, err := strconv.ParseInt(blockHeader.Time, 10, 64)
+	if err != nil {
+		return
+	}
+	d.lastBlockTime = blockTime
+	if d.adjustEvery <= 0 {
+		return
+	}
+
+	if d.blocksInWindow == 0 {
+		d.windowStartTime = blockTime
+	}
+	d.blocksInWindow++
+	if d.blocksInWindow <= d.adjustEvery {
+		return
+	}
+
+	// the window is measured from its first block to the block after its last block, so it covers adjustEvery block intervals
+	actualSeconds := blockTime - d.windowStartTime
+	expectedSeconds := d.adjustEvery * d.targetBlockSeconds
+	if actualSeconds < expectedSeconds/maxAdjustFactor {
+		actualSeconds = expectedSeconds / maxAdjustFactor
+	}
+	if actualSeconds > expectedSeconds*maxAdjustFactor {
+		actualSeconds = expectedSeconds * maxAdjustFactor
+	}
+	if actualSeconds <= 0 {
+		actualSeconds = 1
+	}
+
+	newDifficulty := new(big.Int).SetUint64(d.difficulty)
+	newDifficulty.Mul(newDifficulty, big.NewInt(expectedSeconds))
+	newDifficulty.Div(newDifficulty, big.NewInt(actualSeconds))
+	if newDifficulty.Sign() <= 0 {
+		newDifficulty.SetInt64(1)
+	}
+	if newDifficulty.IsUint64() {
+		d.difficulty = newDifficulty.Uint64()
+	}
+
+	// this block starts the next window
+	d.blocksInWindow = 1
+	d.windowStartTime = blockTime
+}
@@ -0,0 +1,78 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+var (
+	// ErrSealAborted is returned by Seal when the stop channel is closed before the block is sealed
+	ErrSealAborted = errors.New("sealing the block was aborted")
+	// ErrNotProposer is returned by Propose when this node is not allowed to propose the next block
+	ErrNotProposer = errors.New("this node is not the proposer for the next block")
+	// ErrGovernanceNotSupported is returned by ValidateTransaction for governance transactions when the engine has no validators to govern
+	ErrGovernanceNotSupported = errors.New("governance transactions are only for proof of authority")
+)
+
+// Engine is the consensus algorithm the node uses to build, check and finalize blocks.
+// The block builder proposes and seals its own blocks with it, the block sign and block endpoints validate seals with it,
+// and both use it to decide if a block has collected enough signatures to be written.
+type Engine interface {
+	// Name returns the name that selects the engine with the --consensus flag
+	Name() string
+
+	// Propose fills in the consensus fields of a new block header that builds on header.PrevBlockHash.
+	// Propose returns ErrNotProposer when the node with the proposer public key is not allowed to propose the next block.
+	Propose(blockHeader *dto.BlockHeader, proposerPublicKey string) error
+
+	// Seal does whatever makes the proposed header valid for the other nodes, and returns the block hash.
+	// Seal returns ErrSealAborted as soon as stop is closed. stop may be nil.
+	Seal(blockHeader *dto.BlockHeader, stop <-chan struct{}) (blockHash string, err error)
+
+	// ValidateSeal checks the consensus fields and the seal of a block from another node against this node's own chain.
+	ValidateSeal(block *dto.BlockRequest) error
+
+	// ValidateReplayedSeal checks the consensus fields and the seal of a block that is already on a chain, against the engine state
+	// replayed through BlockWritten up to the block before it. It checks everything ValidateSeal does except the header time against this node's clock.
+	ValidateReplayedSeal(block *dto.BlockRequest) error
+
+	// ValidateBranchSeal checks the seal of a block that builds on a side branch. It can only check what doesn't depend on the state of this node's chain.
+	ValidateBranchSeal(block *dto.BlockRequest) error
+
+	// BlockWeight returns how much the block adds to the weight of its branch. The heaviest branch is the main chain.
+	BlockWeight(block *dto.BlockRequest) uint64
+
+	// IsFinal decides if the valid signatures for the block are enough for the block to be written to the chain.
+	// signerPublicKeys include the origin node. activeNodes is the number of nodes the block was sent to including this one,
+	// or 0 when it isn't known.
+	IsFinal(block *dto.BlockRequest, signerPublicKeys []string, activeNodes int) bool
+
+	// ValidateTransaction checks the parts of a transaction that depend on the consensus engine, like the validator approvals on governance transactions.
+	ValidateTransaction(transactionSub *dto.TransactionSubmission) error
+
+	// BlockWritten lets the engine update its state from every block that is written to the chain
+	BlockWritten(block *dto.BlockRequest)
+
+	// Reset puts the engine back to how it was before the first block, so the main chain can be replayed through BlockWritten after a reorg
+	Reset()
+}
+
+// validateHeaderHash checks a block without a difficulty has the hash of its header, for the engines where sealing is only hashing
+func validateHeaderHash(block *dto.BlockRequest) error {
+	if block.Header.Difficulty != 0 {
+		return fmt.Errorf("blocks without proof of work don't have a difficulty")
+	}
+
+	blockHeaderBytes, err := json.Marshal(block.Header)
+	if err != nil {
+		return fmt.Errorf("could not marshal json of block header to verify hash: %s", err.Error())
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != block.ProofOfWorkHash {
+		return fmt.Errorf("mismatching block header hash")
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// ProofOfAuthorityName is the --consensus flag value for proof of authority
+const ProofOfAuthorityName = "poa"
+
+// proofOfAuthorityEngine is for permissioned deployments where a known set of validator nodes takes turns proposing blocks.
+// The proposer for each height goes round-robin through the validators. If the proposer hasn't written the block
+// within a slot of the last block, the turn passes to the next validator so one node being down doesn't stop the chain.
+// A block needs signatures from signatureFraction of the validators.
+type proofOfAuthorityEngine struct {
+	mx                *sync.Mutex
+	genesisValidators []string
+	validators        []string
+	signatureFraction float64
+	slotSeconds       int64
+	height            int64
+	lastBlockTime     int64
+	// validatorSetHeight is the height of the last block that changed the validators, which the governance approvals have to sign
+	validatorSetHeight int64
+	// now is the unix time, can be swapped out for a fake clock
+	now func() int64
+}
+
+// NewProofOfAuthorityEngine returns the proof of authority consensus engine with the validator node public keys from genesis or config.
+func NewProofOfAuthorityEngine(validators []string, signatureFraction float64, slotSeconds int64) (Engine, error) {
+	if len(validators) == 0 {
+		return nil, fmt.Errorf("proof of authority needs at least 1 validator")
+	}
+	if signatureFraction <= 0 || signatureFraction > 1 {
+		return nil, fmt.Errorf("the validator signature fraction has to be more than 0 and at most 1, got %v", signatureFraction)
+	}
+	if slotSeconds <= 0 {
+		slotSeconds = 1
+	}
+
+	seen := make(map[string]bool)
+	for _, validator := range validators {
+		if seen[validator] {
+			return nil, fmt.Errorf("a validator is listed twice")
+		}
+		seen[validator] = true
+	}
+
+	return &proofOfAuthorityEngine{
+		mx:                &sync.Mutex{},
+		genesisValidators: append([]string{}, validators...),
+		validators:        append([]string{}, validators...),
+		signatureFraction: signatureFraction,
+		slotSeconds:       slotSeconds,
+		now: func() int64 {
+			return time.Now().Unix()
+		},
+	}, nil
+}
+
+// ReadValidatorsFile reads the PEM public keys of the validator nodes from the file, in the order they take turns proposing.
+// The keys are formatted the same way nodes send their public keys so that they can be compared as strings.
+func ReadValidatorsFile(validatorsFile string) ([]string, error) {
+	return autograph.ReadPublicKeysFile(validatorsFile)
+}
+
+func (e *proofOfAuthorityEngine) Name() string {
+	return ProofOfAuthorityName
+}
+
+// Propose returns ErrNotProposer unless it's the proposer's turn for the next height at the header time
+func (e *proofOfAuthorityEngine) Propose(blockHeader *dto.BlockHeader, proposerPublicKey string) error {
+	blockTime, err := strconv.ParseInt(blockHeader.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse the block header time: %s", err.Error())
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	blockHeader.Difficulty = 0
+	if e.proposerAt(blockTime) != proposerPublicKey {
+		return ErrNotProposer
+	}
+	return nil
+}
+
+// Seal hashes the header. The validators are trusted, so there is no work to do.
+func (e *proofOfAuthorityEngine) Seal(blockHeader *dto.BlockHeader, stop <-chan struct{}) (string, error) {
+	select {
+	case <-stop:
+		return "", ErrSealAborted
+	default:
+	}
+
+	blockHeaderBytes, err := json.Marshal(blockHeader)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)), nil
+}
+
+// ValidateSeal checks the block hash is the hash of the header, the header time is close to now,
+// and the origin node had the turn to propose at the header time
+func (e *proofOfAuthorityEngine) ValidateSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, true)
+}
+
+// ValidateReplayedSeal checks the same as ValidateSeal except how close the header time is to now, a block on a chain is long past its slot
+func (e *proofOfAuthorityEngine) ValidateReplayedSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, false)
+}
+
+// validateSeal checks the seal, and the header time against now when checkClock is set
+func (e *proofOfAuthorityEngine) validateSeal(block *dto.BlockRequest, checkClock bool) error {
+	if block.Header.Difficulty != 0 {
+		return fmt.Errorf("proof of authority blocks don't have a difficulty")
+	}
+
+	blockHeaderBytes, err := json.Marshal(block.Header)
+	if err != nil {
+		return fmt.Errorf("could not marshal json of block header to verify hash: %s", err.Error())
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != block.ProofOfWorkHash {
+		return fmt.Errorf("mismatching block header hash")
+	}
+
+	blockTime, err := strconv.ParseInt(block.Header.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse the block header time: %s", err.Error())
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if checkClock {
+		// don't let a validator skip the others by picking a time when it would have the turn
+		drift := e.now() - blockTime
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift > 2*e.slotSeconds {
+			return fmt.Errorf("the block header time is %d seconds away from this node's time", drift)
+		}
+	}
+	if blockTime < e.lastBlockTime {
+		return fmt.Errorf("the block header time is before the last block")
+	}
+
+	if e.proposerAt(blockTime) != block.OriginNodePublicKey {
+		return fmt.Errorf("the origin node does not have the turn to propose block %d", e.height+1)
+	}
+	return nil
+}
+
+// ValidateBranchSeal checks the block hash is the hash of the header. Whose turn it was depends on the validators on the side branch, which this node doesn't have.
+func (e *proofOfAuthorityEngine) ValidateBranchSeal(block *dto.BlockRequest) error {
+	return validateHeaderHash(block)
+}
+
+// BlockWeight is the same for every block. Each one already needed signatureFraction of the validators, so the longest branch is the heaviest.
+func (e *proofOfAuthorityEngine) BlockWeight(block *dto.BlockRequest) uint64 {
+	return 1
+}
+
+// IsFinal needs signatures from signatureFraction of the validators. Signatures from nodes that aren't validators don't count.
+func (e *proofOfAuthorityEngine) IsFinal(block *dto.BlockRequest, signerPublicKeys []string, activeNodes int) bool {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	signed := 0
+	counted := make(map[string]bool)
+	for _, publicKey := range signerPublicKeys {
+		if counted[publicKey] || !e.isValidator(publicKey) {
+			continue
+		}
+		counted[publicKey] = true
+		signed++
+	}
+
+	return signed >= e.requiredSignatures()
+}
+
+// ValidateTransaction checks a governance transaction has approvals from a majority of the current validators
+// that sign the current validator set height, and that it adds a node that isn't a validator yet or removes one that is
+func (e *proofOfAuthorityEngine) ValidateTransaction(transactionSub *dto.TransactionSubmission) error {
+	transaction := transactionSub.Submitted
+	if !transaction.IsGovernance() {
+		return nil
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if transaction.Type == dto.TransactionTypeAddValidator && e.isValidator(transaction.To) {
+		return fmt.Errorf("the node is already a validator")
+	}
+	if transaction.Type == dto.TransactionTypeRemoveValidator {
+		if !e.isValidator(transaction.To) {
+			return fmt.Errorf("the node is not a validator")
+		}
+		if len(e.validators) == 1 {
+			return fmt.Errorf("can't remove the last validator")
+		}
+	}
+
+	approvalBodyBytes, err := json.Marshal(&dto.ApprovalBody{
+		Submitted:          transaction,
+		ValidatorSetHeight: e.validatorSetHeight,
+	})
+	if err != nil {
+		return err
+	}
+
+	approved := 0
+	counted := make(map[string]bool)
+	for _, approval := range transactionSub.Approvals {
+		if counted[approval.PublicKey] || !e.isValidator(approval.PublicKey) {
+			continue
+		}
+		signedBodyBytes, err := autograph.SignedBodyToBytes(approval.BodySigned)
+		if err != nil {
+			continue
+		}
+		publicKey := autograph.BytesToPublicKey([]byte(approval.PublicKey))
+		if publicKey == nil || autograph.Verify(approvalBodyBytes, signedBodyBytes, publicKey) != nil {
+			continue
+		}
+		counted[approval.PublicKey] = true
+		approved++
+	}
+
+	if approved*2 <= len(e.validators) {
+		return fmt.Errorf("the %s transaction has valid approvals from %d of %d validators for validator set height %d, it needs a majority", transaction.Type, approved, len(e.validators), e.validatorSetHeight)
+	}
+	return nil
+}
+
+// BlockWritten moves the turn to the next height and applies the governance transactions of the block to the validators.
+// A block that changes the validators becomes the validator set height, so the approvals given before it can't be used again.
+func (e *proofOfAuthorityEngine) BlockWritten(block *dto.BlockRequest) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.height++
+	blockTime, err := strconv.ParseInt(block.Header.Time, 10, 64)
+	if err == nil {
+		e.lastBlockTime = blockTime
+	}
+
+	for _, transactionSub := range block.Transactions {
+		// a pruned payment has no body, but the transactions the engine replays are kept whole by a pruning node
+		if transactionSub.TransactionStatus == dto.StatusDropped || transactionSub.TransactionStatus == dto.StatusPruned {
+			continue
+		}
+		transaction := transactionSub.Submitted
+		switch transaction.Type {
+		case dto.TransactionTypeAddValidator:
+			if !e.isValidator(transaction.To) {
+				e.validators = append(e.validators, transaction.To)
+				e.validatorSetHeight = e.height
+			}
+		case dto.TransactionTypeRemoveValidator:
+			for i, validator := range e.validators {
+				if validator == transaction.To && len(e.validators) > 1 {
+					e.validators = append(e.validators[:i], e.validators[i+1:]...)
+					e.validatorSetHeight = e.height
+					break
+				}
+			}
+		}
+	}
+}
+
+// Reset goes back to the validators from genesis or config at height 0
+func (e *proofOfAuthorityEngine) Reset() {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.validators = append([]string{}, e.genesisValidators...)
+	e.height = 0
+	e.lastBlockTime = 0
+	e.validatorSetHeight = 0
+}
+
+// proposerAt returns the validator with the turn to propose the next height at the block time.
+// Each slot that passes after the last block without a new block moves the turn along one more validator. Call with the mutex locked.
+func (e *proofOfAuthorityEngine) proposerAt(blockTime int64) string {
+	missedTurns := int64(0)
+	if e.lastBlockTime > 0 && blockTime > e.lastBlockTime {
+		missedTurns = (blockTime - e.lastBlockTime) / e.slotSeconds
+	} else if e.lastBlockTime == 0 {
+		// nothing is written yet, so count the slots from the unix epoch the same way on every node
+		missedTurns = blockTime / e.slotSeconds
+	}
+	return e.validators[(e.height+missedTurns)%int64(len(e.validators))]
+}
+
+// requiredSignatures returns how many validators have to sign a block. Call with the mutex locked.
+func (e *proofOfAuthorityEngine) requiredSignatures() int {
+	required := int(math.Ceil(e.signatureFraction * float64(len(e.validators))))
+	if required < 1 {
+		return 1
+	}
+	return required
+}
+
+// isValidator returns if the node public key is one of the validators. Call with the mutex locked.
+func (e *proofOfAuthorityEngine) isValidator(publicKey string) bool {
+	for _, validator := range e.validators {
+		if validator == publicKey {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// ProofOfStakeName is the --consensus flag value for proof of stake
+const ProofOfStakeName = "pos"
+
+// seedBlocks is how many of the last written block hashes go into the seed that picks the proposer,
+// so the proposer of one block can't pick the next proposer just by choosing which transactions go in its block
+const seedBlocks = 3
+
+// proofOfStakeEngine picks one proposer for each time slot, weighted by the coin staked with each validator node,
+// and needs signatures from validators holding at least 2/3 of the stake to write a block.
+// Until anything is staked it falls back to letting any node propose and needing every node to sign, like proof of work without the work.
+type proofOfStakeEngine struct {
+	mx           *sync.Mutex
+	stakes       map[string]dto.Coin
+	recentHashes []string
+	slotSeconds  int64
+	// now is the unix time, swapped out by the tests
+	now func() int64
+}
+
+// NewProofOfStakeEngine returns the proof of stake consensus engine with a new proposer every slotSeconds.
+func NewProofOfStakeEngine(slotSeconds int64) Engine {
+	if slotSeconds <= 0 {
+		slotSeconds = 1
+	}
+	return &proofOfStakeEngine{
+		mx:          &sync.Mutex{},
+		stakes:      make(map[string]dto.Coin),
+		slotSeconds: slotSeconds,
+		now: func() int64 {
+			return time.Now().Unix()
+		},
+	}
+}
+
+func (e *proofOfStakeEngine) Name() string {
+	return ProofOfStakeName
+}
+
+// Propose returns ErrNotProposer unless the proposer was picked for the slot of the header time.
+// There is no difficulty with proof of stake, so the header is left with a difficulty of 0.
+func (e *proofOfStakeEngine) Propose(blockHeader *dto.BlockHeader, proposerPublicKey string) error {
+	blockTime, err := strconv.ParseInt(blockHeader.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse the block header time: %s", err.Error())
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	blockHeader.Difficulty = 0
+	proposer, staked := e.proposerForSlot(blockTime / e.slotSeconds)
+	if staked && proposer != proposerPublicKey {
+		return ErrNotProposer
+	}
+	return nil
+}
+
+// Seal hashes the header. The proposer is picked by stake, so there is no work to do.
+func (e *proofOfStakeEngine) Seal(blockHeader *dto.BlockHeader, stop <-chan struct{}) (string, error) {
+	select {
+	case <-stop:
+		return "", ErrSealAborted
+	default:
+	}
+
+	blockHeaderBytes, err := json.Marshal(blockHeader)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)), nil
+}
+
+// ValidateSeal checks the block hash is the hash of the header, the header time is in the current slot or close to it,
+// and the origin node is the proposer picked for that slot
+func (e *proofOfStakeEngine) ValidateSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, true)
+}
+
+// ValidateReplayedSeal checks the same as ValidateSeal except how close the header time is to now, a block on a chain is long past its slot
+func (e *proofOfStakeEngine) ValidateReplayedSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, false)
+}
+
+// validateSeal checks the seal, and the header time against now when checkClock is set
+func (e *proofOfStakeEngine) validateSeal(block *dto.BlockRequest, checkClock bool) error {
+	if block.Header.Difficulty != 0 {
+		return fmt.Errorf("proof of stake blocks don't have a difficulty")
+	}
+
+	blockHeaderBytes, err := json.Marshal(block.Header)
+	if err != nil {
+		return fmt.Errorf("could not marshal json of block header to verify hash: %s", err.Error())
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != block.ProofOfWorkHash {
+		return fmt.Errorf("mismatching block header hash")
+	}
+
+	blockTime, err := strconv.ParseInt(block.Header.Time, 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse the block header time: %s", err.Error())
+	}
+
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if checkClock {
+		// give the signatures a slot to make it around, but don't let a proposer pick a far off slot that it would win
+		drift := e.now() - blockTime
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift > 2*e.slotSeconds {
+			return fmt.Errorf("the block header time is %d seconds away from this node's time", drift)
+		}
+	}
+
+	proposer, staked := e.proposerForSlot(blockTime / e.slotSeconds)
+	if staked && proposer != block.OriginNodePublicKey {
+		return fmt.Errorf("the origin node is not the proposer for slot %d", blockTime/e.slotSeconds)
+	}
+	return nil
+}
+
+// ValidateBranchSeal checks the block hash is the hash of the header. Who the proposer was depends on the stakes on the side branch, which this node doesn't have.
+func (e *proofOfStakeEngine) ValidateBranchSeal(block *dto.BlockRequest) error {
+	return validateHeaderHash(block)
+}
+
+// BlockWeight is the same for every block. Each one already needed 2/3 of the stake to sign it, so the longest branch is the heaviest.
+func (e *proofOfStakeEngine) BlockWeight(block *dto.BlockRequest) uint64 {
+	return 1
+}
+
+// IsFinal needs signatures from validators holding at least 2/3 of the staked coin.
+// Until anything is staked, it needs a signature from every node the block was sent to, like proof of work.
+func (e *proofOfStakeEngine) IsFinal(block *dto.BlockRequest, signerPublicKeys []string, activeNodes int) bool {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	totalStake := e.totalStake()
+	if totalStake.Sign() == 0 {
+		if activeNodes <= 0 {
+			return len(signerPublicKeys) >= 1
+		}
+		return len(signerPublicKeys) >= activeNodes
+	}
+
+	signedStake := new(big.Int)
+	counted := make(map[string]bool)
+	for _, publicKey := range signerPublicKeys {
+		if counted[publicKey] {
+			continue
+		}
+		counted[publicKey] = true
+		signedStake.Add(signedStake, big.NewInt(int64(e.stakes[publicKey])))
+	}
+
+	// signedStake * 3 >= totalStake * 2 without rounding
+	signedStake.Mul(signedStake, big.NewInt(3))
+	return signedStake.Cmp(new(big.Int).Mul(totalStake, big.NewInt(2))) >= 0
+}
+
+// ValidateTransaction turns away governance transactions, stake decides the validators
+func (e *proofOfStakeEngine) ValidateTransaction(transactionSub *dto.TransactionSubmission) error {
+	if transactionSub.Submitted.IsGovernance() {
+		return ErrGovernanceNotSupported
+	}
+	return nil
+}
+
+// BlockWritten applies the stake and unstake transactions of the block to the validator stakes
+// and remembers the block hash for the proposer seed.
+// The account state turns away a stake that would overflow before it is written, so one that would overflow here is skipped the same way on every node.
+func (e *proofOfStakeEngine) BlockWritten(block *dto.BlockRequest) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	for _, transactionSub := range block.Transactions {
+		// a pruned payment has no body, but the transactions the engine replays are kept whole by a pruning node
+		if transactionSub.TransactionStatus == dto.StatusDropped || transactionSub.TransactionStatus == dto.StatusPruned {
+			continue
+		}
+		transaction := transactionSub.Submitted
+		switch transaction.Type {
+		case dto.TransactionTypeStake:
+			staked, err := e.stakes[transaction.To].Add(transaction.CoinAmount)
+			if err != nil {
+				log.Printf("skipping stake transaction %s: %s", transactionSub.ID, err.Error())
+				continue
+			}
+			e.stakes[transaction.To] = staked
+		case dto.TransactionTypeUnstake:
+			staked, err := e.stakes[transaction.To].Sub(transaction.CoinAmount)
+			if err != nil || staked <= 0 {
+				delete(e.stakes, transaction.To)
+				continue
+			}
+			e.stakes[transaction.To] = staked
+		}
+	}
+
+	e.recentHashes = append(e.recentHashes, block.ProofOfWorkHash)
+	if len(e.recentHashes) > seedBlocks {
+		e.recentHashes = e.recentHashes[len(e.recentHashes)-seedBlocks:]
+	}
+}
+
+// Reset forgets every stake and the recent block hashes
+func (e *proofOfStakeEngine) Reset() {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.stakes = make(map[string]dto.Coin)
+	e.recentHashes = nil
+}
+
+// totalStake returns the sum of every validator stake. Call with the mutex locked.
+func (e *proofOfStakeEngine) totalStake() *big.Int {
+	total := new(big.Int)
+	for _, stake := range e.stakes {
+		total.Add(total, big.NewInt(int64(stake)))
+	}
+	return total
+}
+
+// proposerForSlot picks the validator for the slot, weighted by stake, from a seed of the recent block hashes and the slot number.
+// Every node with the same written blocks picks the same proposer. staked is false when nothing is staked yet. Call with the mutex locked.
+func (e *proofOfStakeEngine) proposerForSlot(slot int64) (proposer string, staked bool) {
+	totalStake := e.totalStake()
+	if totalStake.Sign() == 0 {
+		return "", false
+	}
+
+	seed := sha256.New()
+	for _, blockHash := range e.recentHashes {
+		seed.Write([]byte(blockHash))
+	}
+	slotBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(slotBytes, uint64(slot))
+	seed.Write(slotBytes)
+
+	// walk the validators in a fixed order until the picked coin falls inside one of their stakes
+	picked := new(big.Int).SetBytes(seed.Sum(nil))
+	picked.Mod(picked, totalStake)
+
+	validators := make([]string, 0, len(e.stakes))
+	for publicKey := range e.stakes {
+		validators = append(validators, publicKey)
+	}
+	sort.Strings(validators)
+
+	cumulative := new(big.Int)
+	for _, publicKey := range validators {
+		cumulative.Add(cumulative, big.NewInt(int64(e.stakes[publicKey])))
+		if picked.Cmp(cumulative) < 0 {
+			return publicKey, true
+		}
+	}
+	return validators[len(validators)-1], true
+}
@@ -0,0 +1,138 @@
+package consensus
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// simulateProofOfStake runs one proof of stake engine per validator on a fake clock, as if each validator was its own node.
+// Each validator stakes its coin in a first block, then for every slot every node asks its engine if it can propose,
+// the one that can seals the block, and every other node validates the seal and checks the block is final before writing it.
+// simulateProofOfStake returns how many blocks each validator proposed.
+func simulateProofOfStake(t *testing.T, stakes []dto.Coin, slots int64) (validators []string, proposed []int64) {
+	const slotSeconds = 10
+	clock := int64(0)
+
+	engines := make([]*proofOfStakeEngine, len(stakes))
+	validators = make([]string, len(stakes))
+	stakeBlock := &dto.BlockRequest{
+		ProofOfWorkHash: "simulated-stake-block",
+		Transactions:    make([]*dto.TransactionSubmission, 0, len(stakes)),
+	}
+	for i, stake := range stakes {
+		engine := NewProofOfStakeEngine(slotSeconds).(*proofOfStakeEngine)
+		engine.now = func() int64 { return clock }
+		engines[i] = engine
+		validators[i] = fmt.Sprintf("validator-%d", i+1)
+
+		stakeBlock.Transactions = append(stakeBlock.Transactions, &dto.TransactionSubmission{
+			Submitted: &dto.Transaction{
+				From:       fmt.Sprintf("user-%d", i+1),
+				To:         validators[i],
+				CoinAmount: stake,
+				Type:       dto.TransactionTypeStake,
+			},
+		})
+	}
+
+	for _, engine := range engines {
+		engine.BlockWritten(stakeBlock)
+	}
+
+	proposed = make([]int64, len(stakes))
+	prevBlockHash := stakeBlock.ProofOfWorkHash
+	for slot := int64(0); slot < slots; slot++ {
+		clock = slot * slotSeconds
+
+		proposer := -1
+		var blockHeader *dto.BlockHeader
+		for i, engine := range engines {
+			header := &dto.BlockHeader{
+				PrevBlockHash: prevBlockHash,
+				Time:          strconv.FormatInt(clock, 10),
+			}
+			err := engine.Propose(header, validators[i])
+			if err == ErrNotProposer {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proposer != -1 {
+				t.Fatalf("slot %d has 2 proposers, %s and %s", slot, validators[proposer], validators[i])
+			}
+			proposer = i
+			blockHeader = header
+		}
+		if proposer == -1 {
+			t.Fatalf("slot %d has no proposer", slot)
+		}
+
+		blockHash, err := engines[proposer].Seal(blockHeader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := &dto.BlockRequest{
+			OriginNodePublicKey: validators[proposer],
+			ProofOfWorkHash:     blockHash,
+			Header:              blockHeader,
+		}
+
+		for i, engine := range engines {
+			if i == proposer {
+				continue
+			}
+			err = engine.ValidateSeal(block)
+			if err != nil {
+				t.Fatalf("%s rejected the block from %s in slot %d: %s", validators[i], validators[proposer], slot, err.Error())
+			}
+			if !engine.IsFinal(block, validators, 0) {
+				t.Fatalf("%s does not consider the block from %s final in slot %d", validators[i], validators[proposer], slot)
+			}
+		}
+
+		for _, engine := range engines {
+			engine.BlockWritten(block)
+		}
+		proposed[proposer]++
+		prevBlockHash = blockHash
+	}
+
+	return validators, proposed
+}
+
+func TestProofOfStakeProposerShare(t *testing.T) {
+	const slots = 4000
+	// the share of the blocks each validator proposes can be this many percentage points off its share of the stake
+	const tolerance = 3.0
+
+	stakes := []dto.Coin{10 * dto.CoinBaseUnits, 20 * dto.CoinBaseUnits, 30 * dto.CoinBaseUnits, 40 * dto.CoinBaseUnits}
+	totalStake := dto.Coin(0)
+	for _, stake := range stakes {
+		totalStake += stake
+	}
+
+	validators, proposed := simulateProofOfStake(t, stakes, slots)
+	for i, stake := range stakes {
+		stakeShare := float64(stake) * 100 / float64(totalStake)
+		proposedShare := float64(proposed[i]) * 100 / slots
+		t.Logf("%s staked %s (%.1f%% of the stake) and proposed %d of %d blocks (%.1f%%)", validators[i], stake, stakeShare, proposed[i], slots, proposedShare)
+		if math.Abs(proposedShare-stakeShare) > tolerance {
+			t.Errorf("%s proposed %.1f%% of the blocks with %.1f%% of the stake", validators[i], proposedShare, stakeShare)
+		}
+	}
+}
+
+func TestProofOfStakeUnstakedValidatorDoesNotPropose(t *testing.T) {
+	_, proposed := simulateProofOfStake(t, []dto.Coin{10 * dto.CoinBaseUnits, 0}, 200)
+	if proposed[1] != 0 {
+		t.Fatalf("the validator with no stake proposed %d blocks", proposed[1])
+	}
+	if proposed[0] != 200 {
+		t.Fatalf("the only staked validator proposed %d of 200 blocks", proposed[0])
+	}
+}
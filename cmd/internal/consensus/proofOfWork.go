@@ -0,0 +1,169 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// the nonce is written into the header as 16 hex characters so that it is always the same width
+// and can be patched straight into the pre-serialized header without marshalling the json again
+const nonceHexWidth = 16
+
+// workers check if another worker found proof of work every this many hashes instead of every hash
+const checkFoundEvery = 1024
+
+// proofOfWorkResult is what a proof of work search found and how many hashes it took
+type proofOfWorkResult struct {
+	proofOfWorkHash string
+	nonce           string
+	attempts        uint64
+	elapsed         time.Duration
+	found           bool
+}
+
+// hashRate returns the hashes per second of the search
+func (r *proofOfWorkResult) hashRate() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.attempts) / r.elapsed.Seconds()
+}
+
+// headerTemplate is the block header marshalled once with a placeholder nonce, and where the nonce sits in those bytes
+type headerTemplate struct {
+	headerBytes []byte
+	nonceAt     int
+}
+
+func newHeaderTemplate(blockHeader *dto.BlockHeader) (*headerTemplate, error) {
+	templateHeader := *blockHeader
+	templateHeader.Nonce = strings.Repeat("0", nonceHexWidth)
+
+	headerBytes, err := json.Marshal(&templateHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceKey := []byte(`"nonce":"`)
+	nonceAt := bytes.Index(headerBytes, nonceKey)
+	if nonceAt < 0 {
+		return nil, fmt.Errorf("could not find the nonce in the marshalled block header")
+	}
+
+	return &headerTemplate{
+		headerBytes: headerBytes,
+		nonceAt:     nonceAt + len(nonceKey),
+	}, nil
+}
+
+// targetBytes returns the target for the difficulty as 32 big endian bytes so it can be compared with a sha256 sum directly
+func targetBytes(difficulty uint64) []byte {
+	target := TargetForDifficulty(difficulty).Bytes()
+	padded := make([]byte, sha256.Size)
+	copy(padded[sha256.Size-len(target):], target)
+	return padded
+}
+
+// searchProofOfWork splits the nonce space across the number of workers and returns as soon as one of them
+// finds a header hash at or below the target for the difficulty in the header.
+// The search gives up without finding anything when the stop channel is closed. stop may be nil.
+func searchProofOfWork(blockHeader *dto.BlockHeader, workers int, stop <-chan struct{}) (*proofOfWorkResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	template, err := newHeaderTemplate(blockHeader)
+	if err != nil {
+		return nil, err
+	}
+	target := targetBytes(blockHeader.Difficulty)
+
+	startTime := time.Now()
+	startNonce := rand.New(rand.NewSource(startTime.UnixNano())).Uint64()
+	nonceSpacePerWorker := ^uint64(0) / uint64(workers)
+
+	var attempts uint64
+	var foundFlag int32
+	foundChan := make(chan *proofOfWorkResult, workers)
+	wg := &sync.WaitGroup{}
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+
+			// each worker patches its own copy of the header bytes
+			headerBytes := make([]byte, len(template.headerBytes))
+			copy(headerBytes, template.headerBytes)
+			nonceBytes := make([]byte, 8)
+			nonceHex := headerBytes[template.nonceAt : template.nonceAt+nonceHexWidth]
+
+			var workerAttempts uint64
+			for {
+				if workerAttempts%checkFoundEvery == 0 {
+					atomic.AddUint64(&attempts, workerAttempts)
+					workerAttempts = 0
+					if atomic.LoadInt32(&foundFlag) != 0 || isStopped(stop) {
+						return
+					}
+				}
+
+				binary.BigEndian.PutUint64(nonceBytes, nonce)
+				hex.Encode(nonceHex, nonceBytes)
+				headerHash := sha256.Sum256(headerBytes)
+				workerAttempts++
+
+				if bytes.Compare(headerHash[:], target) <= 0 {
+					atomic.AddUint64(&attempts, workerAttempts)
+					if atomic.CompareAndSwapInt32(&foundFlag, 0, 1) {
+						foundChan <- &proofOfWorkResult{
+							proofOfWorkHash: hex.EncodeToString(headerHash[:]),
+							nonce:           string(nonceHex),
+							found:           true,
+						}
+					}
+					return
+				}
+				nonce++
+			}
+		}(startNonce + uint64(worker)*nonceSpacePerWorker)
+	}
+
+	wg.Wait()
+	close(foundChan)
+
+	result, found := <-foundChan
+	if !found {
+		result = &proofOfWorkResult{}
+	}
+	result.attempts = atomic.LoadUint64(&attempts)
+	result.elapsed = time.Since(startTime)
+
+	if result.found {
+		blockHeader.Nonce = result.nonce
+	}
+	return result, nil
+}
+
+func isStopped(stop <-chan struct{}) bool {
+	if stop == nil {
+		return false
+	}
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
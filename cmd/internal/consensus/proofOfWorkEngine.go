@@ -0,0 +1,160 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// ProofOfWorkName is the --consensus flag value for proof of work with node signatures
+const ProofOfWorkName = "pow"
+
+// proofOfWorkEngine is the original consensus: a header hash at or below the difficulty target,
+// and signatures from every node the block was sent to.
+type proofOfWorkEngine struct {
+	difficultyRunner *DifficultyRunner
+	workers          int
+	// now is the unix time, swapped out by the tests
+	now func() int64
+}
+
+// NewProofOfWorkEngine returns the proof of work with node signatures consensus engine.
+func NewProofOfWorkEngine(initialDifficulty uint64, adjustEvery, targetBlockSeconds int64, workers int) Engine {
+	return &proofOfWorkEngine{
+		difficultyRunner: NewDifficultyRunner(initialDifficulty, adjustEvery, targetBlockSeconds),
+		workers:          workers,
+		now: func() int64 {
+			return time.Now().Unix()
+		},
+	}
+}
+
+func (e *proofOfWorkEngine) Name() string {
+	return ProofOfWorkName
+}
+
+// Propose commits the difficulty for the next block in the header, and moves the header time after the last block
+// if this node's clock is behind it. Any node can propose with proof of work.
+func (e *proofOfWorkEngine) Propose(blockHeader *dto.BlockHeader, proposerPublicKey string) error {
+	blockHeader.Difficulty = e.difficultyRunner.GetDifficulty()
+
+	lastBlockTime := e.difficultyRunner.getLastBlockTime()
+	blockTime, err := strconv.ParseInt(blockHeader.Time, 10, 64)
+	if err != nil || blockTime <= lastBlockTime {
+		blockHeader.Time = strconv.FormatInt(lastBlockTime+1, 10)
+	}
+	return nil
+}
+
+// Seal finds proof of work for the header
+func (e *proofOfWorkEngine) Seal(blockHeader *dto.BlockHeader, stop <-chan struct{}) (string, error) {
+	result, err := searchProofOfWork(blockHeader, e.workers, stop)
+	if err != nil {
+		return "", err
+	}
+
+	if !result.found {
+		return "", ErrSealAborted
+	}
+
+	log.Printf("found proof of work after %d hashes in %s, %.0f hashes/s on %d workers", result.attempts, result.elapsed, result.hashRate(), e.workers)
+	return result.proofOfWorkHash, nil
+}
+
+// ValidateSeal checks the difficulty in the header is the one this node works out from its own chain,
+// that the proof of work hash is the hash of the header and meets the difficulty,
+// and that the header time is after the last block and not too far ahead of this node's clock, since the difficulty adjusts from it.
+// A block without a difficulty is held to the 5 leading zeros of the original proof of work,
+// and is only valid until the chain has a block that commits to a difficulty.
+func (e *proofOfWorkEngine) ValidateSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, true)
+}
+
+// ValidateReplayedSeal checks the same as ValidateSeal except how far the header time is ahead of now, a block on a chain was mined in the past
+func (e *proofOfWorkEngine) ValidateReplayedSeal(block *dto.BlockRequest) error {
+	return e.validateSeal(block, false)
+}
+
+// validateSeal checks the seal, and the header time against now when checkClock is set
+func (e *proofOfWorkEngine) validateSeal(block *dto.BlockRequest, checkClock bool) error {
+	now := int64(0)
+	if checkClock {
+		now = e.now()
+	}
+	err := e.difficultyRunner.validateTime(block.Header, now)
+	if err != nil {
+		return err
+	}
+
+	legacy := block.Header.Difficulty == 0 && e.difficultyRunner.acceptsLegacy()
+	if !legacy && block.Header.Difficulty != e.difficultyRunner.GetDifficulty() {
+		return fmt.Errorf("block header difficulty %d does not match the expected difficulty %d", block.Header.Difficulty, e.difficultyRunner.GetDifficulty())
+	}
+
+	blockHeaderBytes, err := json.Marshal(block.Header)
+	if err != nil {
+		return fmt.Errorf("could not marshal json of block header to verify hash: %s", err.Error())
+	}
+
+	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != block.ProofOfWorkHash || !HashMeetsDifficulty(block.ProofOfWorkHash, block.Header.Difficulty) {
+		return fmt.Errorf("invalid proof of work or mismatching block header hash")
+	}
+
+	return nil
+}
+
+// ValidateBranchSeal checks the proof of work hash is the hash of the header and meets the difficulty the header committed to.
+// A side branch can have a different difficulty than this node's chain, and a low difficulty only gives the block a low weight.
+func (e *proofOfWorkEngine) ValidateBranchSeal(block *dto.BlockRequest) error {
+	blockHeaderBytes, err := json.Marshal(block.Header)
+	if err != nil {
+		return fmt.Errorf("could not marshal json of block header to verify hash: %s", err.Error())
+	}
+
+	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != block.ProofOfWorkHash || !HashMeetsDifficulty(block.ProofOfWorkHash, block.Header.Difficulty) {
+		return fmt.Errorf("invalid proof of work or mismatching block header hash")
+	}
+
+	return nil
+}
+
+// BlockWeight is the difficulty, the number of hashes it takes on average to find the proof of work
+func (e *proofOfWorkEngine) BlockWeight(block *dto.BlockRequest) uint64 {
+	if block.Header.Difficulty == 0 {
+		return legacyDifficulty
+	}
+	return block.Header.Difficulty
+}
+
+// IsFinal needs a signature from every node the block was sent to.
+// When we don't know how many nodes there are, the signature from the origin node is all we can check.
+// TODO: when critical mass number of nodes are found, use 70% for acceptance
+func (e *proofOfWorkEngine) IsFinal(block *dto.BlockRequest, signerPublicKeys []string, activeNodes int) bool {
+	if activeNodes <= 0 {
+		return len(signerPublicKeys) >= 1
+	}
+	return len(signerPublicKeys) >= activeNodes
+}
+
+// ValidateTransaction only turns away governance transactions, there are no validators to govern
+func (e *proofOfWorkEngine) ValidateTransaction(transactionSub *dto.TransactionSubmission) error {
+	if transactionSub.Submitted.IsGovernance() {
+		return ErrGovernanceNotSupported
+	}
+	return nil
+}
+
+// BlockWritten counts the block toward the next difficulty adjustment
+func (e *proofOfWorkEngine) BlockWritten(block *dto.BlockRequest) {
+	e.difficultyRunner.recordBlock(block.Header)
+}
+
+// Reset goes back to the initial difficulty
+func (e *proofOfWorkEngine) Reset() {
+	e.difficultyRunner.reset()
+}
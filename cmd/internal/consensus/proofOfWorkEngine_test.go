@@ -0,0 +1,147 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// baselineHeader is the block header before it had a difficulty or a height
+type baselineHeader struct {
+	PrevBlockHash    string `json:"prev-block-hash"`
+	TransactionsHash string `json:"transactions-hash"`
+	Time             string `json:"time"`
+	Nonce            string `json:"nonce"`
+}
+
+func TestBaselineHeaderHash(t *testing.T) {
+	blockHeader := sampleHeader()
+	blockHeader.Difficulty = 0
+	blockHeader.Height = 0
+	result, err := searchProofOfWork(blockHeader, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(result.proofOfWorkHash, "00000") {
+		t.Fatalf("proof of work hash %s for a header without a difficulty doesn't start with 5 zeros", result.proofOfWorkHash)
+	}
+
+	baselineBytes, err := json.Marshal(&baselineHeader{
+		PrevBlockHash:    blockHeader.PrevBlockHash,
+		TransactionsHash: blockHeader.TransactionsHash,
+		Time:             blockHeader.Time,
+		Nonce:            blockHeader.Nonce,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baselineHash := fmt.Sprintf("%x", sha256.Sum256(baselineBytes)); baselineHash != result.proofOfWorkHash {
+		t.Fatalf("the baseline header hashes to %s but the header hashes to %s", baselineHash, result.proofOfWorkHash)
+	}
+
+	// a block written before the header had a difficulty, read back from its json
+	block := &dto.BlockRequest{
+		ProofOfWorkHash: result.proofOfWorkHash,
+		Header:          &dto.BlockHeader{},
+	}
+	err = json.Unmarshal(baselineBytes, block.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := NewProofOfWorkEngine(benchmarkDifficulty, 0, 0, 1)
+	err = engine.ValidateSeal(block)
+	if err != nil {
+		t.Fatalf("the baseline block was turned away: %s", err.Error())
+	}
+	if engine.BlockWeight(block) != legacyDifficulty {
+		t.Fatalf("the baseline block weighs %d instead of %d", engine.BlockWeight(block), legacyDifficulty)
+	}
+
+	tooEasy := &dto.BlockRequest{ProofOfWorkHash: block.ProofOfWorkHash, Header: &dto.BlockHeader{}}
+	*tooEasy.Header = *block.Header
+	for nonce := 0; ; nonce++ {
+		tooEasy.Header.Nonce = fmt.Sprintf("easy-%d", nonce)
+		headerBytes, err := json.Marshal(tooEasy.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tooEasy.ProofOfWorkHash = fmt.Sprintf("%x", sha256.Sum256(headerBytes))
+		if !strings.HasPrefix(tooEasy.ProofOfWorkHash, "00000") {
+			break
+		}
+	}
+	if engine.ValidateSeal(tooEasy) == nil {
+		t.Fatalf("a block without a difficulty and hash %s was accepted", tooEasy.ProofOfWorkHash)
+	}
+
+	// once a block commits to a difficulty, blocks without one are not valid anymore
+	engine.BlockWritten(&dto.BlockRequest{Header: sampleHeader()})
+	if engine.ValidateSeal(block) == nil {
+		t.Fatal("the baseline block was accepted after a block with a difficulty was written")
+	}
+}
+
+// sealedBlock proposes and seals a block at the header time with the engine
+func sealedBlock(t *testing.T, engine Engine, blockTime int64) *dto.BlockRequest {
+	blockHeader := sampleHeader()
+	blockHeader.Time = strconv.FormatInt(blockTime, 10)
+	err := engine.Propose(blockHeader, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header time is set back after proposing so the tests can seal times Propose would move
+	blockHeader.Time = strconv.FormatInt(blockTime, 10)
+	blockHash, err := engine.Seal(blockHeader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dto.BlockRequest{ProofOfWorkHash: blockHash, Header: blockHeader}
+}
+
+func TestProofOfWorkHeaderTime(t *testing.T) {
+	const clock = 1000000
+	engine := NewProofOfWorkEngine(benchmarkDifficulty, 0, 0, 1).(*proofOfWorkEngine)
+	engine.now = func() int64 { return clock }
+	engine.BlockWritten(sealedBlock(t, engine, clock))
+
+	sameTime := sealedBlock(t, engine, clock)
+	if engine.ValidateSeal(sameTime) == nil || engine.ValidateReplayedSeal(sameTime) == nil {
+		t.Fatal("a block with the same time as the block before it was accepted")
+	}
+	before := sealedBlock(t, engine, clock-1)
+	if engine.ValidateSeal(before) == nil || engine.ValidateReplayedSeal(before) == nil {
+		t.Fatal("a block with a time before the block before it was accepted")
+	}
+
+	farAhead := sealedBlock(t, engine, clock+maxFutureBlockSeconds+1)
+	if engine.ValidateSeal(farAhead) == nil {
+		t.Fatal("a block too far ahead of the clock was accepted")
+	}
+	err := engine.ValidateReplayedSeal(farAhead)
+	if err != nil {
+		t.Fatalf("a replayed block was checked against the clock: %s", err.Error())
+	}
+
+	next := sealedBlock(t, engine, clock+maxFutureBlockSeconds)
+	err = engine.ValidateSeal(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a node with its clock behind the last block proposes a time after it
+	blockHeader := sampleHeader()
+	blockHeader.Time = strconv.FormatInt(clock-10, 10)
+	err = engine.Propose(blockHeader, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockHeader.Time != strconv.FormatInt(clock+1, 10) {
+		t.Fatalf("proposed header time %s with the last block at %d", blockHeader.Time, clock)
+	}
+}
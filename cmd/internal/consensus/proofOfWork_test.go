@@ -0,0 +1,141 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// benchmarkDifficulty takes about 4096 hashes to meet, so every benchmark iteration finds proof of work quickly
+const benchmarkDifficulty = 1 << 12
+
+func sampleHeader() *dto.BlockHeader {
+	return &dto.BlockHeader{
+		PrevBlockHash:    fmt.Sprintf("%x", sha256.Sum256([]byte("previous"))),
+		TransactionsHash: fmt.Sprintf("%x", sha256.Sum256([]byte("transactions"))),
+		Time:             strconv.FormatInt(time.Now().Unix(), 10),
+		Difficulty:       benchmarkDifficulty,
+		Height:           1,
+	}
+}
+
+// searchProofOfWorkByMarshal is how proof of work used to be found, with 1 goroutine that json marshals the header
+// and formats a hex string for every attempt. It is only kept around to compare the header template search against.
+func searchProofOfWorkByMarshal(blockHeader *dto.BlockHeader) (*proofOfWorkResult, error) {
+	startTime := time.Now()
+	nonceCount := 100 + rand.New(rand.NewSource(startTime.UnixNano())).Int63()
+
+	var attempts uint64
+	for {
+		nonceCount++
+		blockHeader.Nonce = base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(nonceCount, 10)))
+
+		blockHeaderBytes, err := json.Marshal(blockHeader)
+		if err != nil {
+			return nil, err
+		}
+		attempts++
+
+		proofOfWorkHash := fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes))
+		if HashMeetsDifficulty(proofOfWorkHash, blockHeader.Difficulty) {
+			return &proofOfWorkResult{
+				proofOfWorkHash: proofOfWorkHash,
+				nonce:           blockHeader.Nonce,
+				attempts:        attempts,
+				elapsed:         time.Since(startTime),
+				found:           true,
+			}, nil
+		}
+	}
+}
+
+// checkProofOfWork fails the test unless the result is the hash of the header marshalled with the nonce it found, and meets the difficulty
+func checkProofOfWork(tb testing.TB, blockHeader *dto.BlockHeader, result *proofOfWorkResult) {
+	if !result.found {
+		tb.Fatal("the search stopped without finding proof of work")
+	}
+	if blockHeader.Nonce != result.nonce {
+		tb.Fatalf("the header has nonce %s but the search found %s", blockHeader.Nonce, result.nonce)
+	}
+	blockHeaderBytes, err := json.Marshal(blockHeader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if proofOfWorkHash := fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)); proofOfWorkHash != result.proofOfWorkHash {
+		tb.Fatalf("the search found hash %s but the header hashes to %s", result.proofOfWorkHash, proofOfWorkHash)
+	}
+	if !HashMeetsDifficulty(result.proofOfWorkHash, blockHeader.Difficulty) {
+		tb.Fatalf("hash %s does not meet difficulty %d", result.proofOfWorkHash, blockHeader.Difficulty)
+	}
+}
+
+func TestSearchProofOfWork(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		blockHeader := sampleHeader()
+		result, err := searchProofOfWork(blockHeader, workers, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkProofOfWork(t, blockHeader, result)
+	}
+}
+
+func TestSearchProofOfWorkStops(t *testing.T) {
+	blockHeader := sampleHeader()
+	// the target for the largest difficulty is 1, which no hash will realistically hit
+	blockHeader.Difficulty = ^uint64(0)
+
+	stop := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stop) })
+	result, err := searchProofOfWork(blockHeader, 2, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.found {
+		t.Fatal("the search found proof of work for the largest difficulty")
+	}
+	if result.attempts == 0 {
+		t.Fatal("the search stopped without hashing")
+	}
+}
+
+// benchmarkSearch finds proof of work b.N times and reports the hash rate next to the time per block
+func benchmarkSearch(b *testing.B, search func(blockHeader *dto.BlockHeader) (*proofOfWorkResult, error)) {
+	var attempts uint64
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		blockHeader := sampleHeader()
+		result, err := search(blockHeader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		checkProofOfWork(b, blockHeader, result)
+		attempts += result.attempts
+		elapsed += result.elapsed
+	}
+	b.ReportMetric(float64(attempts)/elapsed.Seconds(), "hashes/s")
+}
+
+func BenchmarkProofOfWorkByMarshal(b *testing.B) {
+	benchmarkSearch(b, searchProofOfWorkByMarshal)
+}
+
+func BenchmarkProofOfWorkTemplate(b *testing.B) {
+	benchmarkSearch(b, func(blockHeader *dto.BlockHeader) (*proofOfWorkResult, error) {
+		return searchProofOfWork(blockHeader, 1, nil)
+	})
+}
+
+func BenchmarkProofOfWorkTemplateWorkers(b *testing.B) {
+	benchmarkSearch(b, func(blockHeader *dto.BlockHeader) (*proofOfWorkResult, error) {
+		return searchProofOfWork(blockHeader, runtime.NumCPU(), nil)
+	})
+}
@@ -0,0 +1,229 @@
+package droppedjournal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// journalFileName is the file in the journal folder that the entries are appended to, one json entry per line
+const journalFileName = "journal.jsonl"
+
+// Entry is a transaction the node dropped instead of writing it to the chain, with why and when it was dropped
+type Entry struct {
+	Transaction *dto.TransactionSubmission `json:"transaction"`
+	Reason      string                     `json:"reason"`
+	// Attempts is how many blocks the transaction was in that failed to be written. It is 0 for transactions dropped before the journal kept count.
+	Attempts int64 `json:"attempts"`
+	// SubmittedAt is the timestamp of the transaction when it was submitted, and DroppedAt is the unix time the node dropped it
+	SubmittedAt string `json:"submittedAt"`
+	DroppedAt   string `json:"droppedAt"`
+}
+
+// DroppedJournal is the struct that keeps the dropped transactions of this node apart from the block store, with a mutex lock.
+// The dropped transactions aren't on the chain, so they are only kept locally and can be looked up by transaction ID, keyword or user.
+// New entries are appended to the journal file, which is read back when the journal is opened.
+type DroppedJournal struct {
+	mx      *sync.Mutex
+	file    *os.File
+	entries []*Entry
+	// the indexes are positions in entries
+	transactionIDs map[string]int
+	keys           map[string][]int
+	users          map[string][]int
+}
+
+// OpenDroppedJournal returns the dropped journal in journalFolder with the entries already in its journal file.
+// A last line that was only partly written when the node stopped is cut off the end.
+// The entries are only kept in memory when journalFolder is "".
+func OpenDroppedJournal(journalFolder string) (*DroppedJournal, error) {
+	j := &DroppedJournal{
+		mx:             &sync.Mutex{},
+		entries:        make([]*Entry, 0),
+		transactionIDs: make(map[string]int),
+		keys:           make(map[string][]int),
+		users:          make(map[string][]int),
+	}
+	if journalFolder == "" {
+		return j, nil
+	}
+
+	err := os.MkdirAll(journalFolder, 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := filepath.Join(journalFolder, journalFileName)
+	journalBytes, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	offset := 0
+	for offset < len(journalBytes) {
+		lineEnd := bytes.IndexByte(journalBytes[offset:], '\n')
+		if lineEnd < 0 {
+			break
+		}
+		entry := &Entry{}
+		err = json.Unmarshal(journalBytes[offset:offset+lineEnd], entry)
+		if err != nil {
+			return nil, fmt.Errorf("dropped journal %s is corrupt at offset %d: %s", fileName, offset, err.Error())
+		}
+		j.add(entry)
+		offset += lineEnd + 1
+	}
+
+	if offset < len(journalBytes) {
+		log.Printf("truncating the torn tail of dropped journal %s at offset %d", fileName, offset)
+		err = os.Truncate(fileName, int64(offset))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	j.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// NewEntry returns the journal entry for a transaction dropped now. The transaction should already be marked as dropped with its reason.
+func NewEntry(transactionSub *dto.TransactionSubmission, attempts int64) *Entry {
+	return &Entry{
+		Transaction: transactionSub,
+		Reason:      transactionSub.DroppedReason,
+		Attempts:    attempts,
+		SubmittedAt: transactionSub.Timestamp,
+		DroppedAt:   strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+// Add appends the entries to the journal file and flushes it to disk, then adds them to the indexes.
+// An entry for a transaction ID that is already in the journal is skipped, so moving the same dropped block in twice doesn't duplicate it.
+func (j *DroppedJournal) Add(entries []*Entry) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	newEntries := make([]*Entry, 0, len(entries))
+	added := make(map[string]bool)
+	lines := make([]byte, 0)
+	for _, entry := range entries {
+		if _, found := j.transactionIDs[entry.Transaction.ID]; found || added[entry.Transaction.ID] {
+			continue
+		}
+		added[entry.Transaction.ID] = true
+		entryBytes, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, entryBytes...)
+		lines = append(lines, '\n')
+		newEntries = append(newEntries, entry)
+	}
+	if len(newEntries) == 0 {
+		return nil
+	}
+
+	if j.file != nil {
+		// a write cut short leaves a torn last line that is cut off when the journal is opened again
+		_, err := j.file.Write(lines)
+		if err != nil {
+			return err
+		}
+		err = j.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range newEntries {
+		j.add(entry)
+	}
+	return nil
+}
+
+// add puts the entry in the indexes. Call with the mutex locked.
+func (j *DroppedJournal) add(entry *Entry) {
+	if _, found := j.transactionIDs[entry.Transaction.ID]; found {
+		return
+	}
+	position := len(j.entries)
+	j.entries = append(j.entries, entry)
+	j.transactionIDs[entry.Transaction.ID] = position
+	j.keys[entry.Transaction.Submitted.Key] = append(j.keys[entry.Transaction.Submitted.Key], position)
+	j.users[entry.Transaction.Submitted.From] = append(j.users[entry.Transaction.Submitted.From], position)
+	if entry.Transaction.Submitted.To != entry.Transaction.Submitted.From {
+		j.users[entry.Transaction.Submitted.To] = append(j.users[entry.Transaction.Submitted.To], position)
+	}
+}
+
+// Get returns the entry for the dropped transaction with the transaction ID
+func (j *DroppedJournal) Get(transactionID string) (*Entry, bool) {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	position, found := j.transactionIDs[transactionID]
+	if !found {
+		return nil, false
+	}
+	return j.entries[position], true
+}
+
+// GetByKeyword returns the entries for the dropped transactions with the keyword, in the order they were dropped
+func (j *DroppedJournal) GetByKeyword(keyword string) []*Entry {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.entriesAt(j.keys[keyword])
+}
+
+// GetByUserID returns the entries for the dropped transactions with the user public key as the from-user or to-user, in the order they were dropped
+func (j *DroppedJournal) GetByUserID(userID string) []*Entry {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	return j.entriesAt(j.users[userID])
+}
+
+// Since returns the entries dropped at or after the unix time, in the order they were dropped
+func (j *DroppedJournal) Since(unixTime int64) []*Entry {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	result := make([]*Entry, 0)
+	for _, entry := range j.entries {
+		droppedAt, err := strconv.ParseInt(entry.DroppedAt, 10, 64)
+		if err == nil && droppedAt < unixTime {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// entriesAt returns the entries at the positions. Call with the mutex locked.
+func (j *DroppedJournal) entriesAt(positions []int) []*Entry {
+	result := make([]*Entry, 0, len(positions))
+	for _, position := range positions {
+		result = append(result, j.entries[position])
+	}
+	return result
+}
+
+// Transactions returns the dropped transactions of the entries
+func Transactions(entries []*Entry) []*dto.TransactionSubmission {
+	transactions := make([]*dto.TransactionSubmission, 0, len(entries))
+	for _, entry := range entries {
+		transactions = append(transactions, entry.Transaction)
+	}
+	return transactions
+}
@@ -1,11 +1,24 @@
 package dto
 
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
 // BlockHeader defines values and the json of a header for block payloads
 type BlockHeader struct {
 	PrevBlockHash    string `json:"prev-block-hash"`
 	TransactionsHash string `json:"transactions-hash"`
 	Time             string `json:"time"`
-	Nonce            string `json:"nonce"`
+	// Difficulty is the proof of work difficulty the block commits to, and 0 for the engines without proof of work.
+	// Blocks written before the header had a difficulty have difficulty 0, which is left out of the json so their header hash doesn't change,
+	// and their proof of work hash starts with 5 zeros.
+	Difficulty uint64 `json:"difficulty,omitempty"`
+	Nonce      string `json:"nonce"`
+	// Height is the height of the block on the chain, one more than the height of the previous block. The first block is height 1.
+	// Blocks written before the header had a height have height 0, which is left out of the json the same way.
+	Height int64 `json:"height,omitempty"`
 }
 
 // BlockRequest defines the values and json of a block payload
@@ -14,6 +27,54 @@ type BlockRequest struct {
 	ProofOfWorkHash     string                   `json:"proofOfWorkHash"`
 	Header              *BlockHeader             `json:"header"`
 	Transactions        []*TransactionSubmission `json:"transactions"`
+	// Pruned is set on a block written by a pruning node once the bodies of its transactions are pruned, see PruneBlock
+	Pruned bool `json:"pruned,omitempty"`
+	// NodeSignatures are the valid node signatures the block was written with, starting with the origin node.
+	// They sign the json of the block without them, see SignedBlockBytes. Blocks written before the signatures were kept don't have any.
+	NodeSignatures []*NodeSignature `json:"nodeSignatures,omitempty"`
+	// SignedBlockHash is the sha256 hash of the json the node signatures sign, kept on a pruned block since the json can't be made again without the pruned transactions
+	SignedBlockHash string `json:"signedBlockHash,omitempty"`
+}
+
+// SignedBlockBytes returns the json of the block that the node signatures sign, which is the block without its node signatures
+func SignedBlockBytes(block *BlockRequest) ([]byte, error) {
+	unsigned := *block
+	unsigned.NodeSignatures = nil
+	return json.Marshal(&unsigned)
+}
+
+// PruneBlock returns a copy of the block with the header and seal, but with each payment cut down to its transaction ID and a "pruned" status.
+// The stake, unstake and governance transactions are kept whole along with their approvals, since the consensus engines replay them from the first block.
+// The node signatures are kept along with the hash of the json they sign, so they can still be checked against the pruned block.
+// The transactions can't be checked against the transactions hash of a pruned block anymore.
+func PruneBlock(block *BlockRequest) (*BlockRequest, error) {
+	prunedBlock := &BlockRequest{
+		OriginNodePublicKey: block.OriginNodePublicKey,
+		ProofOfWorkHash:     block.ProofOfWorkHash,
+		Header:              block.Header,
+		Transactions:        make([]*TransactionSubmission, 0, len(block.Transactions)),
+		Pruned:              true,
+		NodeSignatures:      block.NodeSignatures,
+	}
+	if len(block.NodeSignatures) > 0 {
+		signedBlockBytes, err := SignedBlockBytes(block)
+		if err != nil {
+			return nil, err
+		}
+		prunedBlock.SignedBlockHash = fmt.Sprintf("%x", sha256.Sum256(signedBlockBytes))
+	}
+	for _, transactionSub := range block.Transactions {
+		if transactionSub.Submitted != nil && transactionSub.Submitted.Type != "" {
+			prunedBlock.Transactions = append(prunedBlock.Transactions, transactionSub)
+			continue
+		}
+		// the array indexes stay the same, so the search index still finds the transactions by ID
+		prunedBlock.Transactions = append(prunedBlock.Transactions, &TransactionSubmission{
+			ID:                transactionSub.ID,
+			TransactionStatus: StatusPruned,
+		})
+	}
+	return prunedBlock, nil
 }
 
 // NodeSignatures defines a block with collected node signatures.
@@ -0,0 +1,160 @@
+package dto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Coin is an amount of coin stored as integer base units so that sums like 0.1+0.2 don't drift the way float64 does,
+// and every node agrees on whether a balance went negative.
+// One whole coin is CoinBaseUnits base units. Amounts are displayed with CoinDisplayPrecision decimal places.
+type Coin int64
+
+const (
+	// CoinDisplayPrecision is the number of decimal places a coin amount can have and is displayed with
+	CoinDisplayPrecision = 8
+	// CoinBaseUnits is the number of base units in one whole coin
+	CoinBaseUnits Coin = 100000000
+	// minPlainCoin is 1e-6 coin, the smallest amount encoding/json writes without an exponent for a float64
+	minPlainCoin Coin = 100
+)
+
+var (
+	// ErrCoinOverflow is returned when coin arithmetic or parsing would not fit in the int64 base units
+	ErrCoinOverflow = errors.New("coin amount overflows the int64 base units")
+	// ErrCoinPrecision is returned when a coin amount has more decimal places than CoinDisplayPrecision
+	ErrCoinPrecision = fmt.Errorf("coin amount has more than %d decimal places", CoinDisplayPrecision)
+)
+
+// Add returns c + other, or ErrCoinOverflow if the sum does not fit
+func (c Coin) Add(other Coin) (Coin, error) {
+	sum := c + other
+	if (other > 0 && sum < c) || (other < 0 && sum > c) {
+		return 0, ErrCoinOverflow
+	}
+	return sum, nil
+}
+
+// Sub returns c - other, or ErrCoinOverflow if the difference does not fit
+func (c Coin) Sub(other Coin) (Coin, error) {
+	difference := c - other
+	if (other > 0 && difference > c) || (other < 0 && difference < c) {
+		return 0, ErrCoinOverflow
+	}
+	return difference, nil
+}
+
+// String displays the coin amount with CoinDisplayPrecision decimal places, for example "0.03000000"
+func (c Coin) String() string {
+	sign := ""
+	units := uint64(c)
+	if c < 0 {
+		sign = "-"
+		units = uint64(-c)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/uint64(CoinBaseUnits), CoinDisplayPrecision, units%uint64(CoinBaseUnits))
+}
+
+// MarshalJSON writes the amount as a json number with the trailing zeros trimmed, for example 0.03.
+// This is the same text encoding/json writes for the float64 amount, so transactions signed before the switch to base units still verify.
+// Like float64, amounts below 1e-6 are written with an exponent, for example 1e-7, and amounts with more than 15 significant digits,
+// which float64 can't hold, are written in full where float64 would have rounded them.
+func (c Coin) MarshalJSON() ([]byte, error) {
+	if c != 0 && c > -minPlainCoin && c < minPlainCoin {
+		return json.Marshal(float64(c) / float64(CoinBaseUnits))
+	}
+
+	trimmed := strings.TrimRight(c.String(), "0")
+	trimmed = strings.TrimSuffix(trimmed, ".")
+	if trimmed == "" || trimmed == "-" {
+		trimmed = "0"
+	}
+	return []byte(trimmed), nil
+}
+
+// UnmarshalJSON reads the amount from a json number or a quoted decimal string without going through float64.
+// Amounts with more than CoinDisplayPrecision decimal places are rejected with ErrCoinPrecision.
+func (c *Coin) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+
+	parsed, err := ParseCoin(text)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+const (
+	// maxCoinTextLength is the longest coin amount text ParseCoin reads. The digits of an int64 with CoinDisplayPrecision decimal places fit with plenty of room.
+	maxCoinTextLength = 64
+	// maxCoinExponent is the largest exponent ParseCoin reads, either way. float64 amounts marshal small amounts like 1e-07 with an exponent,
+	// but big.Rat would work out an exponent like 1e99999999 in full, which takes a lot of CPU and memory for a number that overflows anyway.
+	maxCoinExponent = 30
+)
+
+// ParseCoin parses a decimal string like "0.03" or "3e-2" into base units exactly.
+// The text comes from untrusted json, so its length and exponent are checked before it is parsed.
+func ParseCoin(text string) (Coin, error) {
+	if strings.Contains(text, "/") {
+		// big.Rat would happily read fractions like "1/3", but that isn't a coin amount
+		return 0, fmt.Errorf("could not parse coin amount %q", text)
+	}
+	if len(text) > maxCoinTextLength {
+		return 0, fmt.Errorf("coin amount is longer than %d characters", maxCoinTextLength)
+	}
+	if strings.Trim(text, "0123456789+-.eE") != "" {
+		// big.Rat also reads base prefixes like 0x and binary exponents like p99999999
+		return 0, fmt.Errorf("could not parse coin amount %q", text)
+	}
+	if exponentAt := strings.IndexAny(text, "eE"); exponentAt >= 0 {
+		exponent, err := strconv.Atoi(text[exponentAt+1:])
+		if err != nil {
+			return 0, fmt.Errorf("could not parse coin amount %q", text)
+		}
+		if exponent > maxCoinExponent {
+			return 0, ErrCoinOverflow
+		}
+		if exponent < -maxCoinExponent {
+			return 0, ErrCoinPrecision
+		}
+	}
+
+	amount, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return 0, fmt.Errorf("could not parse coin amount %q", text)
+	}
+
+	amount.Mul(amount, new(big.Rat).SetInt64(int64(CoinBaseUnits)))
+	if !amount.IsInt() {
+		return 0, ErrCoinPrecision
+	}
+
+	units := amount.Num()
+	if !units.IsInt64() {
+		return 0, ErrCoinOverflow
+	}
+
+	return Coin(units.Int64()), nil
+}
+
+// CoinFromFloat converts a legacy float64 coin amount to base units, rounding to the nearest base unit.
+// Only use this for migrating data written before amounts were stored as base units.
+func CoinFromFloat(amount float64) (Coin, error) {
+	units := math.Round(amount * float64(CoinBaseUnits))
+	if math.IsNaN(units) || units >= math.MaxInt64 || units < math.MinInt64 {
+		return 0, ErrCoinOverflow
+	}
+	return Coin(units), nil
+}
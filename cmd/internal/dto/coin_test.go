@@ -0,0 +1,51 @@
+package dto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCoinMarshalJSONMatchesFloat64(t *testing.T) {
+	for _, amount := range []string{
+		"0",
+		"0.00000001",
+		"0.00000007",
+		"0.00000099",
+		"0.000001",
+		"0.00000123",
+		"0.03",
+		"0.1",
+		"1",
+		"-0.00000005",
+		"-0.5",
+		"12.5",
+		"1000000",
+		"123456.12345678",
+		"92233720368.5",
+	} {
+		coin, err := ParseCoin(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coinBytes, err := json.Marshal(coin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		floatBytes, err := json.Marshal(float64(coin) / float64(CoinBaseUnits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(coinBytes) != string(floatBytes) {
+			t.Errorf("coin %s marshals to %s but the float64 marshals to %s", amount, coinBytes, floatBytes)
+		}
+
+		var readBack Coin
+		err = json.Unmarshal(coinBytes, &readBack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readBack != coin {
+			t.Errorf("coin %s marshalled to %s reads back as %s", amount, coinBytes, readBack)
+		}
+	}
+}
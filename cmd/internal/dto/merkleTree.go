@@ -1,5 +1,10 @@
 package dto
 
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
 // TODO: implement a merkle tree check for downloading blocks from other nodes when rejoining the network
 // and offer the updated merkle tree when responding to requests for blockchain history.
 // Also implement logic for finding the longest verified block chain when rejoining the network
@@ -22,3 +27,25 @@ type Merkle struct {
 	TopHeight int64                 `json:"topHeight"`
 	Tree      map[string]BranchData `json:"tree"`
 }
+
+// MerkleRoot returns the top hash of a merkle tree over the hashes, in order. Each pair of hashes is hashed together as their hexadecimal strings
+// joined together, and the last hash of a level with an odd number of hashes is paired with itself. The root of no hashes is "".
+func MerkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+
+	level := hashes
+	for len(level) > 1 {
+		nextLevel := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			nextLevel = append(nextLevel, fmt.Sprintf("%x", sha256.Sum256([]byte(level[i]+right))))
+		}
+		level = nextLevel
+	}
+	return level[0]
+}
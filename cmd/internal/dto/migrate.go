@@ -0,0 +1,59 @@
+package dto
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The legacy structs shadow the coinAmount field so that blocks written while CoinAmount was a float64
+// can still be loaded when an amount has more decimal places than the base units can hold.
+
+type legacyCoin float64
+
+type legacyTransaction struct {
+	Transaction
+	CoinAmount legacyCoin `json:"coinAmount"`
+}
+
+type legacyTransactionSubmission struct {
+	TransactionSubmission
+	Submitted *legacyTransaction `json:"submit"`
+}
+
+type legacyBlockRequest struct {
+	BlockRequest
+	Transactions []*legacyTransactionSubmission `json:"transactions"`
+}
+
+// UnmarshalBlock unmarshals a block that has been written to file.
+// Blocks with amounts that do not fit the base units exactly were written with float64 amounts,
+// so they are migrated by rounding each amount to the nearest base unit.
+func UnmarshalBlock(blockBytes []byte, block *BlockRequest) error {
+	err := json.Unmarshal(blockBytes, block)
+	if err == nil || !errors.Is(err, ErrCoinPrecision) {
+		return err
+	}
+
+	legacyBlock := &legacyBlockRequest{}
+	err = json.Unmarshal(blockBytes, legacyBlock)
+	if err != nil {
+		return err
+	}
+
+	*block = legacyBlock.BlockRequest
+	block.Transactions = make([]*TransactionSubmission, 0, len(legacyBlock.Transactions))
+	for _, legacySub := range legacyBlock.Transactions {
+		transactionSub := legacySub.TransactionSubmission
+		if legacySub.Submitted != nil {
+			transaction := legacySub.Submitted.Transaction
+			transaction.CoinAmount, err = CoinFromFloat(float64(legacySub.Submitted.CoinAmount))
+			if err != nil {
+				return err
+			}
+			transactionSub.Submitted = &transaction
+		}
+		block.Transactions = append(block.Transactions, &transactionSub)
+	}
+
+	return nil
+}
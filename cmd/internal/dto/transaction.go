@@ -1,12 +1,80 @@
 package dto
 
+import "fmt"
+
 // Transaction defines the values and json of the transaction that the from-user signs which creates BodySigned on the TransactionSubmission struct
 type Transaction struct {
-	Key        string  `json:"key"`
-	Value      string  `json:"value"`
-	From       string  `json:"from"`
-	To         string  `json:"to"`
-	CoinAmount float64 `json:"coinAmount"`
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	CoinAmount Coin   `json:"coinAmount"`
+	Nonce      int64  `json:"nonce,omitempty"`
+	Fee        Coin   `json:"fee,omitempty"`
+	Type       string `json:"type,omitempty"`
+}
+
+const (
+	// TransactionTypeStake locks the coin amount of the from-user with the validator node whose public key is in the to field.
+	// The locked coin counts toward the validator's stake for proof of stake and is not credited to anyone's balance.
+	TransactionTypeStake = "stake"
+	// TransactionTypeUnstake unlocks coin the from-user staked with the validator node in the to field and returns it to the from-user
+	TransactionTypeUnstake = "unstake"
+	// TransactionTypeAddValidator adds the node public key in the to field to the proof of authority validators.
+	// It needs approvals from a majority of the current validators.
+	TransactionTypeAddValidator = "add-validator"
+	// TransactionTypeRemoveValidator removes the node public key in the to field from the proof of authority validators.
+	// It needs approvals from a majority of the current validators.
+	TransactionTypeRemoveValidator = "remove-validator"
+)
+
+// IsGovernance returns if the transaction changes the validators instead of moving coin
+func (t *Transaction) IsGovernance() bool {
+	return t.Type == TransactionTypeAddValidator || t.Type == TransactionTypeRemoveValidator
+}
+
+// ValidateType returns an error if the transaction type is unknown or a stake or unstake transaction is missing what it needs.
+// Transactions without a type are plain transfers.
+func (t *Transaction) ValidateType() error {
+	switch t.Type {
+	case "":
+		return nil
+	case TransactionTypeStake, TransactionTypeUnstake:
+		if t.CoinAmount <= 0 {
+			return fmt.Errorf("a %s transaction needs a positive coin amount", t.Type)
+		}
+		if t.To == "" {
+			return fmt.Errorf("a %s transaction needs the public key of the validator node in the to field", t.Type)
+		}
+		return nil
+	case TransactionTypeAddValidator, TransactionTypeRemoveValidator:
+		if t.CoinAmount != 0 {
+			return fmt.Errorf("a %s transaction can't move coin", t.Type)
+		}
+		if t.To == "" {
+			return fmt.Errorf("a %s transaction needs the public key of the validator node in the to field", t.Type)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown transaction type %q", t.Type)
+	}
+}
+
+// Spend returns the coin the from-user loses for this transaction, which is the coin amount plus the fee.
+// Unstaking gives the coin amount back, so the spend of an unstake transaction is the fee minus the coin amount and is usually negative.
+func (t *Transaction) Spend() (Coin, error) {
+	if t.Type == TransactionTypeUnstake {
+		return t.Fee.Sub(t.CoinAmount)
+	}
+	return t.CoinAmount.Add(t.Fee)
+}
+
+// Credit returns the coin the to-user gains for this transaction. Staked coin is locked instead of credited.
+func (t *Transaction) Credit() Coin {
+	if t.Type != "" {
+		return 0
+	}
+	return t.CoinAmount
 }
 
 // TransactionSubmission defines the values and json of a transaction payload
@@ -17,6 +85,33 @@ type TransactionSubmission struct {
 	DroppedReason     string       `json:"droppedReason"`
 	BodySigned        string       `json:"bodySigned"`
 	Submitted         *Transaction `json:"submit"`
+	Approvals         []*Approval  `json:"approvals,omitempty"`
+}
+
+// Approval is a validator node signing the ApprovalBody of the submitted transaction the same way the from-user signs the transaction, to approve a governance transaction
+type Approval struct {
+	PublicKey  string `json:"publicKey"`
+	BodySigned string `json:"bodySigned"`
+}
+
+// ApprovalBody defines the values and json that a validator node signs to approve a governance transaction.
+// The validator set height is the height of the last block that changed the validators, or 0 before any block has,
+// so an approval can't be used again once the validators it was given by have changed.
+type ApprovalBody struct {
+	Submitted          *Transaction `json:"submit"`
+	ValidatorSetHeight int64        `json:"validatorSetHeight"`
+}
+
+// Cancel defines the values and json of the message the from-user signs to cancel their pending transaction with the nonce
+type Cancel struct {
+	From  string `json:"from"`
+	Nonce int64  `json:"nonce"`
+}
+
+// CancelSubmission defines the values and json of a cancel payload
+type CancelSubmission struct {
+	BodySigned string  `json:"bodySigned"`
+	Submitted  *Cancel `json:"cancel"`
 }
 
 const (
@@ -24,6 +119,16 @@ const (
 	StatusDropped = "dropped"
 	// StatusWritten indicates a transaction or block has been accepted and written to the blockchain files
 	StatusWritten = "written"
+	// StatusPending indicates a transaction is waiting in the pending pool to be added to a block
+	StatusPending = "pending"
+	// StatusMining indicates a transaction is in the block the node is currently mining
+	StatusMining = "mining"
+	// StatusReplaced indicates a pending transaction was replaced by a transaction from the same user with the same nonce and a higher fee
+	StatusReplaced = "replaced"
+	// StatusCancelled indicates a pending transaction was cancelled by the user that signed it
+	StatusCancelled = "cancelled"
+	// StatusPruned indicates a written transaction was cut down to its ID by a pruning node, see PruneBlock
+	StatusPruned = "pruned"
 )
 
 /*
@@ -37,6 +142,8 @@ example request body
 		"from":"testPublicKeySender",
 		"to":"testPublicKeyRecipient",
 		"coinAmount":0.03,
+		"nonce":1,
+		"fee":0.001,
 		"timestamp":"a unix timestamp"
 	}
 }
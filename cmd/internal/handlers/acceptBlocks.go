@@ -2,17 +2,21 @@ package handlers
 
 import (
 	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/mining"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/blocktree"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
@@ -20,16 +24,22 @@ import (
 
 type blockAcceptor struct {
 	prevBlockHashRunner *mining.PreviousBlockHashRunner
+	engine              consensus.Engine
+	blockTree           *blocktree.BlockTree
 	searchIndex         *searchindexing.SearchIndexer
+	accountState        *accountstate.AccountState
 	PublicKey           *rsa.PublicKey
 	writeChan           chan *dto.BlockRequest
 }
 
 // NewBlockAcceptor returns a blockAcceptor struct for handling the new block endpoint.
-func NewBlockAcceptor(prevBlockHashRunner *mining.PreviousBlockHashRunner, searchIndex *searchindexing.SearchIndexer, publicKey *rsa.PublicKey, writeChan chan *dto.BlockRequest) *blockAcceptor {
+func NewBlockAcceptor(prevBlockHashRunner *mining.PreviousBlockHashRunner, engine consensus.Engine, blockTree *blocktree.BlockTree, searchIndex *searchindexing.SearchIndexer, accountState *accountstate.AccountState, publicKey *rsa.PublicKey, writeChan chan *dto.BlockRequest) *blockAcceptor {
 	return &blockAcceptor{
 		prevBlockHashRunner: prevBlockHashRunner,
+		engine:              engine,
+		blockTree:           blockTree,
 		searchIndex:         searchIndex,
+		accountState:        accountState,
 		PublicKey:           publicKey,
 		writeChan:           writeChan,
 	}
@@ -37,6 +47,7 @@ func NewBlockAcceptor(prevBlockHashRunner *mining.PreviousBlockHashRunner, searc
 
 // VerifyAndAppend handles the new block endpoint. VerifyAndAppend will receive a block on the request and add it to the written block chain if it deems the block is valid.
 // To be deemed valid by this node the block must acquire the claim on the previous hash within this node.
+// A block that builds on a side branch this node knows about doesn't need the claim. It goes in the block tree, and the node reorganizes onto its branch if the branch is heavier.
 func (b *blockAcceptor) VerifyAndAppend(resp http.ResponseWriter, req *http.Request) {
 	reqBodyBytes, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -53,7 +64,7 @@ func (b *blockAcceptor) VerifyAndAppend(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	blockReqBytes, err := json.Marshal(signRequest.Block)
+	blockReqBytes, err := dto.SignedBlockBytes(signRequest.Block)
 	if err != nil {
 		resp.WriteHeader(http.StatusBadRequest)
 		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the block for signing", "error":"%s"}`, err.Error())))
@@ -65,13 +76,17 @@ func (b *blockAcceptor) VerifyAndAppend(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	blockValidated := b.validateBlock(resp, signRequest.Block)
+	// the previous block is known but isn't the tip, so the block builds on a side branch
+	sideBranch := signRequest.Block.Header.PrevBlockHash != b.prevBlockHashRunner.GetPrevBlockHash()
+
+	blockValidated := b.validateBlock(resp, signRequest.Block, sideBranch)
 	if !blockValidated {
 		return
 	}
 
 	// verify we have enough valid signatures from other nodes
-	foundValidNodes := 0
+	validSignerPublicKeys := make([]string, 0, len(signRequest.Signatures))
+	validSignatures := make([]*dto.NodeSignature, 0, len(signRequest.Signatures))
 	for _, nodeSig := range signRequest.Signatures {
 		publicKey := autograph.BytesToPublicKey([]byte(nodeSig.PublicKey))
 		signedBlock, err := autograph.SignedBodyToBytes(nodeSig.SignedBlockRequest)
@@ -84,15 +99,38 @@ func (b *blockAcceptor) VerifyAndAppend(resp http.ResponseWriter, req *http.Requ
 			// TODO: maybe do something or print something about the invalid signature
 			continue
 		}
-		if foundValidNodes > 5 {
+		if len(validSignerPublicKeys) > 5 {
 			// TODO: If we know of enough valid nodes that have had a block accepted, reject the signature if we don't recognize the public key from the node
 		}
-		foundValidNodes++
+		validSignerPublicKeys = append(validSignerPublicKeys, nodeSig.PublicKey)
+		validSignatures = append(validSignatures, nodeSig)
 	}
 	// TODO: if we know of enough nodes that have had a block accepted for proof of work then check if we have enough signatures from those known nodes
 
-	// if no other node has sent me a block that adds to the previous hash and I have verified everything, claim the previous hash
+	if !b.engine.IsFinal(signRequest.Block, validSignerPublicKeys, 0) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(`{"message":"not enough valid node signatures for the consensus engine to accept the block"}`))
+		return
+	}
+
+	// there is no claim on a side branch to back the block up, so the origin node signing its own block isn't enough
+	if sideBranch && !signedByAnotherNode(signRequest.Block, validSignerPublicKeys) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(`{"message":"a block on a side branch needs a valid signature from a node other than the origin node"}`))
+		return
+	}
+
+	// the signatures are written with the block so the chain can be checked offline with the same finality rule
 	blockReq := signRequest.Block
+	blockReq.NodeSignatures = validSignatures
+	if sideBranch {
+		// there is no claim on a side branch, the block writer decides if the branch is heavier than the main chain
+		// and checks the branch against the replayed engine and account state before switching to it
+		b.writeChan <- blockReq
+		return
+	}
+
+	// if no other node has sent me a block that adds to the previous hash and I have verified everything, claim the previous hash
 	err = b.prevBlockHashRunner.SetPrevBlockHashAsClaimed(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash, blockReq.Header.PrevBlockHash)
 	if err != nil {
 		// If the block is not the same block claimed when signing then respond with error
@@ -104,14 +142,44 @@ func (b *blockAcceptor) VerifyAndAppend(resp http.ResponseWriter, req *http.Requ
 		}
 	}
 
+	// the block is accepted, so end the lease from its sign request so the claim can't expire before the block is written
+	if !b.prevBlockHashRunner.AcceptClaim(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(`{"message":"the claim on the previous block hash was released before the block was accepted"}`))
+		return
+	}
+
 	// writing the block will release the claim on the previous block hash
 	b.writeChan <- blockReq
 }
 
+// signedByAnotherNode returns if any of the valid signers isn't the origin node of the block
+func signedByAnotherNode(block *dto.BlockRequest, validSignerPublicKeys []string) bool {
+	for _, publicKey := range validSignerPublicKeys {
+		if publicKey != block.OriginNodePublicKey {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *blockAcceptor) validateAcceptRequest(resp http.ResponseWriter, signRequest *dto.NodeSignatures, blockReqBytes []byte) (success bool) {
-	if signRequest.Block.Header.PrevBlockHash != b.prevBlockHashRunner.GetPrevBlockHash() {
+	if signRequest.Block.Header.PrevBlockHash != b.prevBlockHashRunner.GetPrevBlockHash() && !b.blockTree.HasBlock(signRequest.Block.Header.PrevBlockHash) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"PrevBlockHash does not match last written block hash or any block on a side branch!"}`)))
+		return
+	}
+
+	prevHeight, _ := b.blockTree.Height(signRequest.Block.Header.PrevBlockHash)
+	if signRequest.Block.Header.Height != prevHeight+1 {
 		resp.WriteHeader(http.StatusUnauthorized)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"PrevBlockHash does not match last written block hash!"}`)))
+		resp.Write([]byte(fmt.Sprintf(`{"message":"the block header height %d is not one more than the height %d of the previous block"}`, signRequest.Block.Header.Height, prevHeight)))
+		return
+	}
+
+	if b.blockTree.HasBlock(signRequest.Block.ProofOfWorkHash) {
+		resp.WriteHeader(http.StatusConflict)
+		resp.Write([]byte(`{"message":"this node already has the block"}`))
 		return
 	}
 
@@ -150,17 +218,19 @@ func (b *blockAcceptor) validateAcceptRequest(resp http.ResponseWriter, signRequ
 	return true
 }
 
-func (b *blockAcceptor) validateBlock(resp http.ResponseWriter, blockReq *dto.BlockRequest) (success bool) {
-	blockHeaderBytes, err := json.Marshal(blockReq.Header)
-	if err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of block header to verify hash", "error":"%s"}`, err.Error())))
-		return
+func (b *blockAcceptor) validateBlock(resp http.ResponseWriter, blockReq *dto.BlockRequest, sideBranch bool) (success bool) {
+	// the consensus engine checks the seal, like the proof of work and its difficulty, against this node's own chain.
+	// this node doesn't have the state of a side branch, so only the parts of the seal that don't depend on it are checked here,
+	// and the block writer checks the rest against the engine replayed along the branch before it reorganizes
+	var err error
+	if sideBranch {
+		err = b.engine.ValidateBranchSeal(blockReq)
+	} else {
+		err = b.engine.ValidateSeal(blockReq)
 	}
-
-	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != blockReq.ProofOfWorkHash || !strings.HasPrefix(blockReq.ProofOfWorkHash, "00000") {
+	if err != nil {
 		resp.WriteHeader(http.StatusUnauthorized)
-		resp.Write([]byte(`{"message":"invalid proof of work or mismatching block header hash"}`))
+		resp.Write([]byte(fmt.Sprintf(`{"message":"invalid block seal", "error":"%s"}`, err.Error())))
 		return
 	}
 
@@ -198,56 +268,32 @@ func (b *blockAcceptor) validateBlock(resp http.ResponseWriter, blockReq *dto.Bl
 			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has negative coin", "transaction.ID":"%s"}`, transactionSub.ID)))
 			return
 		}
-	}
-
-	return true
-}
 
-func (b *blockAcceptor) validateUsersHaveEnoughCoin(resp http.ResponseWriter, blockReq *dto.BlockRequest) (success bool) {
-	// check for negative ballance of new transactions
-	usersBalances := make(map[string]float64)
-	var err error
+		if transactionSub.Submitted.Fee < 0 {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has negative fee", "transaction.ID":"%s"}`, transactionSub.ID)))
+			return
+		}
 
-	for _, transactionSub := range blockReq.Transactions {
-		senderBalance, foundSenderBalance := usersBalances[transactionSub.Submitted.From]
-		if !foundSenderBalance {
-			senderBalance, err = b.searchIndex.GetWrittenUserBalance(transactionSub.Submitted.From)
-			if err != nil {
-				if transactionSub.Submitted.CoinAmount != 0 {
-					resp.WriteHeader(http.StatusUnauthorized)
-					resp.Write([]byte(fmt.Sprintf(`{"message":"Could not get the From-User balance from the written blocks", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
-					return
-				}
-				senderBalance = 0
-			}
-			usersBalances[transactionSub.Submitted.From] = senderBalance
+		err = transactionSub.Submitted.ValidateType()
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has an invalid type", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
 		}
 
-		// the receiver might be the sender on following transactions
-		receiverBalance, foundReceiverBalance := usersBalances[transactionSub.Submitted.To]
-		if !foundReceiverBalance {
-			receiverBalance, err = b.searchIndex.GetWrittenUserBalance(transactionSub.Submitted.To)
-			if err != nil {
-				receiverBalance = 0
-			}
-			usersBalances[transactionSub.Submitted.To] = receiverBalance
+		if sideBranch {
+			// the engine state like the validators may be different on the side branch,
+			// so the block writer checks the transactions against the engine replayed along the branch before it reorganizes
+			continue
 		}
 
-		if senderBalance-transactionSub.Submitted.CoinAmount < 0 {
+		err = b.engine.ValidateTransaction(transactionSub)
+		if err != nil {
 			resp.WriteHeader(http.StatusUnauthorized)
-			resp.Write([]byte(fmt.Sprintf(`{"message":"Not enough Coin in user balance", "transaction.ID":"%s"}`, transactionSub.ID)))
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction is not allowed by the consensus engine", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
 			return
 		}
-
-		// update the balances map with the new amounts
-		// so that we are ready to check the next transaction in this block
-		usersBalances[transactionSub.Submitted.From] = senderBalance - transactionSub.Submitted.CoinAmount
-		usersBalances[transactionSub.Submitted.To] = receiverBalance + transactionSub.Submitted.CoinAmount
-	}
-
-	hasEnough := b.validateUsersHaveEnoughCoin(resp, blockReq)
-	if !hasEnough {
-		return
 	}
 
 	return true
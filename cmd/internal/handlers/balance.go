@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
+)
+
+type balanceReporter struct {
+	accountState *accountstate.AccountState
+}
+
+// NewBalanceReporter returns an instance of the balanceReporter struct for handling the balance and state snapshot endpoints
+func NewBalanceReporter(accountState *accountstate.AccountState) *balanceReporter {
+	return &balanceReporter{
+		accountState: accountState,
+	}
+}
+
+// balanceResponse is the account of the user in the written blocks, with the height of the block the account state is up to
+type balanceResponse struct {
+	Address string `json:"address"`
+	*accountstate.Account
+	Height int64 `json:"height"`
+}
+
+// Balance handles the balance endpoint. Balance responds with the balance, nonce and last seen height of the user public key in the written blocks.
+// The user public key is hexadecimal encoded in the url the same as the search user endpoint.
+func (b *balanceReporter) Balance(resp http.ResponseWriter, req *http.Request) {
+	addressBytes, err := hex.DecodeString(mux.Vars(req)["address"])
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`{"message":"address Public PEM string should be hexadecimal encoded for the url"}`))
+		return
+	}
+
+	address := string(addressBytes)
+	if !strings.HasPrefix(address, "-----BEGIN RSA PUBLIC KEY-----") {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`{"message":"address should be a Public RSA PEM string"}`))
+		return
+	}
+
+	account, err := b.accountState.GetAccount(address)
+	if err != nil {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"the address has no transactions in the written blocks", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	height, _ := b.accountState.Tip()
+	resultBytes, err := json.Marshal(&balanceResponse{
+		Address: address,
+		Account: account,
+		Height:  height,
+	})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the balance", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
+
+// Snapshot handles the state snapshot endpoint. Snapshot responds with the latest signed snapshot of the account state,
+// so a new node can start its account state from it instead of from the first block.
+func (b *balanceReporter) Snapshot(resp http.ResponseWriter, req *http.Request) {
+	snapshot := b.accountState.LatestSnapshot()
+	if snapshot == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte(`{"message":"this node has not taken a snapshot of the account state yet"}`))
+		return
+	}
+
+	resultBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the snapshot", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
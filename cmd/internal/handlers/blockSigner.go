@@ -2,17 +2,19 @@ package handlers
 
 import (
 	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/mining"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
@@ -20,20 +22,44 @@ import (
 
 type blockSigner struct {
 	prevBlockHashRunner *mining.PreviousBlockHashRunner
+	engine              consensus.Engine
 	searchIndex         *searchindexing.SearchIndexer
+	accountState        *accountstate.AccountState
+	signRequests        *signRequestCache
 	PrivateKey          *rsa.PrivateKey
 	PublicKey           *rsa.PublicKey
 }
 
 // NewBlockSigner returns an instance of the blockSigner struct for handling the block sign endpoint.
-func NewBlockSigner(prevBlockHashRunner *mining.PreviousBlockHashRunner, searchIndex *searchindexing.SearchIndexer) (*blockSigner, error) {
-	privateKey, publicKey, err := autograph.NewSig()
+// The node keys are loaded from nodeKeyFile, or made fresh when nodeKeyFile is empty.
+// Sign requests are remembered for signRequestCacheMinutes, up to signRequestCacheSize of them, and each origin node can have signRequestsPerTip of them signed on a tip.
+func NewBlockSigner(
+	prevBlockHashRunner *mining.PreviousBlockHashRunner,
+	engine consensus.Engine,
+	searchIndex *searchindexing.SearchIndexer,
+	accountState *accountstate.AccountState,
+	nodeKeyFile string,
+	signRequestCacheMinutes int64,
+	signRequestCacheSize,
+	signRequestsPerTip int,
+) (*blockSigner, error) {
+	var privateKey *rsa.PrivateKey
+	var publicKey *rsa.PublicKey
+	var err error
+	if nodeKeyFile == "" {
+		privateKey, publicKey, err = autograph.NewSig()
+	} else {
+		privateKey, publicKey, err = autograph.LoadOrCreateSig(nodeKeyFile)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &blockSigner{
 		prevBlockHashRunner: prevBlockHashRunner,
+		engine:              engine,
 		searchIndex:         searchIndex,
+		accountState:        accountState,
+		signRequests:        newSignRequestCache(signRequestCacheMinutes, signRequestCacheSize, signRequestsPerTip),
 		PrivateKey:          privateKey,
 		PublicKey:           publicKey,
 	}, nil
@@ -57,7 +83,7 @@ func (b *blockSigner) VerifyAndSign(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	blockReqBytes, err := json.Marshal(signRequest.Block)
+	blockReqBytes, err := dto.SignedBlockBytes(signRequest.Block)
 	if err != nil {
 		resp.WriteHeader(http.StatusBadRequest)
 		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the block for signing", "error":"%s"}`, err.Error())))
@@ -69,14 +95,34 @@ func (b *blockSigner) VerifyAndSign(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	blockValidated := b.validateBlock(resp, signRequest.Block)
+	// the origin node signature is verified, so the request can be checked against the origin node's limits. It is released again unless the block is signed
+	blockReq := signRequest.Block
+	repeats, err := b.signRequests.reserve(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash, blockReq.Header.PrevBlockHash)
+	if err == errRepeatedSignRequest {
+		resp.WriteHeader(http.StatusConflict)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"repeated sign request", "error":"%s"}`, err.Error())))
+		return
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusTooManyRequests)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"too many sign requests on the previous block hash", "error":"%s"}`, err.Error())))
+		return
+	}
+	signed := false
+	defer func() {
+		if !signed {
+			b.signRequests.release(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash, blockReq.Header.PrevBlockHash)
+		}
+	}()
+
+	blockValidated := b.validateBlock(resp, blockReq)
 	if !blockValidated {
 		return
 	}
 
-	// if no other node has sent me a block that adds to the previous hash and I have verified this block, claim the previous hash for 120 seconds
-	blockReq := signRequest.Block
-	err = b.prevBlockHashRunner.SetPrevBlockHashAsClaimedFromSignRequest(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash, blockReq.Header.PrevBlockHash)
+	// if no other node has sent me a block that adds to the previous hash and I have verified this block, claim the previous hash with a lease that runs out after --claim-lease-seconds,
+	// halved for each block the origin node already had signed on the previous hash
+	err = b.prevBlockHashRunner.SetPrevBlockHashAsClaimedFromSignRequest(blockReq.OriginNodePublicKey, blockReq.ProofOfWorkHash, blockReq.Header.PrevBlockHash, repeats)
 	if err != nil {
 		resp.WriteHeader(http.StatusUnauthorized)
 		resp.Write([]byte(fmt.Sprintf(`{"message":"the previous block hash is already claimed or trying to claim the wrong prevBlockHash", "error":"%s"}`, err.Error())))
@@ -96,6 +142,7 @@ func (b *blockSigner) VerifyAndSign(resp http.ResponseWriter, req *http.Request)
 	}
 
 	signRequest.Signatures = append(signRequest.Signatures, nodeSigned)
+	signed = true
 
 	signedResponse, err := json.Marshal(signRequest)
 	if err != nil {
@@ -109,11 +156,6 @@ func (b *blockSigner) VerifyAndSign(resp http.ResponseWriter, req *http.Request)
 }
 
 func (b *blockSigner) validateSignRequest(resp http.ResponseWriter, signRequest *dto.NodeSignatures, blockReqBytes []byte) (success bool) {
-	// If we were not avoiding using packages here, we would add a 20 minute cache of requests and reject duplicates sent within 20 minutes
-	// this would prevent a malicious node from sending the same block and proof of work repeatedly
-	// which would tie up this node by holding the prevBlockHash claim indefinitely
-	// requestCacheKey := signRequest.Block.OriginNodePublicKey + signRequest.Block.ProofOfWorkHash
-
 	if signRequest.Block.Header.PrevBlockHash != b.prevBlockHashRunner.GetPrevBlockHash() {
 		// use status 401 to mean un verified
 		resp.WriteHeader(http.StatusUnauthorized)
@@ -121,6 +163,14 @@ func (b *blockSigner) validateSignRequest(resp http.ResponseWriter, signRequest
 		return
 	}
 
+	// the account state is up to the last written block, so the block has to be one higher
+	tipHeight, tipHash := b.accountState.Tip()
+	if tipHash != signRequest.Block.Header.PrevBlockHash || signRequest.Block.Header.Height != tipHeight+1 {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"the block header height %d is not one more than the height %d of the last written block"}`, signRequest.Block.Header.Height, tipHeight)))
+		return
+	}
+
 	if signRequest.Block.OriginNodePublicKey == "" {
 		resp.WriteHeader(http.StatusBadRequest)
 		resp.Write([]byte(fmt.Sprintf(`{"message":"OriginNodePublicKey is empty! waddaya tryina pull?"}`)))
@@ -158,16 +208,11 @@ func (b *blockSigner) validateSignRequest(resp http.ResponseWriter, signRequest
 }
 
 func (b *blockSigner) validateBlock(resp http.ResponseWriter, blockReq *dto.BlockRequest) (success bool) {
-	blockHeaderBytes, err := json.Marshal(blockReq.Header)
+	// the consensus engine checks the seal, like the proof of work and its difficulty, against this node's own chain
+	err := b.engine.ValidateSeal(blockReq)
 	if err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of block header to verify hash", "error":"%s"}`, err.Error())))
-		return
-	}
-
-	if fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes)) != blockReq.ProofOfWorkHash || !strings.HasPrefix(blockReq.ProofOfWorkHash, "00000") {
 		resp.WriteHeader(http.StatusUnauthorized)
-		resp.Write([]byte(`{"message":"invalid proof of work or mismatching block header hash"}`))
+		resp.Write([]byte(fmt.Sprintf(`{"message":"invalid block seal", "error":"%s"}`, err.Error())))
 		return
 	}
 
@@ -205,6 +250,26 @@ func (b *blockSigner) validateBlock(resp http.ResponseWriter, blockReq *dto.Bloc
 			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has negative coin", "transaction.ID":"%s"}`, transactionSub.ID)))
 			return
 		}
+
+		if transactionSub.Submitted.Fee < 0 {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has negative fee", "transaction.ID":"%s"}`, transactionSub.ID)))
+			return
+		}
+
+		err = transactionSub.Submitted.ValidateType()
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction has an invalid type", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
+		}
+
+		err = b.engine.ValidateTransaction(transactionSub)
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction is not allowed by the consensus engine", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
+		}
 	}
 
 	hasEnough := b.validateUsersHaveEnoughCoin(resp, blockReq)
@@ -217,15 +282,29 @@ func (b *blockSigner) validateBlock(resp http.ResponseWriter, blockReq *dto.Bloc
 
 func (b *blockSigner) validateUsersHaveEnoughCoin(resp http.ResponseWriter, blockReq *dto.BlockRequest) (success bool) {
 	// check for negative ballance of new transactions
-	usersBalances := make(map[string]float64)
-	var err error
+	usersBalances := make(map[string]dto.Coin)
+	stakeLedger := b.accountState.NewStakeLedger()
+	nonceLedger := b.accountState.NewNonceLedger()
 
 	for _, transactionSub := range blockReq.Transactions {
+		if transactionSub.TransactionStatus == dto.StatusDropped {
+			// dropped transactions don't move any coin
+			continue
+		}
+
+		// the fee is lost by the sender along with the coin amount
+		spend, err := transactionSub.Submitted.Spend()
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction coin amount plus fee overflows", "transaction.ID":"%s"}`, transactionSub.ID)))
+			return
+		}
+
 		senderBalance, foundSenderBalance := usersBalances[transactionSub.Submitted.From]
 		if !foundSenderBalance {
-			senderBalance, err = b.searchIndex.GetWrittenUserBalance(transactionSub.Submitted.From)
+			senderBalance, err = b.accountState.GetWrittenUserBalance(transactionSub.Submitted.From)
 			if err != nil {
-				if transactionSub.Submitted.CoinAmount != 0 {
+				if spend != 0 {
 					resp.WriteHeader(http.StatusUnauthorized)
 					resp.Write([]byte(fmt.Sprintf(`{"message":"Could not get the From-User balance from the written blocks", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
 					return
@@ -238,23 +317,47 @@ func (b *blockSigner) validateUsersHaveEnoughCoin(resp http.ResponseWriter, bloc
 		// the receiver might be the sender on following transactions
 		receiverBalance, foundReceiverBalance := usersBalances[transactionSub.Submitted.To]
 		if !foundReceiverBalance {
-			receiverBalance, err = b.searchIndex.GetWrittenUserBalance(transactionSub.Submitted.To)
+			receiverBalance, err = b.accountState.GetWrittenUserBalance(transactionSub.Submitted.To)
 			if err != nil {
 				receiverBalance = 0
 			}
 			usersBalances[transactionSub.Submitted.To] = receiverBalance
 		}
 
-		if senderBalance-transactionSub.Submitted.CoinAmount < 0 {
+		newSenderBalance, err := senderBalance.Sub(spend)
+		if err != nil || newSenderBalance < 0 {
 			resp.WriteHeader(http.StatusUnauthorized)
 			resp.Write([]byte(fmt.Sprintf(`{"message":"Not enough Coin in user balance", "transaction.ID":"%s"}`, transactionSub.ID)))
 			return
 		}
 
+		newReceiverBalance, err := receiverBalance.Add(transactionSub.Submitted.Credit())
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"To-User balance would overflow", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
+		}
+
+		// can't unstake more than was staked with the validator
+		err = stakeLedger.Apply(transactionSub.Submitted)
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"invalid stake change", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
+		}
+
+		// a nonce can only be written once
+		err = nonceLedger.Apply(transactionSub.Submitted)
+		if err != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"invalid nonce", "transaction.ID":"%s", "error":"%s"}`, transactionSub.ID, err.Error())))
+			return
+		}
+
 		// update the balances map with the new amounts
 		// so that we are ready to check the next transaction in this block
-		usersBalances[transactionSub.Submitted.From] = senderBalance - transactionSub.Submitted.CoinAmount
-		usersBalances[transactionSub.Submitted.To] = receiverBalance + transactionSub.Submitted.CoinAmount
+		usersBalances[transactionSub.Submitted.From] = newSenderBalance
+		usersBalances[transactionSub.Submitted.To] = newReceiverBalance
 	}
 
 	return true
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/blocktree"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/mining"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+)
+
+type chainReporter struct {
+	blockTree           *blocktree.BlockTree
+	blockStore          storage.BlockStore
+	prevBlockHashRunner *mining.PreviousBlockHashRunner
+	pruneMode           string
+	pruneRetention      int64
+}
+
+// NewChainReporter returns an instance of the chainReporter struct for reporting on the block tree, the written blocks and the claim on the previous hash
+func NewChainReporter(blockTree *blocktree.BlockTree, blockStore storage.BlockStore, prevBlockHashRunner *mining.PreviousBlockHashRunner) *chainReporter {
+	return &chainReporter{
+		blockTree:           blockTree,
+		blockStore:          blockStore,
+		prevBlockHashRunner: prevBlockHashRunner,
+		pruneMode:           storage.ArchivalMode,
+	}
+}
+
+// SetPruneMode sets the --prune mode and retention the node advertises on the healthcheck endpoint
+func (c *chainReporter) SetPruneMode(mode string, retention int64) {
+	c.pruneMode = mode
+	c.pruneRetention = retention
+}
+
+// nodeHealth is what a node advertises to its peers on the healthcheck endpoint
+type nodeHealth struct {
+	// Mode is "archival" when the node keeps every block whole, or "pruned" when it prunes the transaction bodies of old blocks
+	Mode      string `json:"mode"`
+	PruneMode string `json:"pruneMode"`
+	Retention int64  `json:"retention,omitempty"`
+	// PrunedHeight is the height that every block up to and including is pruned on the node
+	PrunedHeight int64 `json:"prunedHeight"`
+	Height       int64 `json:"height"`
+}
+
+// Healthcheck handles the healthcheck endpoint. Healthcheck responds with whether the node is archival or pruned, so peers know which blocks it still has whole.
+func (c *chainReporter) Healthcheck(resp http.ResponseWriter, req *http.Request) {
+	health := &nodeHealth{
+		Mode:      "archival",
+		PruneMode: c.pruneMode,
+	}
+	if c.pruneMode != storage.ArchivalMode {
+		health.Mode = "pruned"
+		health.Retention = c.pruneRetention
+	}
+	if pruner, ok := c.blockStore.(storage.Pruner); ok {
+		health.PrunedHeight = pruner.PrunedHeight()
+	}
+	health.Height, _ = c.blockTree.Height(c.blockTree.Tip())
+
+	resultBytes, err := json.Marshal(health)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the node health", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
+
+// chainBlock is a written block on the chain with its height
+type chainBlock struct {
+	Height int64             `json:"height"`
+	Block  *dto.BlockRequest `json:"block"`
+}
+
+// Tip handles the chain tip endpoint. Tip responds with the last written block on the chain and its height.
+func (c *chainReporter) Tip(resp http.ResponseWriter, req *http.Request) {
+	height, block, err := c.blockStore.Tip()
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not read the tip from the block store", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	c.writeBlock(resp, height, block)
+}
+
+// BlockByHeight handles the chain block by height endpoint. BlockByHeight responds with the written block at the height on the chain.
+func (c *chainReporter) BlockByHeight(resp http.ResponseWriter, req *http.Request) {
+	height, err := strconv.ParseInt(mux.Vars(req)["height"], 10, 64)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"height is not a number", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	block, err := c.blockStore.GetByHeight(height)
+	if !c.checkBlockFound(resp, err) {
+		return
+	}
+
+	c.writeBlock(resp, height, block)
+}
+
+// BlockByHash handles the chain block by hash endpoint. BlockByHash responds with the written block on the chain with the block hash.
+func (c *chainReporter) BlockByHash(resp http.ResponseWriter, req *http.Request) {
+	blockHash := mux.Vars(req)["block_hash"]
+
+	block, err := c.blockStore.GetByHash(blockHash)
+	if !c.checkBlockFound(resp, err) {
+		return
+	}
+
+	height, _ := c.blockTree.Height(blockHash)
+	c.writeBlock(resp, height, block)
+}
+
+func (c *chainReporter) checkBlockFound(resp http.ResponseWriter, err error) (success bool) {
+	if err == storage.ErrBlockNotFound {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte(`{"message":"the block is not on the written chain"}`))
+		return false
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not read the block from the block store", "error":"%s"}`, err.Error())))
+		return false
+	}
+	return true
+}
+
+func (c *chainReporter) writeBlock(resp http.ResponseWriter, height int64, block *dto.BlockRequest) {
+	resultBytes, err := json.Marshal(&chainBlock{
+		Height: height,
+		Block:  block,
+	})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the block", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
+
+// Reorgs handles the chain reorgs endpoint. Reorgs responds with the recent reorg events, oldest first.
+func (c *chainReporter) Reorgs(resp http.ResponseWriter, req *http.Request) {
+	resultBytes, err := json.Marshal(c.blockTree.RecentReorgs())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the reorg events", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
+
+// Claim handles the admin claim endpoint. Claim responds with the node and block holding the claim on the previous hash,
+// and when the lease on the claim expires if it came from a sign request.
+func (c *chainReporter) Claim(resp http.ResponseWriter, req *http.Request) {
+	resultBytes, err := json.Marshal(c.prevBlockHashRunner.GetClaimStatus())
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the claim status", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
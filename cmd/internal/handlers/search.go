@@ -5,26 +5,88 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/droppedjournal"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
 )
 
 type searcher struct {
-	searchIndex *searchindexing.SearchIndexer
+	searchIndex    *searchindexing.SearchIndexer
+	droppedJournal *droppedjournal.DroppedJournal
 }
 
-// NewSearcher returns an instance of the searcher struct for searching via the built search index
-func NewSearcher(searchIndex *searchindexing.SearchIndexer) *searcher {
+// NewSearcher returns an instance of the searcher struct for searching via the built search index and the dropped journal
+func NewSearcher(searchIndex *searchindexing.SearchIndexer, droppedJournal *droppedjournal.DroppedJournal) *searcher {
 	return &searcher{
-		searchIndex: searchIndex,
+		searchIndex:    searchIndex,
+		droppedJournal: droppedJournal,
 	}
 }
 
+// includeDropped returns if the search asked for dropped transactions with ?include_dropped=true
+func includeDropped(req *http.Request) bool {
+	return req.URL.Query().Get("include_dropped") == "true"
+}
+
+// withoutDropped returns the transactions that weren't dropped from the block they were written in
+func withoutDropped(transactions []*dto.TransactionSubmission) []*dto.TransactionSubmission {
+	result := make([]*dto.TransactionSubmission, 0, len(transactions))
+	for _, transaction := range transactions {
+		if transaction.TransactionStatus != dto.StatusDropped {
+			result = append(result, transaction)
+		}
+	}
+	return result
+}
+
+// filterDropped leaves out the dropped transactions found in the written blocks, or adds the ones in the dropped journal when the search asked for dropped transactions
+func filterDropped(req *http.Request, transactions []*dto.TransactionSubmission, dropped []*droppedjournal.Entry) []*dto.TransactionSubmission {
+	if !includeDropped(req) {
+		return withoutDropped(transactions)
+	}
+	return append(transactions, droppedjournal.Transactions(dropped)...)
+}
+
+// withoutPruned leaves out the transactions whose bodies were pruned from old blocks by this node.
+// When the node has pruned blocks, the X-Pruned-Height header says every block up to that height is pruned, so the search can't find the transactions in them.
+func (s *searcher) withoutPruned(resp http.ResponseWriter, transactions []*dto.TransactionSubmission) []*dto.TransactionSubmission {
+	prunedHeight := s.searchIndex.PrunedHeight()
+	if prunedHeight == 0 {
+		return transactions
+	}
+	resp.Header().Set("X-Pruned-Height", strconv.FormatInt(prunedHeight, 10))
+
+	result := make([]*dto.TransactionSubmission, 0, len(transactions))
+	for _, transaction := range transactions {
+		if transaction.TransactionStatus != dto.StatusPruned {
+			result = append(result, transaction)
+		}
+	}
+	return result
+}
+
+// reportPruned responds that nothing was found in the blocks the node hasn't pruned, when it has pruned blocks, since the pruned transactions can't be searched for.
+// It returns if the response was written.
+func (s *searcher) reportPruned(resp http.ResponseWriter) bool {
+	prunedHeight := s.searchIndex.PrunedHeight()
+	if prunedHeight == 0 {
+		return false
+	}
+	resp.Header().Set("X-Pruned-Height", strconv.FormatInt(prunedHeight, 10))
+	resp.WriteHeader(http.StatusNotFound)
+	resp.Write([]byte(fmt.Sprintf(`{"message":"no transactions found after height %d, the blocks up to it are pruned on this node", "status":"%s"}`, prunedHeight, dto.StatusPruned)))
+	return true
+}
+
 // Transaction handles the search transaction endpoint.
 // Transaction searches for transactions in the written-to-file blocks.
 // Transaction searches via the built search index using the transaction ID as the search key.
+// Dropped transactions are left out unless the search has ?include_dropped=true, and then the dropped journal is searched too.
+// A transaction in a block this node has pruned is reported as pruned with 410 Gone, since only its ID is left.
 func (s *searcher) Transaction(resp http.ResponseWriter, req *http.Request) {
 	searchTerms := mux.Vars(req)
 
@@ -41,18 +103,29 @@ func (s *searcher) Transaction(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	var transactions []*dto.TransactionSubmission
 	fileName, transactionIndex, err := s.searchIndex.GetTransactionPathByID(transactionID)
-	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		resp.Write([]byte(fmt.Sprintf("error finding transaction: %s", err.Error())))
-		return
-	}
-
-	transactions, err := s.searchIndex.GetTransactionsFromSingleFile(fileName, []int{transactionIndex})
-	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		resp.Write([]byte(fmt.Sprintf("error finding transaction: %s", err.Error())))
-		return
+	if err == nil {
+		transactions, err = s.searchIndex.GetTransactionsFromSingleFile(fileName, []int{transactionIndex})
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			resp.Write([]byte(fmt.Sprintf("error finding transaction: %s", err.Error())))
+			return
+		}
+		if transactions[0].TransactionStatus == dto.StatusPruned {
+			resp.WriteHeader(http.StatusGone)
+			resp.Write([]byte(fmt.Sprintf(`{"transaction_id":"%s", "status":"%s"}`, transactionID, dto.StatusPruned)))
+			return
+		}
+		transactions = filterDropped(req, transactions, nil)
+	} else {
+		entry, found := s.droppedJournal.Get(transactionID)
+		if !found || !includeDropped(req) {
+			resp.WriteHeader(http.StatusInternalServerError)
+			resp.Write([]byte(fmt.Sprintf("error finding transaction: %s", err.Error())))
+			return
+		}
+		transactions = []*dto.TransactionSubmission{entry.Transaction}
 	}
 
 	resultBytes, err := json.Marshal(transactions)
@@ -69,6 +142,8 @@ func (s *searcher) Transaction(resp http.ResponseWriter, req *http.Request) {
 // Keyword handles the search keyword endpoint.
 // Keyword searches for transactions with the specified value under "key" in the written-to-file blocks.
 // Keyword searches via the built search index using the keyword as the search key.
+// Dropped transactions are left out unless the search has ?include_dropped=true, and then the dropped journal is searched too.
+// Pruned transactions are left out, see withoutPruned.
 func (s *searcher) Keyword(resp http.ResponseWriter, req *http.Request) {
 	searchTerms := mux.Vars(req)
 
@@ -79,8 +154,12 @@ func (s *searcher) Keyword(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	dropped := s.droppedJournal.GetByKeyword(key)
 	searchPaths, err := s.searchIndex.GetTransactionPathsByKeyword(key)
-	if err != nil {
+	if err != nil && (len(dropped) == 0 || !includeDropped(req)) {
+		if s.reportPruned(resp) {
+			return
+		}
 		resp.WriteHeader(http.StatusInternalServerError)
 		resp.Write([]byte(fmt.Sprintf("error finding transactions: %s", err.Error())))
 		return
@@ -92,6 +171,7 @@ func (s *searcher) Keyword(resp http.ResponseWriter, req *http.Request) {
 		resp.Write([]byte(fmt.Sprintf("error finding transactions: %s", err.Error())))
 		return
 	}
+	transactions = filterDropped(req, s.withoutPruned(resp, transactions), dropped)
 
 	resultBytes, err := json.Marshal(transactions)
 	if err != nil {
@@ -107,6 +187,8 @@ func (s *searcher) Keyword(resp http.ResponseWriter, req *http.Request) {
 // User handles the search user endpoint.
 // User searches for transactions with the user public key as the from-user or to-user in the written-to-file blocks.
 // User searches via the built search index using the user public key as the search key.
+// Dropped transactions are left out unless the search has ?include_dropped=true, and then the dropped journal is searched too.
+// Pruned transactions are left out, see withoutPruned.
 func (s *searcher) User(resp http.ResponseWriter, req *http.Request) {
 	searchTerms := mux.Vars(req)
 
@@ -133,8 +215,12 @@ func (s *searcher) User(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	dropped := s.droppedJournal.GetByUserID(userID)
 	searchPaths, err := s.searchIndex.GetTransactionPathsByUserID(userID)
-	if err != nil {
+	if err != nil && (len(dropped) == 0 || !includeDropped(req)) {
+		if s.reportPruned(resp) {
+			return
+		}
 		resp.WriteHeader(http.StatusInternalServerError)
 		resp.Write([]byte(fmt.Sprintf("error finding transactions: %s", err.Error())))
 		return
@@ -146,6 +232,7 @@ func (s *searcher) User(resp http.ResponseWriter, req *http.Request) {
 		resp.Write([]byte(fmt.Sprintf("error finding transactions: %s", err.Error())))
 		return
 	}
+	transactions = filterDropped(req, s.withoutPruned(resp, transactions), dropped)
 
 	resultBytes, err := json.Marshal(transactions)
 	if err != nil {
@@ -157,3 +244,52 @@ func (s *searcher) User(resp http.ResponseWriter, req *http.Request) {
 	resp.WriteHeader(http.StatusOK)
 	resp.Write(resultBytes)
 }
+
+// Dropped handles the dropped journal endpoint.
+// Dropped responds with the entries of the dropped journal, with the reason, attempts and timestamps of each dropped transaction.
+// With ?since=<unix time> only the transactions dropped at or after that time are in the response.
+func (s *searcher) Dropped(resp http.ResponseWriter, req *http.Request) {
+	since := int64(0)
+	if sinceStr := req.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		since, err = strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte(fmt.Sprintf("since is not a unix time: %s", err.Error())))
+			return
+		}
+	}
+
+	resultBytes, err := json.Marshal(s.droppedJournal.Since(since))
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf("error marshallig dropped journal entries to json: %s", err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
+
+// DroppedTransaction handles the dropped journal transaction endpoint.
+// DroppedTransaction responds with the entry of the dropped journal for the transaction ID.
+func (s *searcher) DroppedTransaction(resp http.ResponseWriter, req *http.Request) {
+	transactionID := mux.Vars(req)["transaction_id"]
+
+	entry, found := s.droppedJournal.Get(transactionID)
+	if !found {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("transaction ID is not in the dropped journal"))
+		return
+	}
+
+	resultBytes, err := json.Marshal(entry)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf("error marshallig dropped journal entry to json: %s", err.Error())))
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(resultBytes)
+}
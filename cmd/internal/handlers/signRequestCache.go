@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// errRepeatedSignRequest is returned by reserve when the origin node already asked to sign the same block
+	errRepeatedSignRequest = errors.New("this node was already asked to sign the block")
+	// errTooManySignRequests is returned by reserve when the origin node already asked for too many claims on the previous hash
+	errTooManySignRequests = errors.New("the origin node asked for too many claims on the previous block hash")
+)
+
+// signRequestCache is the struct that remembers the sign requests this node has seen, with a mutex lock.
+// Without it a malicious node could send the same block and proof of work over and over,
+// and hold the claim on the previous hash forever because every request claims it with another lease.
+// A node could also do the same by sealing new blocks on the same previous hash, which is cheap without proof of work,
+// so the number of sign requests from each origin node on the current tip is limited too.
+type signRequestCache struct {
+	mx               *sync.Mutex
+	ttl              time.Duration
+	maxEntries       int
+	maxRequestsOnTip int
+	seenAt           map[string]time.Time
+	// seenOrder is the keys of seenAt oldest first, for expiring and evicting entries
+	seenOrder []string
+	tip       string
+	onTip     map[string]int
+	// now is the time, can be swapped out for a fake clock
+	now func() time.Time
+}
+
+// newSignRequestCache returns an empty instance of the signRequestCache struct
+// that remembers up to maxEntries sign requests for ttlMinutes, and allows maxRequestsOnTip sign requests from each origin node on a tip.
+func newSignRequestCache(ttlMinutes int64, maxEntries, maxRequestsOnTip int) *signRequestCache {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &signRequestCache{
+		mx:               &sync.Mutex{},
+		ttl:              time.Duration(ttlMinutes) * time.Minute,
+		maxEntries:       maxEntries,
+		maxRequestsOnTip: maxRequestsOnTip,
+		seenAt:           make(map[string]time.Time),
+		seenOrder:        make([]string, 0),
+		onTip:            make(map[string]int),
+		now:              time.Now,
+	}
+}
+
+// reserve returns errRepeatedSignRequest or errTooManySignRequests if the sign request from the origin node for the block can't be signed.
+// Otherwise it remembers the sign request and counts it toward the limit on the tip in the same lock, so the same request sent twice at once can't both get through,
+// and returns how many sign requests from the origin node were already counted on the tip.
+// Only call reserve after the signature from the origin node is verified, so a node can't use up the limit of another node,
+// and call release if the block isn't signed after all, so invalid blocks and blocks that lose the claim don't use up the limit of an honest node that is retrying.
+func (c *signRequestCache) reserve(originNodePublicKey, proofOfWorkHash, prevBlockHash string) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	now := c.now()
+	c.expire(now)
+	key := signRequestKey(originNodePublicKey, proofOfWorkHash)
+	if _, seen := c.seenAt[key]; seen {
+		return 0, errRepeatedSignRequest
+	}
+
+	c.moveToTip(prevBlockHash)
+	repeats := c.onTip[originNodePublicKey]
+	if c.maxRequestsOnTip > 0 && repeats >= c.maxRequestsOnTip {
+		return 0, errTooManySignRequests
+	}
+
+	c.onTip[originNodePublicKey]++
+	c.seenAt[key] = now
+	c.seenOrder = append(c.seenOrder, key)
+	return repeats, nil
+}
+
+// release forgets the sign request reserve remembered, for a block that wasn't signed
+func (c *signRequestCache) release(originNodePublicKey, proofOfWorkHash, prevBlockHash string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	key := signRequestKey(originNodePublicKey, proofOfWorkHash)
+	if _, seen := c.seenAt[key]; !seen {
+		return
+	}
+	delete(c.seenAt, key)
+	for i, seenKey := range c.seenOrder {
+		if seenKey == key {
+			c.seenOrder = append(c.seenOrder[:i], c.seenOrder[i+1:]...)
+			break
+		}
+	}
+
+	// the counts started again if the tip moved on since the request was reserved
+	if prevBlockHash == c.tip && c.onTip[originNodePublicKey] > 0 {
+		c.onTip[originNodePublicKey]--
+	}
+}
+
+// moveToTip starts the counts again when the sign request is on a new tip, the counts are only for the current tip. Call with the mutex locked.
+func (c *signRequestCache) moveToTip(prevBlockHash string) {
+	if prevBlockHash != c.tip {
+		c.tip = prevBlockHash
+		c.onTip = make(map[string]int)
+	}
+}
+
+// signRequestKey is the key the sign request from the origin node for the block is remembered under
+func signRequestKey(originNodePublicKey, proofOfWorkHash string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(originNodePublicKey+proofOfWorkHash)))
+}
+
+// expire forgets the sign requests older than the ttl, and the oldest ones past maxEntries. Call with the mutex locked.
+func (c *signRequestCache) expire(now time.Time) {
+	expired := 0
+	for _, key := range c.seenOrder {
+		if now.Sub(c.seenAt[key]) <= c.ttl && len(c.seenOrder)-expired < c.maxEntries {
+			break
+		}
+		delete(c.seenAt, key)
+		expired++
+	}
+	c.seenOrder = c.seenOrder[expired:]
+}
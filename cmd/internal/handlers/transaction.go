@@ -7,24 +7,98 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/droppedjournal"
+
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/pendingpool"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
 )
 
 type transactionRunner struct {
-	TranChan chan *dto.TransactionSubmission
+	TranChan          chan *dto.TransactionSubmission
+	pendingPool       *pendingpool.PendingPool
+	searchIndex       *searchindexing.SearchIndexer
+	droppedJournal    *droppedjournal.DroppedJournal
+	accountState      *accountstate.AccountState
+	engine            consensus.Engine
+	admitMx           *sync.Mutex
+	maxPending        int
+	retryAfterSeconds int64
 }
 
 // NewTransactionRunner initiates transactionRunner with a channel for passing to the transaction queue
-func NewTransactionRunner(tranChan chan *dto.TransactionSubmission) *transactionRunner {
+// and the pending pool for replacing, cancelling and looking up the status of transactions.
+// When the tranChan is full or maxPending transactions are waiting to be written, new transactions are turned away with a 503 and Retry-After.
+func NewTransactionRunner(
+	tranChan chan *dto.TransactionSubmission,
+	pendingPool *pendingpool.PendingPool,
+	searchIndex *searchindexing.SearchIndexer,
+	droppedJournal *droppedjournal.DroppedJournal,
+	accountState *accountstate.AccountState,
+	engine consensus.Engine,
+	maxPending int,
+	retryAfterSeconds int64,
+) *transactionRunner {
 	return &transactionRunner{
-		TranChan: tranChan,
+		TranChan:          tranChan,
+		pendingPool:       pendingPool,
+		searchIndex:       searchIndex,
+		droppedJournal:    droppedJournal,
+		accountState:      accountState,
+		engine:            engine,
+		admitMx:           &sync.Mutex{},
+		maxPending:        maxPending,
+		retryAfterSeconds: retryAfterSeconds,
 	}
 }
 
+// freeSlots returns how many transactions can be admitted without blocking on the tranChan or going over maxPending.
+// Call with admitMx locked. The handlers are the only senders on the tranChan and they hold admitMx while sending,
+// so the slots can't be taken between checking and sending.
+func (r *transactionRunner) freeSlots() int {
+	free := cap(r.TranChan) - len(r.TranChan)
+	poolFree := r.maxPending - r.pendingPool.PendingCount()
+	if poolFree < free {
+		free = poolFree
+	}
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// writeSaturated responds with 503 and Retry-After when there is no room for more pending transactions
+func (r *transactionRunner) writeSaturated(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", strconv.FormatInt(r.retryAfterSeconds, 10))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	resp.Write([]byte(fmt.Sprintf(`{"message":"the pending pool is full, retry later", "queue_depth":%d, "queue_capacity":%d}`, r.pendingPool.PendingCount(), r.maxPending)))
+}
+
+// Queue handles the transaction queue endpoint. Queue reports how many transactions are pending and how many fit.
+func (r *transactionRunner) Queue(resp http.ResponseWriter, req *http.Request) {
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(fmt.Sprintf(
+		`{"queue_depth":%d, "queue_capacity":%d, "channel_depth":%d, "channel_capacity":%d}`,
+		r.pendingPool.PendingCount(),
+		r.maxPending,
+		len(r.TranChan),
+		cap(r.TranChan),
+	)))
+}
+
 /*
 example request:
 
@@ -40,7 +114,9 @@ curl --request POST \
 		"value": "anything",
 		"from": "-----BEGIN RSA PUBLIC KEY-----\nMIGf...\n-----END RSA PUBLIC KEY-----",
 		"to": "testPublicKeyRecipient",
-		"coinAmount": 0.03
+		"coinAmount": 0.03,
+		"nonce": 1,
+		"fee": 0.001
 	}
 }'
 
@@ -49,9 +125,12 @@ response:
 {
   "submission": "success"
 }
+
+Sending a transaction with the same from-user and nonce as a pending transaction and a higher fee replaces the pending transaction.
 */
 
 // Transaction is the handler for intaking transaction payloads. Transaction will verify the signature of the from-user and verify the coin is a positive value.
+// If the from-user already has a pending transaction with the same nonce, the new transaction replaces it when it has a higher fee.
 func (r *transactionRunner) Transaction(resp http.ResponseWriter, req *http.Request) {
 	reqBodyBytes, err := ioutil.ReadAll(req.Body)
 	if err != nil {
@@ -68,27 +147,80 @@ func (r *transactionRunner) Transaction(resp http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	statusCode, message, err := r.verifyAndStampTransaction(transactionSub)
+	if statusCode != http.StatusOK {
+		resp.WriteHeader(statusCode)
+		resp.Write(messageJSON(message, err))
+		return
+	}
+
+	// the client may have given up while we were verifying the signature
+	if req.Context().Err() != nil {
+		return
+	}
+
+	r.admitMx.Lock()
+	if r.freeSlots() < 1 {
+		r.admitMx.Unlock()
+		r.writeSaturated(resp)
+		return
+	}
+
+	replacedID, err := r.pendingPool.Add(transactionSub)
+	if err != nil {
+		r.admitMx.Unlock()
+		resp.WriteHeader(http.StatusConflict)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not replace the pending transaction", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	r.TranChan <- transactionSub
+	r.admitMx.Unlock()
+
+	resp.WriteHeader(http.StatusOK)
+	if replacedID != "" {
+		resp.Write([]byte(fmt.Sprintf(`{"submission":"success", "transaction_id":"%s", "replaced_transaction_id":"%s"}`, transactionSub.ID, replacedID)))
+		return
+	}
+	resp.Write([]byte(fmt.Sprintf(`{"submission":"success", "transaction_id":"%s"}`, transactionSub.ID)))
+}
+
+// verifyAndStampTransaction verifies the signature of the from-user, that the coin and fee are not negative,
+// anything the consensus engine checks like validator approvals, and that the nonce has not been written yet, then adds the timestamp and transaction ID.
+// The status code is http.StatusOK when the transaction is good to add to the pending pool.
+func (r *transactionRunner) verifyAndStampTransaction(transactionSub *dto.TransactionSubmission) (statusCode int, message string, err error) {
+	if transactionSub == nil || transactionSub.Submitted == nil {
+		return http.StatusBadRequest, "submit is empty", nil
+	}
+
 	// don't allow negative coinAmounts, but 0 coin is fine
 	if transactionSub.Submitted.CoinAmount < 0 {
-		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(`{"message":"don't send a negative coin amount"}`))
-		return
+		return http.StatusBadRequest, "don't send a negative coin amount", nil
+	}
+
+	if transactionSub.Submitted.Fee < 0 {
+		return http.StatusBadRequest, "don't send a negative fee", nil
+	}
+
+	err = transactionSub.Submitted.ValidateType()
+	if err != nil {
+		return http.StatusBadRequest, "invalid transaction type", err
+	}
+
+	if transactionSub.Submitted.Nonce < 0 {
+		return http.StatusBadRequest, "don't send a negative nonce", nil
 	}
 
 	// get the bytes of the submitted transaction for verifying
 	submittedBytes, err := json.Marshal(transactionSub.Submitted)
 	if err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the transaction for verification", "error":"%s"}`, err.Error())))
-		return
+		return http.StatusBadRequest, "could not marshal json of the transaction for verification", err
 	}
 
 	// get the signed body as bytes for verifying
 	signedBodyBytes, err := autograph.SignedBodyToBytes(transactionSub.BodySigned)
 	if err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not scan the signedBody into bytes for verification", "error":"%s"}`, err.Error())))
-		return
+		return http.StatusBadRequest, "could not scan the signedBody into bytes for verification", err
 	}
 
 	pubKey := autograph.BytesToPublicKey([]byte(transactionSub.Submitted.From))
@@ -96,23 +228,160 @@ func (r *transactionRunner) Transaction(resp http.ResponseWriter, req *http.Requ
 	// verify
 	err = autograph.Verify(submittedBytes, signedBodyBytes, pubKey)
 	if err != nil {
-		resp.WriteHeader(http.StatusUnauthorized)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not verify the transaction with the public key", "error":"%s"}`, err.Error())))
-		return
+		return http.StatusUnauthorized, "could not verify the transaction with the public key", err
+	}
+
+	err = r.engine.ValidateTransaction(transactionSub)
+	if err != nil {
+		return http.StatusUnauthorized, "the transaction is not allowed by the consensus engine", err
+	}
+
+	// a replaced or cancelled transaction can't be sent again once a transaction with its nonce or a higher one is written
+	writtenNonce := r.accountState.GetWrittenUserNonce(transactionSub.Submitted.From)
+	if transactionSub.Submitted.Nonce != 0 && transactionSub.Submitted.Nonce <= writtenNonce {
+		return http.StatusConflict, fmt.Sprintf("the nonce has to be above %d, the nonce of the sender in the written blocks", writtenNonce), nil
 	}
 
 	// add the timestamp and transaction ID
 	transactionSub.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
 	transactionBytes, err := json.Marshal(transactionSub)
+	if err != nil {
+		return http.StatusBadRequest, "could not marshal the transaction with the timestamp to create the transaction ID", err
+	}
+	transactionSub.ID = fmt.Sprintf("%x", sha256.Sum256(transactionBytes))
+
+	return http.StatusOK, "", nil
+}
+
+// messageJSON formats the message and error the same way as the rest of the handler responses
+func messageJSON(message string, err error) []byte {
+	if err == nil {
+		return []byte(fmt.Sprintf(`{"message":"%s"}`, message))
+	}
+	return []byte(fmt.Sprintf(`{"message":"%s", "error":"%s"}`, message, err.Error()))
+}
+
+/*
+example request:
+
+curl --request POST \
+  --url http://127.0.0.1:8080/transaction/cancel \
+  --header 'content-type: application/json' \
+  --data '{
+	"bodySigned": "8a48a...",
+	"cancel": {
+		"from": "-----BEGIN RSA PUBLIC KEY-----\nMIGf...\n-----END RSA PUBLIC KEY-----",
+		"nonce": 1
+	}
+}'
+
+response:
+
+{
+  "cancellation": "success",
+  "transaction_id": "aa7d6..."
+}
+*/
+
+// Cancel is the handler for cancelling a pending transaction. Cancel will verify the signature of the from-user on the cancel message
+// and evict their pending transaction with the same nonce, as long as the node has not started mining a block with it.
+func (r *transactionRunner) Cancel(resp http.ResponseWriter, req *http.Request) {
+	reqBodyBytes, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		resp.WriteHeader(http.StatusBadRequest)
-		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal the transaction with the timestamp to create the transaction ID", "error":"%s"}`, err.Error())))
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not read request body", "error":"%s"}`, err.Error())))
 		return
 	}
-	transactionSub.ID = fmt.Sprintf("%x", sha256.Sum256(transactionBytes))
 
-	r.TranChan <- transactionSub
+	cancelSub := &dto.CancelSubmission{}
+	err = json.Unmarshal(reqBodyBytes, cancelSub)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not unmarshal json of request body", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	if cancelSub.Submitted == nil || cancelSub.Submitted.Nonce == 0 {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`{"message":"only transactions with a nonce can be cancelled"}`))
+		return
+	}
+
+	// get the bytes of the submitted cancel for verifying
+	submittedBytes, err := json.Marshal(cancelSub.Submitted)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not marshal json of the cancel for verification", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	signedBodyBytes, err := autograph.SignedBodyToBytes(cancelSub.BodySigned)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not scan the signedBody into bytes for verification", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	pubKey := autograph.BytesToPublicKey([]byte(cancelSub.Submitted.From))
+
+	err = autograph.Verify(submittedBytes, signedBodyBytes, pubKey)
+	if err != nil {
+		resp.WriteHeader(http.StatusUnauthorized)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not verify the cancel with the public key", "error":"%s"}`, err.Error())))
+		return
+	}
+
+	cancelledID, err := r.pendingPool.Cancel(cancelSub.Submitted.From, cancelSub.Submitted.Nonce)
+	if err != nil {
+		resp.WriteHeader(http.StatusConflict)
+		resp.Write([]byte(fmt.Sprintf(`{"message":"could not cancel the pending transaction", "error":"%s"}`, err.Error())))
+		return
+	}
 
 	resp.WriteHeader(http.StatusOK)
-	resp.Write([]byte(fmt.Sprintf(`{"submission":"success", "transaction_id":"%s"}`, transactionSub.ID)))
+	resp.Write([]byte(fmt.Sprintf(`{"cancellation":"success", "transaction_id":"%s"}`, cancelledID)))
+}
+
+// Status is the handler for looking up the status of a transaction.
+// Status reports pending, mining, replaced or cancelled from the pending pool,
+// written or dropped from the written-to-file blocks, and dropped from the dropped journal.
+// A transaction in a block this node has pruned is still reported as written.
+func (r *transactionRunner) Status(resp http.ResponseWriter, req *http.Request) {
+	transactionID := mux.Vars(req)["transaction_id"]
+	if len(transactionID) != 64 {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`{"message":"transaction ID is not 64 characters"}`))
+		return
+	}
+
+	status, found := r.pendingPool.GetStatus(transactionID)
+	if !found {
+		fileName, transactionIndex, err := r.searchIndex.GetTransactionPathByID(transactionID)
+		if _, dropped := r.droppedJournal.Get(transactionID); err != nil && dropped {
+			// a transaction that was dropped and submitted again can be written after all, so the written blocks are looked at first
+			resp.WriteHeader(http.StatusOK)
+			resp.Write([]byte(fmt.Sprintf(`{"transaction_id":"%s", "status":"%s"}`, transactionID, dto.StatusDropped)))
+			return
+		}
+		if err != nil {
+			resp.WriteHeader(http.StatusNotFound)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"transaction ID is not pending, written or dropped", "error":"%s"}`, err.Error())))
+			return
+		}
+
+		transactions, err := r.searchIndex.GetTransactionsFromSingleFile(fileName, []int{transactionIndex})
+		if err != nil {
+			resp.WriteHeader(http.StatusInternalServerError)
+			resp.Write([]byte(fmt.Sprintf(`{"message":"error finding transaction", "error":"%s"}`, err.Error())))
+			return
+		}
+
+		status = dto.StatusWritten
+		if transactions[0].TransactionStatus == dto.StatusDropped {
+			status = dto.StatusDropped
+		}
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(fmt.Sprintf(`{"transaction_id":"%s", "status":"%s"}`, transactionID, status)))
 }
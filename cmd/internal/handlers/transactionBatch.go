@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/pendingpool"
+)
+
+// maxBatchTransactions keeps a single batch request from tying up the node verifying signatures
+const maxBatchTransactions = 5000
+
+type batchTransactionResult struct {
+	Index                 int    `json:"index"`
+	TransactionID         string `json:"transaction_id,omitempty"`
+	ReplacedTransactionID string `json:"replaced_transaction_id,omitempty"`
+	Message               string `json:"message,omitempty"`
+	Error                 string `json:"error,omitempty"`
+}
+
+/*
+example request:
+
+curl --request POST \
+  --url 'http://127.0.0.1:8080/transactions/batch?atomic=true' \
+  --header 'content-type: application/json' \
+  --data '[
+	{
+		"bodySigned": "8a48a...",
+		"submit": {...}
+	},
+	{
+		"bodySigned": "a0817...",
+		"submit": {...}
+	}
+]'
+
+response:
+
+{
+  "submission": "success",
+  "results": [
+    {"index": 0, "transaction_id": "aa7d6..."},
+    {"index": 1, "transaction_id": "febdf..."}
+  ]
+}
+*/
+
+// Batch is the handler for intaking many transaction payloads at once. Batch verifies the transactions in parallel
+// the same way as the Transaction handler and responds with the transaction ID or error for each one.
+// With ?atomic=true none of the transactions are added unless every one of them can be added.
+func (r *transactionRunner) Batch(resp http.ResponseWriter, req *http.Request) {
+	reqBodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write(messageJSON("could not read request body", err))
+		return
+	}
+
+	transactions := make([]*dto.TransactionSubmission, 0)
+	err = json.Unmarshal(reqBodyBytes, &transactions)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write(messageJSON("could not unmarshal json of request body", err))
+		return
+	}
+
+	if len(transactions) == 0 {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write(messageJSON("the batch is empty", nil))
+		return
+	}
+
+	if len(transactions) > maxBatchTransactions {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		resp.Write(messageJSON(fmt.Sprintf("send at most %d transactions per batch", maxBatchTransactions), nil))
+		return
+	}
+
+	atomic := req.URL.Query().Get("atomic") == "true"
+
+	results := r.verifyBatch(req.Context(), transactions)
+
+	// the client may have given up while we were verifying the signatures
+	if req.Context().Err() != nil {
+		return
+	}
+
+	// only the verified transactions go on to the pending pool
+	verified := make([]*dto.TransactionSubmission, 0, len(transactions))
+	verifiedIndexes := make([]int, 0, len(transactions))
+	for i, result := range results {
+		if result.Message != "" {
+			continue
+		}
+		verified = append(verified, transactions[i])
+		verifiedIndexes = append(verifiedIndexes, i)
+	}
+
+	if atomic && len(verified) != len(transactions) {
+		for _, i := range verifiedIndexes {
+			results[i].TransactionID = ""
+			results[i].Message = "could not add the transaction"
+			results[i].Error = pendingpool.ErrAtomicBatchFailed.Error()
+		}
+		r.writeBatchResponse(resp, http.StatusBadRequest, "failed", results)
+		return
+	}
+
+	r.admitMx.Lock()
+	free := r.freeSlots()
+	if free == 0 || (atomic && free < len(verified)) {
+		r.admitMx.Unlock()
+		r.writeSaturated(resp)
+		return
+	}
+
+	// without atomic, admit as many as there is room for and turn the rest away
+	if free < len(verified) {
+		for _, i := range verifiedIndexes[free:] {
+			results[i].TransactionID = ""
+			results[i].Message = "the pending pool is full, retry later"
+		}
+		verified = verified[:free]
+		verifiedIndexes = verifiedIndexes[:free]
+	}
+
+	replacedIDs, errs := r.pendingPool.AddBatch(verified, atomic)
+	admitted := 0
+	for i, transactionSub := range verified {
+		result := results[verifiedIndexes[i]]
+		if errs[i] != nil {
+			result.TransactionID = ""
+			result.Message = "could not add the transaction"
+			result.Error = errs[i].Error()
+			continue
+		}
+		result.ReplacedTransactionID = replacedIDs[i]
+		admitted++
+
+		r.TranChan <- transactionSub
+	}
+	r.admitMx.Unlock()
+
+	if admitted == 0 {
+		r.writeBatchResponse(resp, http.StatusConflict, "failed", results)
+		return
+	}
+
+	submission := "success"
+	if admitted != len(transactions) {
+		submission = "partial"
+	}
+	r.writeBatchResponse(resp, http.StatusOK, submission, results)
+}
+
+// verifyBatch verifies and stamps every transaction using as many goroutines as there are CPUs.
+// verifyBatch stops verifying when the request context is cancelled.
+func (r *transactionRunner) verifyBatch(ctx context.Context, transactions []*dto.TransactionSubmission) []*batchTransactionResult {
+	results := make([]*batchTransactionResult, len(transactions))
+	indexChan := make(chan int, len(transactions))
+	for i := range transactions {
+		indexChan <- i
+	}
+	close(indexChan)
+
+	wg := &sync.WaitGroup{}
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexChan {
+				result := &batchTransactionResult{Index: i}
+				if ctx.Err() != nil {
+					result.Message = "request cancelled"
+					results[i] = result
+					continue
+				}
+				statusCode, message, err := r.verifyAndStampTransaction(transactions[i])
+				if statusCode != http.StatusOK {
+					result.Message = message
+					if err != nil {
+						result.Error = err.Error()
+					}
+				} else {
+					result.TransactionID = transactions[i].ID
+				}
+				results[i] = result
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (r *transactionRunner) writeBatchResponse(resp http.ResponseWriter, statusCode int, submission string, results []*batchTransactionResult) {
+	respBytes, err := json.Marshal(map[string]interface{}{
+		"submission": submission,
+		"results":    results,
+	})
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write(messageJSON("could not marshal json of the batch results", err))
+		return
+	}
+
+	resp.WriteHeader(statusCode)
+	resp.Write(respBytes)
+}
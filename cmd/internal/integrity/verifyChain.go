@@ -0,0 +1,542 @@
+package integrity
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// orphanedFolder is the folder the file block store moves the files of rolled back blocks to
+const orphanedFolder = "orphaned"
+
+// Report is what VerifyChain found in the block files, as json for CI to read
+type Report struct {
+	Path string `json:"path"`
+	OK   bool   `json:"ok"`
+	// Height is the number of blocks on the chain, from the first block to the last block that links to it
+	Height   int64  `json:"height"`
+	TipHash  string `json:"tipHash"`
+	Verified int64  `json:"verified"`
+	// DroppedBlocks is the number of dropped blocks from before the dropped journal that the node hasn't moved to the journal yet
+	DroppedBlocks int `json:"droppedBlocks"`
+	// PrunedBlocks is the number of blocks on the chain that a pruning node cut the transaction bodies out of, which are checked without their transactions
+	PrunedBlocks int `json:"prunedBlocks"`
+	// UnsignedBlocks is the number of blocks on the chain written before the node signatures were kept with the blocks, which are checked without them
+	UnsignedBlocks int `json:"unsignedBlocks"`
+	// FirstBadBlock is the first block on the chain that fails a check. The blocks after it are linked up but not checked.
+	FirstBadBlock           *BadBlock               `json:"firstBadBlock,omitempty"`
+	Gaps                    []*Gap                  `json:"gaps"`
+	DuplicateTransactionIDs []*DuplicateTransaction `json:"duplicateTransactionIDs"`
+	OrphanFiles             []*OrphanFile           `json:"orphanFiles"`
+}
+
+// BadBlock is a block on the chain that fails a check, and why
+type BadBlock struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// Gap is a block whose previous block isn't in the block files, so the blocks in between are missing
+type Gap struct {
+	File          string `json:"file"`
+	Hash          string `json:"hash"`
+	PrevBlockHash string `json:"prevBlockHash"`
+}
+
+// DuplicateTransaction is a transaction ID that is in more than one place on the chain
+type DuplicateTransaction struct {
+	ID      string  `json:"id"`
+	Heights []int64 `json:"heights"`
+}
+
+// OrphanFile is a file in the block chain output path that isn't part of the chain, and why
+type OrphanFile struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// blockFile is a block read from a block file, with the height and block hash from the file name.
+// A file named the old way has the hash of the block json and the number of blocks written in its name instead.
+type blockFile struct {
+	file     string
+	legacy   bool
+	height   int64
+	fileHash string
+	written  int
+	contents []byte
+	block    *dto.BlockRequest
+}
+
+// checkName returns an error if the file name doesn't match the block in it at the height on the chain
+func (f *blockFile) checkName(height int64) error {
+	if f.legacy {
+		if fmt.Sprintf("%x", sha256.Sum256(f.contents)) != f.fileHash {
+			return fmt.Errorf("the block file was changed after it was written, its contents don't match the hash in the file name")
+		}
+		return nil
+	}
+	if f.height != height || f.fileHash != f.block.ProofOfWorkHash {
+		return fmt.Errorf("the block file name doesn't match the height %d and hash of the block in it", height)
+	}
+	return nil
+}
+
+// VerifyChain reads the block files written by the file block store in blockChainOutputPath without changing them,
+// orders the blocks by their previous block hash from the first block, and checks every block on the chain the way a node checks a block it is sent.
+// The engine has to be new, it is replayed from the first block so each block is checked against the consensus state before it.
+// The node signatures written with a block have to be enough for the engine to finalize it, like the share of the validators for proof of authority
+// or of the stake for proof of stake. Blocks written before the signatures were kept are counted in the report and checked without them.
+func VerifyChain(blockChainOutputPath string, engine consensus.Engine) (*Report, error) {
+	report := &Report{
+		Path:                    blockChainOutputPath,
+		Gaps:                    make([]*Gap, 0),
+		DuplicateTransactionIDs: make([]*DuplicateTransaction, 0),
+		OrphanFiles:             make([]*OrphanFile, 0),
+	}
+
+	_, err := os.Stat(blockChainOutputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	blockFiles, err := readBlockFiles(blockChainOutputPath, report)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := orderChain(blockFiles, report)
+	report.Height = int64(len(chain))
+	if len(chain) > 0 {
+		report.TipHash = chain[len(chain)-1].block.ProofOfWorkHash
+	}
+
+	checker := NewChainChecker(engine)
+	transactionHeights := make(map[string][]int64)
+	transactionOrder := make([]string, 0)
+	for i, blockFile := range chain {
+		height := int64(i + 1)
+		for _, transactionSub := range blockFile.block.Transactions {
+			if _, found := transactionHeights[transactionSub.ID]; !found {
+				transactionOrder = append(transactionOrder, transactionSub.ID)
+			}
+			transactionHeights[transactionSub.ID] = append(transactionHeights[transactionSub.ID], height)
+		}
+
+		if blockFile.block.Pruned {
+			report.PrunedBlocks++
+		}
+		if len(blockFile.block.NodeSignatures) == 0 {
+			report.UnsignedBlocks++
+		}
+
+		if report.FirstBadBlock != nil {
+			continue
+		}
+		err = blockFile.checkName(height)
+		if err == nil {
+			err = checker.CheckBlock(blockFile.block)
+		}
+		if err != nil {
+			report.FirstBadBlock = &BadBlock{
+				Height: height,
+				Hash:   blockFile.block.ProofOfWorkHash,
+				File:   blockFile.file,
+				Reason: err.Error(),
+			}
+			continue
+		}
+		report.Verified = height
+	}
+
+	for _, transactionID := range transactionOrder {
+		if len(transactionHeights[transactionID]) > 1 {
+			report.DuplicateTransactionIDs = append(report.DuplicateTransactionIDs, &DuplicateTransaction{
+				ID:      transactionID,
+				Heights: transactionHeights[transactionID],
+			})
+		}
+	}
+
+	report.OK = report.FirstBadBlock == nil && len(report.Gaps) == 0 && len(report.DuplicateTransactionIDs) == 0 && len(report.OrphanFiles) == 0
+	return report, nil
+}
+
+// readBlockFiles reads every block file in the block chain output path in height order, and the files named the old way after them in the order they were written.
+// The dropped blocks are counted, and the files that can't be read as blocks and the files of rolled back blocks are added to the report as orphan files.
+func readBlockFiles(blockChainOutputPath string, report *Report) ([]*blockFile, error) {
+	fileNames, err := filepath.Glob(filepath.Join(blockChainOutputPath, "*"))
+	if err != nil {
+		return nil, err
+	}
+	orphanedFileNames, err := filepath.Glob(filepath.Join(blockChainOutputPath, orphanedFolder, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range orphanedFileNames {
+		report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{File: fileName, Reason: "the block was rolled back by a reorg"})
+	}
+
+	blockFiles := make([]*blockFile, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			// the orphaned folder is reported above, the state folder has the account state snapshots and the pruned folder has the gzip archives of pruned blocks
+			continue
+		}
+		if !strings.HasSuffix(fileName, ".json") {
+			report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{File: fileName, Reason: "not a block file, like a temp file or write ahead record left by a node that stopped part way"})
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(fileName), ".json")
+		separator := strings.LastIndex(name, "_")
+		if strings.HasPrefix(name, "dropped_") {
+			report.DroppedBlocks++
+			continue
+		}
+		blockFile := &blockFile{file: fileName}
+		if separator == 12 {
+			blockFile.height, err = strconv.ParseInt(name[:separator], 10, 64)
+		} else {
+			blockFile.legacy = true
+			blockFile.written, err = strconv.Atoi(name[separator+1:])
+		}
+		if separator < 0 || err != nil {
+			report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{File: fileName, Reason: "the block file is not named <height>_<block hash>, dropped_<hash> or <hash>_<number written>"})
+			continue
+		}
+		blockFile.fileHash = name[separator+1:]
+		if blockFile.legacy {
+			blockFile.fileHash = name[:separator]
+		}
+
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		block := &dto.BlockRequest{}
+		err = dto.UnmarshalBlock(contents, block)
+		if err == nil && block.Header == nil {
+			err = fmt.Errorf("the block has no header")
+		}
+		if err != nil {
+			report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{File: fileName, Reason: fmt.Sprintf("could not read the block: %s", err.Error())})
+			continue
+		}
+
+		if block.ProofOfWorkHash == dto.StatusDropped {
+			report.DroppedBlocks++
+			continue
+		}
+
+		blockFile.contents = contents
+		blockFile.block = block
+		blockFiles = append(blockFiles, blockFile)
+	}
+
+	sort.Slice(blockFiles, func(i, j int) bool {
+		if blockFiles[i].legacy != blockFiles[j].legacy {
+			return !blockFiles[i].legacy
+		}
+		if blockFiles[i].legacy {
+			return blockFiles[i].written < blockFiles[j].written
+		}
+		return blockFiles[i].height < blockFiles[j].height
+	})
+	return blockFiles, nil
+}
+
+// orderChain follows the previous block hashes from the first block to put the blocks in chain order.
+// When more than one block builds on the same block, the one that sorts first is followed and the others are orphan files.
+// The blocks whose previous block isn't in the block files are gaps, and the blocks that build on a gap are orphan files.
+func orderChain(blockFiles []*blockFile, report *Report) []*blockFile {
+	children := make(map[string][]*blockFile)
+	hashes := make(map[string]bool)
+	for _, blockFile := range blockFiles {
+		children[blockFile.block.Header.PrevBlockHash] = append(children[blockFile.block.Header.PrevBlockHash], blockFile)
+		hashes[blockFile.block.ProofOfWorkHash] = true
+	}
+
+	chain := make([]*blockFile, 0, len(blockFiles))
+	onChain := make(map[*blockFile]bool)
+	prevBlockHash := ""
+	for {
+		next := children[prevBlockHash]
+		if len(next) == 0 {
+			break
+		}
+		for _, sibling := range next[1:] {
+			report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{
+				File:   sibling.file,
+				Reason: fmt.Sprintf("forks off the chain at height %d, the block that sorts first is on the chain", len(chain)+1),
+			})
+			onChain[sibling] = true
+		}
+		chain = append(chain, next[0])
+		onChain[next[0]] = true
+		prevBlockHash = next[0].block.ProofOfWorkHash
+	}
+
+	for _, blockFile := range blockFiles {
+		if onChain[blockFile] {
+			continue
+		}
+		if !hashes[blockFile.block.Header.PrevBlockHash] {
+			report.Gaps = append(report.Gaps, &Gap{
+				File:          blockFile.file,
+				Hash:          blockFile.block.ProofOfWorkHash,
+				PrevBlockHash: blockFile.block.Header.PrevBlockHash,
+			})
+			continue
+		}
+		report.OrphanFiles = append(report.OrphanFiles, &OrphanFile{File: blockFile.file, Reason: "is not on the chain that links back to the first block"})
+	}
+
+	return chain
+}
+
+// ChainChecker checks the blocks of a chain in order from the first block, the way a node checks a block it is sent,
+// keeping the balances and stakes of the blocks before the one being checked
+type ChainChecker struct {
+	engine   consensus.Engine
+	height   int64
+	tipHash  string
+	balances map[string]dto.Coin
+	// balancesPruned is set once a pruned block has been checked, the balances after it aren't known so they aren't checked
+	balancesPruned bool
+	// stakes are the coin staked by a user with a validator, by "<user>|<validator>"
+	stakes map[string]dto.Coin
+	// signed is set once a block with node signatures has been checked, the blocks after it need node signatures too
+	signed bool
+}
+
+// NewChainChecker returns a ChainChecker for checking a chain from the first block. The engine has to be new,
+// it is replayed block by block so each block is checked against the consensus state before it.
+func NewChainChecker(engine consensus.Engine) *ChainChecker {
+	return &ChainChecker{
+		engine:   engine,
+		balances: make(map[string]dto.Coin),
+		stakes:   make(map[string]dto.Coin),
+	}
+}
+
+// CheckBlock checks the block builds on the last block checked and is valid against the blocks before it,
+// and adds it to the balances, stakes and consensus engine if it passes.
+// Only the header, the seal and the transactions kept whole of a pruned block are checked, and the balances aren't checked from then on.
+func (c *ChainChecker) CheckBlock(block *dto.BlockRequest) error {
+	if block.Header == nil {
+		return fmt.Errorf("the block has no header")
+	}
+	if block.Header.PrevBlockHash != c.tipHash {
+		return fmt.Errorf("the previous block hash %q is not the hash of the block before it %q", block.Header.PrevBlockHash, c.tipHash)
+	}
+	// blocks written before the header had a height have height 0
+	if block.Header.Height != 0 && block.Header.Height != c.height+1 {
+		return fmt.Errorf("the block header height %d is not one more than the height %d of the block before it", block.Header.Height, c.height)
+	}
+
+	// the seal is checked against the engine replayed up to the block before it, without the clock since a written block is long past its slot.
+	// that is the difficulty for proof of work, the validator with the turn for proof of authority and the slot leader for proof of stake
+	err := c.engine.ValidateReplayedSeal(block)
+	if err != nil {
+		return fmt.Errorf("invalid block seal: %s", err.Error())
+	}
+
+	err = c.checkNodeSignatures(block)
+	if err != nil {
+		return err
+	}
+
+	if block.Pruned {
+		c.balancesPruned = true
+	} else {
+		transactionsBytes, err := json.Marshal(block.Transactions)
+		if err != nil {
+			return fmt.Errorf("could not marshal json of the transactions to verify the transactions hash: %s", err.Error())
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(transactionsBytes)) != block.Header.TransactionsHash {
+			return fmt.Errorf("the transactions don't match the transactions hash in the block header")
+		}
+	}
+
+	// the changes are copies until every transaction of the block has been checked
+	balances := make(map[string]dto.Coin)
+	balance := func(userID string) dto.Coin {
+		if changedBalance, found := balances[userID]; found {
+			return changedBalance
+		}
+		return c.balances[userID]
+	}
+	stakes := make(map[string]dto.Coin)
+	stake := func(key string) dto.Coin {
+		if changedStake, found := stakes[key]; found {
+			return changedStake
+		}
+		return c.stakes[key]
+	}
+
+	for _, transactionSub := range block.Transactions {
+		if block.Pruned && transactionSub.TransactionStatus == dto.StatusPruned {
+			continue
+		}
+		if transactionSub.Submitted == nil {
+			return fmt.Errorf("transaction %s has nothing submitted", transactionSub.ID)
+		}
+
+		submittedBytes, err := json.Marshal(transactionSub.Submitted)
+		if err != nil {
+			return fmt.Errorf("could not marshal json of transaction %s for verification: %s", transactionSub.ID, err.Error())
+		}
+		signedBodyBytes, err := autograph.SignedBodyToBytes(transactionSub.BodySigned)
+		if err != nil {
+			return fmt.Errorf("could not scan the signedBody of transaction %s into bytes for verification: %s", transactionSub.ID, err.Error())
+		}
+		pubKey := autograph.BytesToPublicKey([]byte(transactionSub.Submitted.From))
+		if pubKey == nil {
+			return fmt.Errorf("the from-user of transaction %s is not a Public RSA PEM string", transactionSub.ID)
+		}
+		err = autograph.Verify(submittedBytes, signedBodyBytes, pubKey)
+		if err != nil {
+			return fmt.Errorf("could not verify transaction %s with the public key: %s", transactionSub.ID, err.Error())
+		}
+
+		if transactionSub.TransactionStatus == dto.StatusDropped {
+			// dropped transactions don't move any coin
+			continue
+		}
+
+		if transactionSub.Submitted.CoinAmount < 0 {
+			return fmt.Errorf("transaction %s has negative coin", transactionSub.ID)
+		}
+		if transactionSub.Submitted.Fee < 0 {
+			return fmt.Errorf("transaction %s has negative fee", transactionSub.ID)
+		}
+		err = transactionSub.Submitted.ValidateType()
+		if err != nil {
+			return fmt.Errorf("transaction %s has an invalid type: %s", transactionSub.ID, err.Error())
+		}
+		err = c.engine.ValidateTransaction(transactionSub)
+		if err != nil {
+			return fmt.Errorf("transaction %s is not allowed by the consensus engine: %s", transactionSub.ID, err.Error())
+		}
+
+		// the fee is lost by the sender along with the coin amount
+		spend, err := transactionSub.Submitted.Spend()
+		if err != nil {
+			return fmt.Errorf("transaction %s coin amount plus fee overflows", transactionSub.ID)
+		}
+		newSenderBalance, err := balance(transactionSub.Submitted.From).Sub(spend)
+		if err != nil || (newSenderBalance < 0 && !c.balancesPruned) {
+			return fmt.Errorf("transaction %s spends more coin than is in the from-user balance", transactionSub.ID)
+		}
+		balances[transactionSub.Submitted.From] = newSenderBalance
+
+		// the receiver might be the sender, so the receiver balance is read after the sender balance is changed
+		newReceiverBalance, err := balance(transactionSub.Submitted.To).Add(transactionSub.Submitted.Credit())
+		if err != nil {
+			return fmt.Errorf("transaction %s overflows the to-user balance", transactionSub.ID)
+		}
+		balances[transactionSub.Submitted.To] = newReceiverBalance
+
+		// can't unstake more than was staked with the validator
+		key := transactionSub.Submitted.From + "|" + transactionSub.Submitted.To
+		switch transactionSub.Submitted.Type {
+		case dto.TransactionTypeStake:
+			stakes[key], err = stake(key).Add(transactionSub.Submitted.CoinAmount)
+		case dto.TransactionTypeUnstake:
+			stakes[key], err = stake(key).Sub(transactionSub.Submitted.CoinAmount)
+			if err == nil && stakes[key] < 0 {
+				err = fmt.Errorf("can't unstake more coin than is staked with the validator")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("transaction %s has an invalid stake change: %s", transactionSub.ID, err.Error())
+		}
+	}
+
+	for userID, changedBalance := range balances {
+		c.balances[userID] = changedBalance
+	}
+	for key, changedStake := range stakes {
+		c.stakes[key] = changedStake
+	}
+	c.engine.BlockWritten(block)
+	c.height++
+	c.tipHash = block.ProofOfWorkHash
+	if len(block.NodeSignatures) > 0 {
+		c.signed = true
+	}
+	return nil
+}
+
+// checkNodeSignatures checks the node signatures written with the block start with the origin node,
+// and that the valid ones are enough for the engine replayed up to the block before it to finalize the block.
+// The signatures of a pruned block are checked against the hash of the json they sign that was kept when it was pruned.
+// A block without node signatures was written before they were kept, which is only allowed before the first block that has them.
+func (c *ChainChecker) checkNodeSignatures(block *dto.BlockRequest) error {
+	if len(block.NodeSignatures) == 0 {
+		if c.signed {
+			return fmt.Errorf("the block has no node signatures, but the blocks before it do")
+		}
+		return nil
+	}
+
+	// the json the node signatures sign was cut down when the block was pruned, so a pruned block keeps its hash
+	var hashed []byte
+	if block.Pruned {
+		_, err := fmt.Sscanf(block.SignedBlockHash, "%x", &hashed)
+		if err != nil || len(hashed) != sha256.Size {
+			return fmt.Errorf("the pruned block doesn't have the hash of the json its node signatures sign")
+		}
+	} else {
+		signedBlockBytes, err := dto.SignedBlockBytes(block)
+		if err != nil {
+			return fmt.Errorf("could not marshal json of the block to verify the node signatures: %s", err.Error())
+		}
+		signedBlockHash := sha256.Sum256(signedBlockBytes)
+		hashed = signedBlockHash[:]
+	}
+
+	signerPublicKeys := make([]string, 0, len(block.NodeSignatures))
+	signers := make(map[string]bool)
+	for i, nodeSig := range block.NodeSignatures {
+		publicKey := autograph.BytesToPublicKey([]byte(nodeSig.PublicKey))
+		signature, err := autograph.SignedBodyToBytes(nodeSig.SignedBlockRequest)
+		if err == nil && publicKey == nil {
+			err = fmt.Errorf("not a Public RSA PEM string")
+		}
+		if err == nil {
+			err = autograph.VerifyHashed(hashed, signature, publicKey)
+		}
+		if i == 0 && (err != nil || nodeSig.PublicKey != block.OriginNodePublicKey) {
+			return fmt.Errorf("the first node signature is not a valid signature from the origin node")
+		}
+		// the signatures from the other nodes weren't checked by the origin node before it wrote them, so the invalid ones just don't count
+		if err != nil || signers[nodeSig.PublicKey] {
+			continue
+		}
+		signers[nodeSig.PublicKey] = true
+		signerPublicKeys = append(signerPublicKeys, nodeSig.PublicKey)
+	}
+
+	// the number of nodes the block was sent to isn't known, the same as when a node accepts a block
+	if !c.engine.IsFinal(block, signerPublicKeys, 0) {
+		return fmt.Errorf("the %d valid node signatures are not enough for the consensus engine to finalize the block", len(signerPublicKeys))
+	}
+	return nil
+}
@@ -3,41 +3,76 @@ package mining
 import (
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/rand"
-	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/blocktree"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/droppedjournal"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/pendingpool"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
 )
 
-// PreviousBlockHashRunner is the struct that governs the claims on the previous hash with a mutex lock
+// PreviousBlockHashRunner is the struct that governs the claims on the previous hash with a mutex lock.
+// When competing claims arrive within tieWindow of the first claim, the claim with the lowest block hash wins,
+// so every node ends up holding the same claim instead of each one holding the first claim it happened to see.
+// A claim from a sign request is a lease that expires after leaseTTL, see claimLease.go.
+// Once the block that holds the claim is accepted, the claim is locked and no other claim takes over, even within the tie window.
 type PreviousBlockHashRunner struct {
 	mx             *sync.Mutex
 	prevHashString string
 	claimed        bool
 	claimedBy      string
 	blockIDHash    string
+	claimedAt      time.Time
+	tieWindow      time.Duration
+	tipChanged     chan struct{}
+	leaseTTL       time.Duration
+	// leaseExpiresAt is zero when the claim isn't a lease
+	leaseExpiresAt time.Time
+	leaseTimer     leaseTimer
+	// accepted is set once the block that holds the claim is accepted, see AcceptClaim
+	accepted bool
+	// now and afterFunc are the clock, swapped out by the tests
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func()) leaseTimer
 }
 
-// NewPrevBlockHashRunner returns an empty instance of the PreviousBlockHashRunner struct.
-func NewPrevBlockHashRunner() *PreviousBlockHashRunner {
+// NewPrevBlockHashRunner returns an empty instance of the PreviousBlockHashRunner struct
+// where a better claim can take over a claim for tieWindowSeconds after it was made,
+// and a claim from a sign request is released after leaseSeconds.
+func NewPrevBlockHashRunner(tieWindowSeconds, leaseSeconds int64) *PreviousBlockHashRunner {
 	return &PreviousBlockHashRunner{
 		mx:             &sync.Mutex{},
 		prevHashString: "",
 		claimed:        false,
 		claimedBy:      "",
 		blockIDHash:    "",
+		tieWindow:      time.Duration(tieWindowSeconds) * time.Second,
+		tipChanged:     make(chan struct{}),
+		leaseTTL:       time.Duration(leaseSeconds) * time.Second,
+		now:            time.Now,
+		afterFunc: func(d time.Duration, f func()) leaseTimer {
+			return time.AfterFunc(d, f)
+		},
+	}
+}
+
+// isBetterClaim returns if the candidate block hash beats the claimed block hash. The lowest hash wins.
+// The hashes are hex sha256 hashes of the same length, so comparing the strings compares the numbers.
+func isBetterClaim(candidateHash, claimedHash string) bool {
+	if len(candidateHash) != len(claimedHash) {
+		return len(candidateHash) < len(claimedHash)
 	}
+	return candidateHash < claimedHash
 }
 
 // GetPrevBlockHash will use the mutex lock to return the current previous block hash.
@@ -47,42 +82,80 @@ func (r *PreviousBlockHashRunner) GetPrevBlockHash() string {
 	return r.prevHashString
 }
 
+// GetPrevBlockHashAndTipChange returns the current previous block hash along with a channel
+// that will be closed the next time the previous block hash changes, so that mining on it can be cancelled.
+func (r *PreviousBlockHashRunner) GetPrevBlockHashAndTipChange() (string, <-chan struct{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.prevHashString, r.tipChanged
+}
+
 // don't export so that only the file writer can set
 func (r *PreviousBlockHashRunner) setPrevBlockHash(hash string) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 	r.prevHashString = hash
+
+	// a claim is on the old previous hash, so it means nothing on the new tip.
+	// this is how the claim of an accepted block is released once it is written,
+	// and it also clears a claim on a block that lost a reorg instead of waiting for it to time out
+	r.releaseClaim()
+
+	// wake up anything mining on the old tip
+	close(r.tipChanged)
+	r.tipChanged = make(chan struct{})
 }
 
 // GetPrevBlockHashClaimed returns if the previous hash is claimed, which node claimed, and with which block header hash they claimed
 func (r *PreviousBlockHashRunner) GetPrevBlockHashClaimed() (bool, string, string) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
+	r.releaseExpiredLease()
 	return r.claimed, r.claimedBy, r.blockIDHash
 }
 
+// HoldsClaim returns if the node and block header hash still hold the claim on the previous hash,
+// which is false after the claim was given up to a better candidate
+func (r *PreviousBlockHashRunner) HoldsClaim(publicKeyStr, proofOfWorkHash string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.releaseExpiredLease()
+	return r.claimed && publicKeyStr == r.claimedBy && proofOfWorkHash == r.blockIDHash
+}
+
 // setPrevBlockHashAsUnclaimed set the previous hash to claimed = false for node and block header hash that was claimed earlier
 func (r *PreviousBlockHashRunner) setPrevBlockHashAsUnclaimed(publicKeyStr, proofOfWorkHash string) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
 	if publicKeyStr != r.claimedBy || proofOfWorkHash != r.blockIDHash {
-		log.Fatalln("don't call setPrevBlockHashAsUnclaimed() with a block that didn't make the claim")
+		// the claim was given up to a better candidate, so it isn't ours to release anymore
 		return
 	}
 
-	r.claimed = false
-	r.claimedBy = ""
-	r.blockIDHash = ""
+	r.releaseClaim()
 }
 
-// SetPrevBlockHashAsClaimed set the previous hash To claimed, which node claimed, and with which block header hash they claimed
+// SetPrevBlockHashAsClaimed set the previous hash To claimed, which node claimed, and with which block header hash they claimed.
+// If the previous hash is already claimed, the new claim only takes over when it arrives within the tie window of the first claim,
+// has a lower block hash, and the block holding the claim wasn't accepted yet. The node holding the claim gives it up, even when the claim is this node's own.
 func (r *PreviousBlockHashRunner) SetPrevBlockHashAsClaimed(publicKeyStr, proofOfWorkHash, prevBlockHash string) error {
 	r.mx.Lock()
 	defer r.mx.Unlock()
+	return r.claim(publicKeyStr, proofOfWorkHash, prevBlockHash)
+}
+
+// claim is SetPrevBlockHashAsClaimed with the mutex locked
+func (r *PreviousBlockHashRunner) claim(publicKeyStr, proofOfWorkHash, prevBlockHash string) error {
+	r.releaseExpiredLease()
 
 	if r.claimed == true {
-		return fmt.Errorf("SetPrevBlockHashAsClaimed() failed because already claimed")
+		if r.accepted {
+			return fmt.Errorf("SetPrevBlockHashAsClaimed() failed because the claimed block was already accepted")
+		}
+		if r.now().Sub(r.claimedAt) > r.tieWindow || !isBetterClaim(proofOfWorkHash, r.blockIDHash) {
+			return fmt.Errorf("SetPrevBlockHashAsClaimed() failed because already claimed")
+		}
 	}
 	if publicKeyStr == "" {
 		return fmt.Errorf("SetPrevBlockHashAsClaimed() failed because publicKeyStr was empty")
@@ -93,86 +166,110 @@ func (r *PreviousBlockHashRunner) SetPrevBlockHashAsClaimed(publicKeyStr, proofO
 	if prevBlockHash != r.prevHashString {
 		return fmt.Errorf("SetPrevBlockHashAsClaimed() failed because prevBlockHash did not match")
 	}
+	if !r.claimed {
+		// a better claim keeps the window of the first claim so the window can't be stretched out
+		r.claimedAt = r.now()
+	}
+	// a better claim doesn't get the lease of the claim it took over
+	r.endLease()
 	r.claimed = true
 	r.claimedBy = publicKeyStr
 	r.blockIDHash = proofOfWorkHash
 	return nil
 }
 
-// SetPrevBlockHashAsClaimedFromSignRequest will claim the prevBlockHash for 120 seconds.
+// SetPrevBlockHashAsClaimedFromSignRequest will claim the prevBlockHash with a lease that is released after leaseTTL.
+// repeats is the number of sign requests already signed for the origin node on the previous hash, and the lease is halved for each of them, see repeatedLeaseTTL.
 // This prevents a node from holding on to the claim forever.
 // With no timeout the origin node could hold the claim forever by requesting a signature,
 // and then never submitting the block for acceptance.
-func (r *PreviousBlockHashRunner) SetPrevBlockHashAsClaimedFromSignRequest(publicKeyStr, proofOfWorkHash, prevBlockHash string) error {
-	err := r.SetPrevBlockHashAsClaimed(publicKeyStr, proofOfWorkHash, prevBlockHash)
+func (r *PreviousBlockHashRunner) SetPrevBlockHashAsClaimedFromSignRequest(publicKeyStr, proofOfWorkHash, prevBlockHash string, repeats int) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	err := r.claim(publicKeyStr, proofOfWorkHash, prevBlockHash)
 	if err != nil {
 		return err
 	}
 
-	// use a goroutine so that we don't sleep for 120 while handling the sign request endpoint
-	// we could perhaps call this whole function as a goroutine if we did not need to return the error
-	go r.setPrevBlockHashAsUnclaimedFromSignRequest(publicKeyStr, proofOfWorkHash)
-
+	r.startLease(publicKeyStr, proofOfWorkHash, r.repeatedLeaseTTL(repeats))
 	return nil
 }
 
-// setPrevBlockHashAsUnclaimedFromSignRequest runs as a goroutine
-// so that SetPrevBlockHashAsClaimedFromSignRequest() will not cause the /block-sign handler to sleep for 120 seconds
-func (r *PreviousBlockHashRunner) setPrevBlockHashAsUnclaimedFromSignRequest(publicKeyStr, proofOfWorkHash string) {
-	time.Sleep(120 * time.Second)
-
-	r.mx.Lock()
-	defer r.mx.Unlock()
+// MaxBlockRetries is how many times the block builder seals a batch again and asks for signatures before it hands the batch back to the pending pool
+const MaxBlockRetries = 10
 
-	if publicKeyStr != r.claimedBy || proofOfWorkHash != r.blockIDHash {
-		// setPrevBlockHashAsUnclaimedFromSignRequest doesn't need log.Fatalln()
-		// because the claim can be released when the block is accepted before 120 seconds is up
-		return
-	}
+// notProposerWait is how long the block builder waits for the next block before asking the engine again when it isn't our turn to propose
+const notProposerWait = 5 * time.Second
 
-	r.claimed = false
-	r.claimedBy = ""
-	r.blockIDHash = ""
-}
+// maxMissedTurns is how many times the block builder waits for its turn to propose before it hands the batch back to the pending pool,
+// so a batch isn't held as mining forever by a node that doesn't get the turn
+const maxMissedTurns = 12
 
 type blockBuilder struct {
-	timerChan            chan struct{}
-	resetTimerChan       chan struct{}
-	myLocalHostPort      string
-	transactionsWaiting  chan []*dto.TransactionSubmission
-	writeChan            chan *dto.BlockRequest
-	prevBlockHashRunner  *PreviousBlockHashRunner
-	searchIndex          *searchindexing.SearchIndexer
-	maxTransactions      int64
-	timeLimitInMinutes   int64
-	BlockChainOutputPath string
-	privateKey           *rsa.PrivateKey
-	publicKey            *rsa.PublicKey
+	timerChan           chan struct{}
+	resetTimerChan      chan struct{}
+	myLocalHostPort     string
+	transactionsWaiting chan []*dto.TransactionSubmission
+	requeueChan         chan []*dto.TransactionSubmission
+	writeChan           chan *dto.BlockRequest
+	prevBlockHashRunner *PreviousBlockHashRunner
+	engine              consensus.Engine
+	blockTree           *blocktree.BlockTree
+	blockStore          storage.BlockStore
+	searchIndex         *searchindexing.SearchIndexer
+	droppedJournal      *droppedjournal.DroppedJournal
+	accountState        *accountstate.AccountState
+	pendingPool         *pendingpool.PendingPool
+	maxTransactions     int64
+	timeLimitInMinutes  int64
+	transactionRetries  int64
+	transactionAttempts map[string]int64
+	privateKey          *rsa.PrivateKey
+	publicKey           *rsa.PublicKey
+	// pruner is the block store when the node prunes the transaction bodies of old blocks, or nil for an archival node
+	pruner         storage.Pruner
+	pruneGzip      bool
+	pruneRetention int64
 }
 
 // NewBlockBuilder returns a new instance of the blockBuilder struct with the given arguments.
 func NewBlockBuilder(
 	prevBlockHashRunner *PreviousBlockHashRunner,
+	engine consensus.Engine,
+	blockTree *blocktree.BlockTree,
+	blockStore storage.BlockStore,
 	searchIndex *searchindexing.SearchIndexer,
+	droppedJournal *droppedjournal.DroppedJournal,
+	accountState *accountstate.AccountState,
+	pendingPool *pendingpool.PendingPool,
 	writeChan chan *dto.BlockRequest,
 	maxTransactions,
-	timeLimit int64,
-	blockChainOutputPath string,
+	timeLimit,
+	transactionRetries int64,
 	privateKey *rsa.PrivateKey,
 	publicKey *rsa.PublicKey,
 ) *blockBuilder {
 	return &blockBuilder{
-		timerChan:            make(chan struct{}, 1),
-		resetTimerChan:       make(chan struct{}, 1),
-		transactionsWaiting:  make(chan []*dto.TransactionSubmission, 0),
-		writeChan:            writeChan,
-		prevBlockHashRunner:  prevBlockHashRunner,
-		searchIndex:          searchIndex,
-		maxTransactions:      maxTransactions,
-		timeLimitInMinutes:   timeLimit,
-		BlockChainOutputPath: blockChainOutputPath,
-		privateKey:           privateKey,
-		publicKey:            publicKey,
+		timerChan:           make(chan struct{}, 1),
+		resetTimerChan:      make(chan struct{}, 1),
+		transactionsWaiting: make(chan []*dto.TransactionSubmission, 0),
+		requeueChan:         make(chan []*dto.TransactionSubmission, 0),
+		writeChan:           writeChan,
+		prevBlockHashRunner: prevBlockHashRunner,
+		engine:              engine,
+		blockTree:           blockTree,
+		blockStore:          blockStore,
+		searchIndex:         searchIndex,
+		droppedJournal:      droppedJournal,
+		accountState:        accountState,
+		pendingPool:         pendingPool,
+		maxTransactions:     maxTransactions,
+		timeLimitInMinutes:  timeLimit,
+		transactionRetries:  transactionRetries,
+		transactionAttempts: make(map[string]int64),
+		privateKey:          privateKey,
+		publicKey:           publicKey,
 	}
 }
 
@@ -181,6 +278,30 @@ func (b *blockBuilder) SetMyLocalHostPort(portStr string) {
 	b.myLocalHostPort = portStr
 }
 
+// SetPruning sets the --prune mode and how many blocks back from the tip are kept whole. The block store has to be a storage.Pruner unless the mode is archival.
+func (b *blockBuilder) SetPruning(mode string, retention int64) error {
+	switch mode {
+	case storage.ArchivalMode:
+		b.pruner = nil
+		return nil
+	case storage.PruneDeleteMode, storage.PruneGzipMode:
+	default:
+		return fmt.Errorf("unknown prune mode %q", mode)
+	}
+
+	pruner, ok := b.blockStore.(storage.Pruner)
+	if !ok {
+		return fmt.Errorf("the block store can't prune blocks, use --block-store %s to prune", storage.FileBlockStoreName)
+	}
+	if retention < 1 {
+		return fmt.Errorf("--prune-retention has to keep at least 1 block whole")
+	}
+	b.pruner = pruner
+	b.pruneGzip = mode == storage.PruneGzipMode
+	b.pruneRetention = retention
+	return nil
+}
+
 // BlockTimer sends a signal on the timerChan when the TIME_LIMIT environment variable minutes have elapsed. The timer is reset every time we receive max transactions for a block.
 func (b *blockBuilder) BlockTimer() {
 	countDownTimer := b.timeLimitInMinutes * 60
@@ -205,6 +326,10 @@ func (b *blockBuilder) BuildNewTransactionsList(tranChan <-chan *dto.Transaction
 	for {
 		select {
 		case transactionSub := <-tranChan:
+			if !b.pendingPool.IsPending(transactionSub.ID) {
+				// replaced or cancelled while it was waiting in the channel
+				continue
+			}
 			if len(blockTransactions) < int(b.maxTransactions) {
 				blockTransactions = append(blockTransactions, transactionSub)
 			} else {
@@ -214,6 +339,14 @@ func (b *blockBuilder) BuildNewTransactionsList(tranChan <-chan *dto.Transaction
 					transactionSub,
 				}
 			}
+		case requeuedTransactions := <-b.requeueChan:
+			// requeued transactions came in before anything we are collecting now, so they go to the front of the line
+			blockTransactions = append(requeuedTransactions, blockTransactions...)
+			for len(blockTransactions) > int(b.maxTransactions) {
+				b.resetTimerChan <- struct{}{}
+				b.transactionsWaiting <- blockTransactions[:b.maxTransactions]
+				blockTransactions = blockTransactions[b.maxTransactions:]
+			}
 		case <-b.timerChan:
 			if len(blockTransactions) > 0 {
 				b.transactionsWaiting <- blockTransactions
@@ -225,37 +358,73 @@ func (b *blockBuilder) BuildNewTransactionsList(tranChan <-chan *dto.Transaction
 
 // CreateNewBlocks is the bulk of the node's job because it handles the block mining.
 // CreateNewBlocks Will verify there are no negative balances on its list of transactions,
-// create a header for the block, find proof of work for that header, and then claim the previous block hash if available.
-// CreateNewBlocks will create a header and find proof of work up to 10 times if it can not claim the previous block hash.
-// If CreateNewBlocks never succeeds at claiming the previous block hash, the block will be written locally as a dropped block with dropped transactions.
+// create a header for the block, seal that header with the consensus engine (find proof of work), and then claim the previous block hash if available.
+// CreateNewBlocks will create a header and seal it up to 10 times if it can not claim the previous block hash.
+// When it isn't this node's turn to propose, CreateNewBlocks waits up to maxMissedTurns times for the turn before it hands the batch back to the pending pool.
+// If CreateNewBlocks never succeeds at claiming the previous block hash, the transactions that are still valid go back into the pending pool,
+// and only the invalid transactions or the ones that used up their retry budget are added to the local dropped journal.
 func (b *blockBuilder) CreateNewBlocks() {
 	transactionsWaitingLoopCount := 0
 
 TransactionsWaitingLoop:
 	for blockTransactions := range b.transactionsWaiting {
-		// if a transaction sets a user ballance to negative, mark transaction as dropped
-		b.verifySpendIsAllowed(blockTransactions)
-
-		// TODO: add last transaction with self award for mining.
-		// Should also verify other nodes are not awarding themselves too much.
-
-		// get blockTransactionsBytes for proof of work
-		blockTransactionsBytes, err := json.Marshal(blockTransactions)
-		if err != nil {
-			log.Fatalln("can't marshal the transactions to create a hash! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
-			return
+		// skip transactions that were replaced or cancelled after they were batched
+		blockTransactions = b.pendingPool.TakeForMining(blockTransactions)
+		if len(blockTransactions) == 0 {
+			continue
 		}
 
-		transactionsHash := fmt.Sprintf("%x", sha256.Sum256(blockTransactionsBytes))
+		transactionsHash := b.getTransactionsHash(blockTransactions)
 
-		for retry := 0; retry < 10; retry++ {
+		missedTurns := 0
+		for retry := 0; retry < MaxBlockRetries; retry++ {
+			prevBlockHash, tipChanged := b.prevBlockHashRunner.GetPrevBlockHashAndTipChange()
+			prevHeight, _ := b.blockTree.Height(prevBlockHash)
 			blockHeader := &dto.BlockHeader{
-				PrevBlockHash:    b.prevBlockHashRunner.GetPrevBlockHash(),
+				PrevBlockHash:    prevBlockHash,
 				TransactionsHash: transactionsHash,
 				Time:             strconv.FormatInt(time.Now().Unix(), 10),
+				Height:           prevHeight + 1,
+			}
+
+			err := b.engine.Propose(blockHeader, string(autograph.PublicKeyToBytes(b.publicKey)))
+			if err == consensus.ErrNotProposer {
+				missedTurns++
+				if missedTurns >= maxMissedTurns {
+					// the turn hasn't come to us, so let the transactions be replaced, cancelled and batched again
+					// without using up their retry budget, since no block was tried
+					log.Println("not the proposer after", missedTurns, "turns, handing the batch back to the pending pool")
+					b.requeueOrDropTransactions(blockTransactions, false)
+					continue TransactionsWaitingLoop
+				}
+				// it isn't our turn, so wait for the next block or for the proposer to time out, and don't count it as a retry
+				select {
+				case <-tipChanged:
+				case <-time.After(notProposerWait):
+				}
+				transactionsHash = b.getTransactionsHash(blockTransactions)
+				retry--
+				continue
+			}
+			if err != nil {
+				log.Println("could not propose a block:", err.Error())
+				continue
 			}
 
-			proofOfWorkHash := b.getProofOfWork(blockHeader)
+			proofOfWorkHash, err := b.engine.Seal(blockHeader, tipChanged)
+			if err == consensus.ErrSealAborted {
+				// another node's block was written while we were sealing, so our seal is for a stale prevBlockHash.
+				// restart on the new tip with the balances checked again, and don't count it as a retry
+				// because we never got to try for the claim
+				log.Println("the chain tip moved while sealing the block, restarting on the new tip")
+				transactionsHash = b.getTransactionsHash(blockTransactions)
+				retry--
+				continue
+			}
+			if err != nil {
+				log.Fatalln("can't seal the block! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
+				return
+			}
 
 			block := &dto.BlockRequest{
 				OriginNodePublicKey: string(autograph.PublicKeyToBytes(b.publicKey)),
@@ -288,21 +457,47 @@ TransactionsWaitingLoop:
 			// time.Sleep(20 * time.Second)
 
 			// if the other nodes agreed that I found proof of work first write the block to the chain
-			// and release the claim so that I accept blocks from other nodes again
+			// and release the claim so that I accept blocks from other nodes again.
+			// the signatures are written with the block so the chain can be checked offline with the same finality rule
+			sendOffBlock.Block.NodeSignatures = sendOffBlock.Signatures
 			b.writeChan <- sendOffBlock.Block
+			for _, writtenTransaction := range blockTransactions {
+				delete(b.transactionAttempts, writtenTransaction.ID)
+			}
+			b.pendingPool.Remove(blockTransactions)
 			continue TransactionsWaitingLoop
 		}
 
-		// write dropped block if we fail all retries
-		b.writeDroppedBlock(blockTransactions)
+		// requeue the valid transactions and add the rest to the dropped journal if we fail all retries
+		b.requeueOrDropTransactions(blockTransactions, true)
 
 		transactionsWaitingLoopCount++
 	}
 }
 
+// getTransactionsHash checks the balances for the transactions and hashes them for the block header
+func (b *blockBuilder) getTransactionsHash(blockTransactions []*dto.TransactionSubmission) string {
+	// if a transaction sets a user ballance to negative, mark transaction as dropped
+	b.verifySpendIsAllowed(blockTransactions)
+
+	// TODO: add last transaction with self award for mining.
+	// Should also verify other nodes are not awarding themselves too much.
+
+	// get blockTransactionsBytes for proof of work
+	blockTransactionsBytes, err := json.Marshal(blockTransactions)
+	if err != nil {
+		log.Fatalln("can't marshal the transactions to create a hash! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(blockTransactionsBytes))
+}
+
 func (b *blockBuilder) verifySpendIsAllowed(blockTransactions []*dto.TransactionSubmission) {
 	// check for negative ballance of new transactions
-	usersBalances := make(map[string]float64)
+	usersBalances := make(map[string]dto.Coin)
+	stakeLedger := b.accountState.NewStakeLedger()
+	nonceLedger := b.accountState.NewNonceLedger()
 
 	for _, transactionForNewBlock := range blockTransactions {
 		if transactionForNewBlock.Submitted.CoinAmount < 0 {
@@ -312,17 +507,56 @@ func (b *blockBuilder) verifySpendIsAllowed(blockTransactions []*dto.Transaction
 			continue
 		}
 
+		if transactionForNewBlock.Submitted.Fee < 0 {
+			// we should never reach this point either
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = "Fee is negative"
+			continue
+		}
+
+		err := transactionForNewBlock.Submitted.ValidateType()
+		if err != nil {
+			// checked on the transaction handler too
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
+		// the validators may have changed since the transaction handler checked the approvals
+		err = b.engine.ValidateTransaction(transactionForNewBlock)
+		if err != nil {
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
+		// the nonce may have been written by a replacement since the transaction handler checked it
+		err = nonceLedger.Apply(transactionForNewBlock.Submitted)
+		if err != nil {
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
+		// the fee is lost by the sender along with the coin amount
+		// TODO: award the fees to the node that wins the block along with the mining award
+		spend, err := transactionForNewBlock.Submitted.Spend()
+		if err != nil {
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
 		senderBalance, foundSenderBalance := usersBalances[transactionForNewBlock.Submitted.From]
 		if !foundSenderBalance {
-			senderBalance, err := b.searchIndex.GetWrittenUserBalance(transactionForNewBlock.Submitted.From)
+			senderBalance, err = b.accountState.GetWrittenUserBalance(transactionForNewBlock.Submitted.From)
 			if err != nil {
-				if transactionForNewBlock.Submitted.CoinAmount != 0 {
+				if spend != 0 {
 					transactionForNewBlock.TransactionStatus = dto.StatusDropped
 					transactionForNewBlock.DroppedReason = err.Error()
 					continue
-				} else {
-					senderBalance = 0
 				}
+				senderBalance = 0
 			}
 			usersBalances[transactionForNewBlock.Submitted.From] = senderBalance
 		}
@@ -330,86 +564,105 @@ func (b *blockBuilder) verifySpendIsAllowed(blockTransactions []*dto.Transaction
 		// the receiver might be the sender on following transactions
 		receiverBalance, foundReceiverBalance := usersBalances[transactionForNewBlock.Submitted.To]
 		if !foundReceiverBalance {
-			receiverBalance, err := b.searchIndex.GetWrittenUserBalance(transactionForNewBlock.Submitted.To)
+			receiverBalance, err = b.accountState.GetWrittenUserBalance(transactionForNewBlock.Submitted.To)
 			if err != nil {
 				receiverBalance = 0
 			}
 			usersBalances[transactionForNewBlock.Submitted.To] = receiverBalance
 		}
 
-		if senderBalance-transactionForNewBlock.Submitted.CoinAmount < 0 {
+		newSenderBalance, err := senderBalance.Sub(spend)
+		if err != nil || newSenderBalance < 0 {
 			transactionForNewBlock.TransactionStatus = dto.StatusDropped
 			transactionForNewBlock.DroppedReason = "Not enough Coin in user balance"
 			continue
 		}
 
+		newReceiverBalance, err := receiverBalance.Add(transactionForNewBlock.Submitted.Credit())
+		if err != nil {
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
+		// can't unstake more than was staked with the validator
+		err = stakeLedger.Apply(transactionForNewBlock.Submitted)
+		if err != nil {
+			transactionForNewBlock.TransactionStatus = dto.StatusDropped
+			transactionForNewBlock.DroppedReason = err.Error()
+			continue
+		}
+
 		// update the balances map with the new amounts
 		// so that we are ready to check the next transaction in this block
-		usersBalances[transactionForNewBlock.Submitted.From] = senderBalance - transactionForNewBlock.Submitted.CoinAmount
-		usersBalances[transactionForNewBlock.Submitted.To] = receiverBalance + transactionForNewBlock.Submitted.CoinAmount
+		usersBalances[transactionForNewBlock.Submitted.From] = newSenderBalance
+		usersBalances[transactionForNewBlock.Submitted.To] = newReceiverBalance
 		transactionForNewBlock.TransactionStatus = "accepted"
 	}
 }
 
-// mark the block and transactions as dropped before writing the block to a file
-func (b *blockBuilder) writeDroppedBlock(blockTransactions []*dto.TransactionSubmission) {
-	for _, droppedTransaction := range blockTransactions {
-		droppedTransaction.TransactionStatus = dto.StatusDropped
-		droppedTransaction.DroppedReason = "exceeded retries and dropped block"
-	}
-
-	// not needed if we aren't going to hash the transactions
-	// blockTransactionsBytes, err := json.Marshal(blockTransactions)
-	// if err != nil {
-	// 	log.Fatalln("can't marshal the transactions to create a hash! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
-	// 	return
-	// }
+// requeueOrDropTransactions is called when a block used up all of its retries, with countAttempt true,
+// or when the node never got the turn to propose it, with countAttempt false.
+// A valid payment that only lost the race for the previous hash should not get lost,
+// so it goes back into the pending pool until it has been in transactionRetries failed blocks.
+// Transactions that are invalid or past their retry budget are added to the dropped journal.
+func (b *blockBuilder) requeueOrDropTransactions(blockTransactions []*dto.TransactionSubmission, countAttempt bool) {
+	requeueTransactions := make([]*dto.TransactionSubmission, 0)
+	droppedTransactions := make([]*dto.TransactionSubmission, 0)
+	droppedEntries := make([]*droppedjournal.Entry, 0)
+
+	for _, transactionSub := range blockTransactions {
+		attempts := b.transactionAttempts[transactionSub.ID] + 1
+		if transactionSub.TransactionStatus == dto.StatusDropped {
+			delete(b.transactionAttempts, transactionSub.ID)
+			droppedTransactions = append(droppedTransactions, transactionSub)
+			droppedEntries = append(droppedEntries, droppedjournal.NewEntry(transactionSub, attempts))
+			continue
+		}
 
-	// don't really need this since they are just getting dropped to the nodes local file system
-	// transactionsHash := fmt.Sprintf("%x", sha256.Sum256(blockTransactionsBytes))
+		if !countAttempt {
+			transactionSub.TransactionStatus = ""
+			requeueTransactions = append(requeueTransactions, transactionSub)
+			continue
+		}
 
-	blockHeader := &dto.BlockHeader{
-		PrevBlockHash: "scrubbed",
-		// TransactionsHash: transactionsHash,
-		Time: strconv.FormatInt(time.Now().Unix(), 10),
-	}
+		b.transactionAttempts[transactionSub.ID] = attempts
+		if attempts >= b.transactionRetries {
+			delete(b.transactionAttempts, transactionSub.ID)
+			transactionSub.TransactionStatus = dto.StatusDropped
+			transactionSub.DroppedReason = "exceeded retries and dropped block"
+			droppedTransactions = append(droppedTransactions, transactionSub)
+			droppedEntries = append(droppedEntries, droppedjournal.NewEntry(transactionSub, attempts))
+			continue
+		}
 
-	block := &dto.BlockRequest{
-		OriginNodePublicKey: string(autograph.PublicKeyToBytes(b.publicKey)),
-		ProofOfWorkHash:     dto.StatusDropped,
-		Header:              blockHeader,
-		Transactions:        blockTransactions,
+		// the balances get checked again when the transaction is in its next block
+		transactionSub.TransactionStatus = ""
+		requeueTransactions = append(requeueTransactions, transactionSub)
 	}
 
-	b.writeChan <- block
-}
-
-// find a hash of the block header that has enough leading 0's
-func (b *blockBuilder) getProofOfWork(blockHeader *dto.BlockHeader) string {
-	rand.Seed(time.Now().Unix())
-	nonceCount := 100 + rand.Int63()
-
-	proofOfWorkHash := ""
-	for {
-		nonceCount++
-		blockHeader.Nonce = base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(nonceCount, 10)))
-
-		blockHeaderBytes, err := json.Marshal(blockHeader)
+	if len(droppedTransactions) > 0 {
+		err := b.droppedJournal.Add(droppedEntries)
 		if err != nil {
-			log.Fatalln("can't marshal the block header to create a hash! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
-			return ""
+			log.Fatalln("can't add the dropped transactions to the dropped journal!", err.Error())
+			return
 		}
+		b.pendingPool.Remove(droppedTransactions)
+	}
 
-		proofOfWorkHash = fmt.Sprintf("%x", sha256.Sum256(blockHeaderBytes))
-		if strings.HasPrefix(proofOfWorkHash, "00000") {
-			return proofOfWorkHash
-		}
+	if len(requeueTransactions) > 0 {
+		b.pendingPool.ReturnFromMining(requeueTransactions)
+		log.Println("requeueing", len(requeueTransactions), "transactions from a block that wasn't written")
+		// use a goroutine because BuildNewTransactionsList may be waiting for us to take its next batch
+		go func() {
+			b.requeueChan <- requeueTransactions
+		}()
 	}
 }
 
 // Sign the block and send it off to the other nodes for signing and adding to the block chain
 func (b *blockBuilder) getSendOffBlock(block *dto.BlockRequest) *dto.NodeSignatures {
-	blockBytes, err := json.Marshal(block)
+	blockBytes, err := dto.SignedBlockBytes(block)
 	if err != nil {
 		log.Fatalln("can't marshal the block struct to write to file! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
 		return nil
@@ -433,78 +686,363 @@ func (b *blockBuilder) getSendOffBlock(block *dto.BlockRequest) *dto.NodeSignatu
 	return sendOffBlock
 }
 
-// WriteBlocks receives accepted and dropped blocks on writeChan,
-// verifies the block header has previous hash as the hash of the last written block,
-// updates the search index, and finally writes the block to a file.
-// The file name for the block is the hash of the block plus the number of the blocks written to file including that block.
+// WriteBlocks receives accepted blocks on writeChan and puts them in the block tree.
+// A block that builds on the tip is appended to the main chain. A block that builds on a side branch is kept in the block tree,
+// and when its branch becomes heavier than the main chain the node reorganizes onto that branch.
 func (b *blockBuilder) WriteBlocks() {
-	blocksReceived := 0
-	previousBlockHash := ""
 	for blockToWrite := range b.writeChan {
-		blocksReceived++
-
-		if blockToWrite.ProofOfWorkHash != dto.StatusDropped {
-			previousBlockHashFromLock := b.prevBlockHashRunner.GetPrevBlockHash()
-			if (previousBlockHashFromLock != "" && blockToWrite.Header.PrevBlockHash != previousBlockHashFromLock) ||
-				(previousBlockHash != "" && blockToWrite.Header.PrevBlockHash != previousBlockHash) {
-				panic(
-					fmt.Sprintf(
-						"You done Gooofed! Actual previously written block hash: %s, prevBlockHash from lock: %s, trying to write block with prevBlockHash %s in header",
-						previousBlockHash,
-						previousBlockHashFromLock,
-						blockToWrite.Header.PrevBlockHash,
-					),
-				)
-			}
-		} else /* block is dropped */ {
-			for _, droppedTransaction := range blockToWrite.Transactions {
-				if droppedTransaction.TransactionStatus != dto.StatusDropped {
-					panic(fmt.Sprintf("How do we have a dropped block with a non dropped transaction? transactionID: %s", droppedTransaction.ID))
-				}
-			}
+		err := b.blockTree.Add(blockToWrite, b.engine.BlockWeight(blockToWrite))
+		if err != nil {
+			log.Println("not writing block:", err.Error())
+			continue
+		}
+
+		if blockToWrite.Header.PrevBlockHash == b.blockTree.Tip() {
+			b.appendBlock(blockToWrite)
+			continue
 		}
 
-		blockBytes, err := json.Marshal(blockToWrite)
+		if !b.blockTree.IsHeavierThanTip(blockToWrite.ProofOfWorkHash) {
+			log.Println("keeping block", blockToWrite.ProofOfWorkHash, "on a side branch that is not heavier than the main chain")
+			continue
+		}
+
+		b.reorganize(blockToWrite.ProofOfWorkHash)
+	}
+}
+
+// appendBlock writes the block that builds on the tip and makes it the new tip
+func (b *blockBuilder) appendBlock(block *dto.BlockRequest) {
+	b.writeBlock(block)
+
+	height, _ := b.blockTree.Height(block.ProofOfWorkHash)
+	err := b.accountState.ApplyBlock(height, block)
+	if err != nil {
+		log.Fatalln("can't update the account state with the written block!", err.Error())
+		return
+	}
+
+	b.blockTree.SetTip(block.ProofOfWorkHash)
+	b.engine.BlockWritten(block)
+	b.prevBlockHashRunner.setPrevBlockHash(block.ProofOfWorkHash)
+
+	err = b.pruneOldBlocks()
+	if err != nil {
+		log.Fatalln("can't prune the old blocks in the block store!", err.Error())
+		return
+	}
+}
+
+// pruneOldBlocks prunes the transaction bodies of the blocks more than the retention back from the tip when the node is pruning.
+// The blocks after the oldest snapshot the account state keeps are never pruned, so the accounts can still be built again from a snapshot after a reorg.
+func (b *blockBuilder) pruneOldBlocks() error {
+	if b.pruner == nil {
+		return nil
+	}
+
+	tipHeight, _ := b.blockTree.Height(b.blockTree.Tip())
+	pruneHeight := tipHeight - b.pruneRetention
+	oldestSnapshotHeight := b.accountState.OldestSnapshotHeight()
+	if oldestSnapshotHeight < pruneHeight {
+		pruneHeight = oldestSnapshotHeight
+	}
+	if pruneHeight <= b.pruner.PrunedHeight() {
+		return nil
+	}
+
+	pruned, err := b.pruner.Prune(pruneHeight, b.pruneGzip)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.Printf("pruned the transaction bodies of %d blocks, every block up to height %d is pruned", pruned, b.pruner.PrunedHeight())
+	}
+	return nil
+}
+
+// ReplayWrittenBlocks puts the blocks the block store already had when the node started back in the search index, the block tree and the consensus engine,
+// and brings the account state up to the tip, so the node carries on from the tip of the block store.
+// Dropped blocks the block store has from before the dropped journal are moved to the journal first. Call before the block builder goroutines are started.
+func (b *blockBuilder) ReplayWrittenBlocks() error {
+	err := b.moveDroppedBlocks()
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	err = b.blockStore.IterateWritten(func(name string, block *dto.BlockRequest) error {
+		b.indexBlock(name, block)
+		replayed++
+
+		err := b.blockTree.Add(block, b.engine.BlockWeight(block))
+		if err != nil {
+			return err
+		}
+		b.blockTree.SetTip(block.ProofOfWorkHash)
+		b.engine.BlockWritten(block)
+		b.prevBlockHashRunner.setPrevBlockHash(block.ProofOfWorkHash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.accountState.CatchUp(b.blockTree.MainChain())
+	if err != nil {
+		return err
+	}
+
+	if replayed > 0 {
+		log.Printf("replayed %d written blocks from the block store, the tip is %s", replayed, b.blockTree.Tip())
+	}
+	return b.pruneOldBlocks()
+}
+
+// moveDroppedBlocks adds the transactions of the dropped blocks written before the dropped journal to the journal, and then removes the blocks from the block store.
+// The journal skips the transactions it already has, so a move cut short by the node stopping is finished the next time it starts.
+func (b *blockBuilder) moveDroppedBlocks() error {
+	moved := 0
+	err := b.blockStore.IterateDropped(func(name string, block *dto.BlockRequest) error {
+		entries := make([]*droppedjournal.Entry, 0, len(block.Transactions))
+		for _, transactionSub := range block.Transactions {
+			entries = append(entries, &droppedjournal.Entry{
+				Transaction: transactionSub,
+				Reason:      transactionSub.DroppedReason,
+				SubmittedAt: transactionSub.Timestamp,
+				DroppedAt:   block.Header.Time,
+			})
+		}
+
+		err := b.droppedJournal.Add(entries)
 		if err != nil {
-			log.Fatalln("can't marshal the block struct to write to file! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
+			return err
+		}
+		moved++
+		return b.blockStore.RemoveDropped(name)
+	})
+	if err != nil {
+		return err
+	}
+
+	if moved > 0 {
+		log.Printf("moved %d dropped blocks from the block store to the dropped journal", moved)
+	}
+	return nil
+}
+
+// reorganize switches the main chain to the heavier branch ending at newTip.
+// The branch is checked first, and an invalid branch is taken out of the block tree while the node keeps its main chain.
+// The main chain blocks after the common ancestor are rolled back: they come out of the block store and the search index.
+// Then the branch blocks are written, the account state catches up with the new main chain, and the transactions that only the rolled back blocks had go back to the pending pool.
+func (b *blockBuilder) reorganize(newTip string) {
+	oldTip := b.blockTree.Tip()
+	commonAncestor, rollBack, apply, err := b.blockTree.Branches(newTip)
+	if err != nil {
+		log.Println("could not reorganize onto the heavier branch:", err.Error())
+		return
+	}
+
+	if b.pruner != nil && b.pruner.PrunedHeight() > 0 {
+		// the account state can only be built again from a snapshot at or before the common ancestor, since the blocks before the snapshots may be pruned
+		ancestorHeight, _ := b.blockTree.Height(commonAncestor)
+		oldestSnapshotHeight := b.accountState.OldestSnapshotHeight()
+		if ancestorHeight < oldestSnapshotHeight {
+			log.Printf("not reorganizing onto the heavier branch after %s at height %d, this node has pruned the blocks before its oldest snapshot at height %d", commonAncestor, ancestorHeight, oldestSnapshotHeight)
 			return
 		}
+	}
 
-		fileName := fmt.Sprintf("%x_%d", sha256.Sum256(blockBytes), blocksReceived)
+	invalidBlock, err := b.checkBranch(commonAncestor, apply)
+	if err != nil {
+		log.Printf("not reorganizing onto the heavier branch ending at %s, it is invalid: %s", newTip, err.Error())
+		if invalidBlock != "" {
+			err = b.blockTree.Remove(invalidBlock)
+			if err != nil {
+				log.Println("could not remove the invalid branch from the block tree:", err.Error())
+			}
+		}
+		return
+	}
+
+	event := &blocktree.ReorgEvent{
+		Time:           strconv.FormatInt(time.Now().Unix(), 10),
+		OldTip:         oldTip,
+		NewTip:         newTip,
+		CommonAncestor: commonAncestor,
+		RolledBack:     make([]string, 0, len(rollBack)),
+		Applied:        make([]string, 0, len(apply)),
+	}
+
+	appliedTransactions := make(map[string]bool)
+	for _, block := range apply {
+		for _, transactionSub := range block.Transactions {
+			if transactionSub.TransactionStatus != dto.StatusDropped {
+				appliedTransactions[transactionSub.ID] = true
+			}
+		}
+	}
+
+	orphanedTransactions := make([]*dto.TransactionSubmission, 0)
+	for _, block := range rollBack {
+		b.unwriteTip()
+		event.RolledBack = append(event.RolledBack, block.ProofOfWorkHash)
+
+		for _, transactionSub := range block.Transactions {
+			if transactionSub.TransactionStatus == dto.StatusDropped || transactionSub.TransactionStatus == dto.StatusPruned || appliedTransactions[transactionSub.ID] {
+				continue
+			}
+			// copy it so the rolled back block in the block tree keeps its transactions the way they were written
+			orphaned := *transactionSub
+			orphaned.TransactionStatus = ""
+			orphanedTransactions = append(orphanedTransactions, &orphaned)
+		}
+	}
+
+	for _, block := range apply {
+		b.writeBlock(block)
+		event.Applied = append(event.Applied, block.ProofOfWorkHash)
+		// the branch may have transactions that are still pending on this node
+		b.pendingPool.Remove(block.Transactions)
+	}
+	b.blockTree.SetTip(newTip)
+
+	// checkBranch already replayed the engine up to the new tip, and the account state can't fail on the checked branch
+	err = b.accountState.CatchUp(b.blockTree.MainChain())
+	if err != nil {
+		log.Fatalln("can't update the account state with the new main chain!", err.Error())
+		return
+	}
 
-		// save indexes for searching the block chain files
-		for transactionIndex, transaction := range blockToWrite.Transactions {
-			// transaction IDs
-			b.searchIndex.SetTransactionPathByID(transaction.ID, fileName, transactionIndex)
+	b.prevBlockHashRunner.setPrevBlockHash(newTip)
 
-			// keys
-			b.searchIndex.SetTransactionPathsByKeyword(transaction.Submitted.Key, fileName, transactionIndex)
+	b.returnOrphanedTransactions(orphanedTransactions)
+	event.OrphanedTransactions = len(orphanedTransactions)
 
-			// users giving coin
-			b.searchIndex.SetTransactionPathsByUserID(transaction.Submitted.From, fileName, transactionIndex)
+	log.Printf(
+		"reorganized onto a heavier branch, rolled back %d blocks and applied %d blocks after %s, %d transactions orphaned",
+		len(event.RolledBack),
+		len(event.Applied),
+		commonAncestor,
+		event.OrphanedTransactions,
+	)
+	b.blockTree.EmitReorg(event)
+}
+
+// checkBranch checks the branch blocks after the common ancestor the same way the blocks on the main chain were checked before the node switches to them.
+// The engine is replayed from the first block to the common ancestor, and each branch block is checked against the engine state before it:
+// the seal, which is the proof of work difficulty from the replayed difficulty schedule or the proposer with the turn, and the transactions the engine has a say in.
+// Then the account state checks no sender spends more than their balance or unstakes more than they staked on the branch.
+// checkBranch returns the hash of the first invalid block with the error. The engine is left replayed up to the end of a valid branch,
+// and is replayed back to the main chain for an invalid one.
+func (b *blockBuilder) checkBranch(commonAncestor string, apply []*dto.BlockRequest) (invalidBlock string, err error) {
+	mainChain := b.blockTree.MainChain()
+	ancestorHeight, _ := b.blockTree.Height(commonAncestor)
+	branch := append(append(make([]*dto.BlockRequest, 0, ancestorHeight+int64(len(apply))), mainChain[:ancestorHeight]...), apply...)
+
+	b.engine.Reset()
+	for _, block := range mainChain[:ancestorHeight] {
+		b.engine.BlockWritten(block)
+	}
 
-			// users receiving coin
-			b.searchIndex.SetTransactionPathsByUserID(transaction.Submitted.To, fileName, transactionIndex)
+	invalidBlock, err = b.checkBranchBlocks(apply)
+	if err == nil {
+		invalidBlock, err = b.accountState.CheckBranch(branch)
+	}
+	if err != nil {
+		b.engine.Reset()
+		for _, block := range mainChain {
+			b.engine.BlockWritten(block)
 		}
+		return invalidBlock, err
+	}
+	return "", nil
+}
 
-		err = os.MkdirAll(b.BlockChainOutputPath, 0744)
+// checkBranchBlocks checks each block against the engine and then writes it to the engine, see checkBranch
+func (b *blockBuilder) checkBranchBlocks(apply []*dto.BlockRequest) (invalidBlock string, err error) {
+	for _, block := range apply {
+		err = b.engine.ValidateReplayedSeal(block)
 		if err != nil {
-			log.Fatalln(err)
-			return
+			return block.ProofOfWorkHash, fmt.Errorf("block %s has an invalid seal: %s", block.ProofOfWorkHash, err.Error())
 		}
 
-		err = ioutil.WriteFile(fmt.Sprintf("%s/%s.json", b.BlockChainOutputPath, fileName), blockBytes, 0644)
+		for _, transactionSub := range block.Transactions {
+			if transactionSub.TransactionStatus == dto.StatusDropped || transactionSub.TransactionStatus == dto.StatusPruned {
+				continue
+			}
+			err = b.engine.ValidateTransaction(transactionSub)
+			if err != nil {
+				return block.ProofOfWorkHash, fmt.Errorf("transaction %s in block %s is not allowed by the consensus engine: %s", transactionSub.ID, block.ProofOfWorkHash, err.Error())
+			}
+		}
+
+		b.engine.BlockWritten(block)
+	}
+	return "", nil
+}
+
+// returnOrphanedTransactions puts the transactions from rolled back blocks back in the pending pool and requeues them for the next block.
+// Their balances get checked again on the new main chain when they are in their next block.
+func (b *blockBuilder) returnOrphanedTransactions(orphanedTransactions []*dto.TransactionSubmission) {
+	returnedTransactions := make([]*dto.TransactionSubmission, 0)
+	for _, transactionSub := range orphanedTransactions {
+		_, err := b.pendingPool.Add(transactionSub)
 		if err != nil {
-			log.Fatalln(err)
-			return
+			log.Println("could not return orphaned transaction", transactionSub.ID, "to the pending pool:", err.Error())
+			continue
 		}
+		returnedTransactions = append(returnedTransactions, transactionSub)
+	}
 
-		if blockToWrite.ProofOfWorkHash != dto.StatusDropped {
-			previousBlockHash = blockToWrite.ProofOfWorkHash
-			b.prevBlockHashRunner.setPrevBlockHash(blockToWrite.ProofOfWorkHash)
-			b.prevBlockHashRunner.setPrevBlockHashAsUnclaimed(blockToWrite.OriginNodePublicKey, blockToWrite.ProofOfWorkHash)
+	if len(returnedTransactions) > 0 {
+		// use a goroutine because BuildNewTransactionsList may be waiting for us to take its next batch
+		go func() {
+			b.requeueChan <- returnedTransactions
+		}()
+	}
+}
+
+// writeBlock puts the block in the block store and updates the search index with the name the store gave it
+func (b *blockBuilder) writeBlock(blockToWrite *dto.BlockRequest) {
+	name, err := b.blockStore.Put(blockToWrite)
+	if err != nil {
+		log.Fatalln("can't write the block to the block store! it's the end of the worrrlllldd!!!! aaaaaaaahhhhhhhhh!!!!", err.Error())
+		return
+	}
+
+	b.indexBlock(name, blockToWrite)
+}
+
+// indexBlock saves indexes for searching the written block under the name the block store gave it
+func (b *blockBuilder) indexBlock(name string, blockToWrite *dto.BlockRequest) {
+	for transactionIndex, transaction := range blockToWrite.Transactions {
+		// transaction IDs
+		b.searchIndex.SetTransactionPathByID(transaction.ID, name, transactionIndex)
+
+		if transaction.TransactionStatus == dto.StatusPruned {
+			// only the ID of a pruned transaction is left to index
+			continue
 		}
+
+		// keys
+		b.searchIndex.SetTransactionPathsByKeyword(transaction.Submitted.Key, name, transactionIndex)
+
+		// users giving coin
+		b.searchIndex.SetTransactionPathsByUserID(transaction.Submitted.From, name, transactionIndex)
+
+		// users receiving coin
+		b.searchIndex.SetTransactionPathsByUserID(transaction.Submitted.To, name, transactionIndex)
+	}
+}
+
+// unwriteTip takes the tip block out of the block store and the search index when a reorg rolls it back
+func (b *blockBuilder) unwriteTip() {
+	name, err := b.blockStore.RemoveTip()
+	if err != nil {
+		log.Fatalln("can't roll back the tip of the block store!", err.Error())
+		return
 	}
+	b.searchIndex.RemoveBlock(name)
 }
 
 // found a handy permissions chart on stack overflow
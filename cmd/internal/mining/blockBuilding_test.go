@@ -0,0 +1,168 @@
+package mining
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// claimRaceResult counts how the rounds of a claim race ended
+type claimRaceResult struct {
+	noWinner         int
+	lowestHashWinner int
+	otherWinner      int
+	manyWinners      int
+	ownClaimsGivenUp int
+	// acceptedTakenOver counts the nodes that gave up the claim of an accepted block to a lower hash that came late
+	acceptedTakenOver int
+}
+
+// runClaimRace simulates every node finding proof of work for the same previous hash at the same moment, round after round,
+// with the real claim rules on a fake clock. Each node claims the previous hash for its own block, then the sign requests
+// reach the other nodes in a random order, a few milliseconds apart. A node's block wins the round when every other node signed it
+// and it still holds its own claim. The random order is seeded by the round number, so every run sees the same order of sign requests.
+// Every node then accepts the winning block, and a late sign request with a lower hash still within the tie window must not take over its claim.
+func runClaimRace(t *testing.T, nodes, rounds int, tieWindowSeconds int64) *claimRaceResult {
+	result := &claimRaceResult{}
+
+	for round := 0; round < rounds; round++ {
+		clock := time.Unix(0, 0)
+		now := func() time.Time { return clock }
+
+		runners := make([]*PreviousBlockHashRunner, nodes)
+		publicKeys := make([]string, nodes)
+		blockHashes := make([]string, nodes)
+		lowestHash := 0
+		for node := range runners {
+			runners[node] = NewPrevBlockHashRunner(tieWindowSeconds, 0)
+			runners[node].now = now
+			publicKeys[node] = fmt.Sprintf("node-%d", node+1)
+			blockHashes[node] = fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("round %d node %d", round, node))))
+			if blockHashes[node] < blockHashes[lowestHash] {
+				lowestHash = node
+			}
+
+			// every node found proof of work at the same moment and claims the previous hash for its own block first
+			err := runners[node].SetPrevBlockHashAsClaimed(publicKeys[node], blockHashes[node], "")
+			if err != nil {
+				t.Fatalf("a node could not claim an unclaimed previous hash: %s", err.Error())
+			}
+		}
+
+		type signRequest struct {
+			from int
+			to   int
+		}
+		requests := make([]signRequest, 0, nodes*(nodes-1))
+		for from := 0; from < nodes; from++ {
+			for to := 0; to < nodes; to++ {
+				if from != to {
+					requests = append(requests, signRequest{from: from, to: to})
+				}
+			}
+		}
+		random := rand.New(rand.NewSource(int64(round)))
+		random.Shuffle(len(requests), func(i, j int) {
+			requests[i], requests[j] = requests[j], requests[i]
+		})
+
+		signatures := make([]int, nodes)
+		for _, request := range requests {
+			// the network delay between sign requests
+			clock = clock.Add(time.Duration(1+random.Intn(20)) * time.Millisecond)
+
+			hadClaim := runners[request.to].HoldsClaim(publicKeys[request.to], blockHashes[request.to])
+			err := runners[request.to].SetPrevBlockHashAsClaimed(publicKeys[request.from], blockHashes[request.from], "")
+			if err != nil {
+				continue
+			}
+			if hadClaim {
+				result.ownClaimsGivenUp++
+			}
+			signatures[request.from]++
+		}
+
+		winners := make([]int, 0, 1)
+		for node := range runners {
+			if signatures[node] == nodes-1 && runners[node].HoldsClaim(publicKeys[node], blockHashes[node]) {
+				winners = append(winners, node)
+			}
+		}
+
+		if len(winners) == 1 {
+			lateHash := strings.Repeat("0", len(blockHashes[winners[0]]))
+			for node := range runners {
+				if !runners[node].AcceptClaim(publicKeys[winners[0]], blockHashes[winners[0]]) {
+					t.Fatalf("node %d could not accept the winning block", node+1)
+				}
+				clock = clock.Add(time.Millisecond)
+				err := runners[node].SetPrevBlockHashAsClaimed("late-node", lateHash, "")
+				if err == nil {
+					result.acceptedTakenOver++
+				}
+			}
+		}
+
+		switch {
+		case len(winners) == 0:
+			result.noWinner++
+		case len(winners) > 1:
+			result.manyWinners++
+		case winners[0] == lowestHash:
+			result.lowestHashWinner++
+		default:
+			result.otherWinner++
+		}
+	}
+
+	return result
+}
+
+func TestClaimTieBreakLowestHashWins(t *testing.T) {
+	const nodes = 7
+	const rounds = 1000
+
+	result := runClaimRace(t, nodes, rounds, 10)
+	t.Logf("lowest hash wins within 10s: %d of %d rounds won by the lowest hash, %d times a node gave up its own claim", result.lowestHashWinner, rounds, result.ownClaimsGivenUp)
+	if result.lowestHashWinner != rounds {
+		t.Fatalf("%d rounds had no winner, %d had more than 1 winner and %d were won by a block that isn't the lowest hash, out of %d",
+			result.noWinner, result.manyWinners, result.otherWinner, rounds)
+	}
+	if result.acceptedTakenOver != 0 {
+		t.Fatalf("a lower hash took over the claim of an accepted block %d times", result.acceptedTakenOver)
+	}
+}
+
+func TestClaimFirstClaimWinsStalls(t *testing.T) {
+	const nodes = 7
+	const rounds = 1000
+
+	// without the tie window every node keeps its own claim and no block gets every signature
+	result := runClaimRace(t, nodes, rounds, 0)
+	t.Logf("first claim wins: %d of %d rounds had no winner", result.noWinner, rounds)
+	if result.noWinner != rounds {
+		t.Fatalf("first-claim-wins was expected to stall every round, but %d of %d rounds had a winner", rounds-result.noWinner, rounds)
+	}
+}
+
+func TestClaimTieWindowCloses(t *testing.T) {
+	clock := time.Unix(0, 0)
+	runner := NewPrevBlockHashRunner(10, 0)
+	runner.now = func() time.Time { return clock }
+
+	err := runner.SetPrevBlockHashAsClaimed("node-1", "bbbb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(10*time.Second + time.Millisecond)
+	err = runner.SetPrevBlockHashAsClaimed("node-2", "aaaa", "")
+	if err == nil {
+		t.Fatal("a lower hash took over the claim after the tie window closed")
+	}
+	if !runner.HoldsClaim("node-1", "bbbb") {
+		t.Fatal("the first claim was lost after the tie window closed")
+	}
+}
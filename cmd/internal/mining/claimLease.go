@@ -0,0 +1,124 @@
+package mining
+
+import (
+	"time"
+)
+
+// minRepeatedLease is the shortest lease the halving in repeatedLeaseTTL goes down to, so a retrying node still has time to collect the signatures
+const minRepeatedLease = 10 * time.Second
+
+// leaseTimer is the part of *time.Timer a claim lease uses, so the tests can fire leases from a fake clock
+type leaseTimer interface {
+	Stop() bool
+}
+
+// ClaimStatus is who holds the claim on the previous hash, for the admin claim endpoint
+type ClaimStatus struct {
+	PrevBlockHash string `json:"prevBlockHash"`
+	Claimed       bool   `json:"claimed"`
+	ClaimedBy     string `json:"claimedBy,omitempty"`
+	BlockHash     string `json:"blockHash,omitempty"`
+	ClaimedAt     string `json:"claimedAt,omitempty"`
+	// Accepted is set once the block holding the claim is accepted, which locks the claim until the block is written
+	Accepted bool `json:"accepted,omitempty"`
+	// LeaseExpiresAt and LeaseSecondsLeft are only set when the claim came from a sign request
+	LeaseExpiresAt   string  `json:"leaseExpiresAt,omitempty"`
+	LeaseSecondsLeft float64 `json:"leaseSecondsLeft,omitempty"`
+}
+
+// GetClaimStatus returns the claim on the previous hash and how long is left on its lease
+func (r *PreviousBlockHashRunner) GetClaimStatus() *ClaimStatus {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.releaseExpiredLease()
+
+	status := &ClaimStatus{
+		PrevBlockHash: r.prevHashString,
+		Claimed:       r.claimed,
+	}
+	if !r.claimed {
+		return status
+	}
+
+	status.ClaimedBy = r.claimedBy
+	status.BlockHash = r.blockIDHash
+	status.ClaimedAt = r.claimedAt.UTC().Format(time.RFC3339)
+	status.Accepted = r.accepted
+	if !r.leaseExpiresAt.IsZero() {
+		status.LeaseExpiresAt = r.leaseExpiresAt.UTC().Format(time.RFC3339)
+		status.LeaseSecondsLeft = r.leaseExpiresAt.Sub(r.now()).Seconds()
+	}
+	return status
+}
+
+// AcceptClaim ends the lease on the claim when the block that holds it is accepted,
+// so the claim can't expire while the block waits to be written, and locks the claim so a lower block hash can't take it over
+// within the tie window after the block was accepted. Writing the block releases the claim.
+// AcceptClaim returns false when the node and block header hash don't hold the claim.
+func (r *PreviousBlockHashRunner) AcceptClaim(publicKeyStr, proofOfWorkHash string) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.releaseExpiredLease()
+
+	if !r.claimed || publicKeyStr != r.claimedBy || proofOfWorkHash != r.blockIDHash {
+		return false
+	}
+	r.endLease()
+	r.accepted = true
+	return true
+}
+
+// repeatedLeaseTTL returns leaseTTL halved for each sign request already signed for the origin node on the previous hash, down to minRepeatedLease.
+// A node that keeps sending new blocks on the same previous hash only holds the claim a few minutes in all instead of a full lease for each block.
+func (r *PreviousBlockHashRunner) repeatedLeaseTTL(repeats int) time.Duration {
+	ttl := r.leaseTTL
+	for i := 0; i < repeats && ttl > minRepeatedLease; i++ {
+		ttl /= 2
+	}
+	if ttl < minRepeatedLease && r.leaseTTL >= minRepeatedLease {
+		ttl = minRepeatedLease
+	}
+	return ttl
+}
+
+// startLease puts a lease on the claim that releases it after ttl. Call with the mutex locked.
+func (r *PreviousBlockHashRunner) startLease(publicKeyStr, proofOfWorkHash string, ttl time.Duration) {
+	r.endLease()
+
+	expiresAt := r.now().Add(ttl)
+	r.leaseExpiresAt = expiresAt
+	r.leaseTimer = r.afterFunc(ttl, func() {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+
+		// the claim may have been released, taken over, or claimed again with a new lease before the timer fired
+		if r.claimed && publicKeyStr == r.claimedBy && proofOfWorkHash == r.blockIDHash && r.leaseExpiresAt.Equal(expiresAt) {
+			r.releaseClaim()
+		}
+	})
+}
+
+// endLease stops the lease timer and keeps the claim. Call with the mutex locked.
+func (r *PreviousBlockHashRunner) endLease() {
+	if r.leaseTimer != nil {
+		r.leaseTimer.Stop()
+		r.leaseTimer = nil
+	}
+	r.leaseExpiresAt = time.Time{}
+}
+
+// releaseClaim clears the claim and its lease. Call with the mutex locked.
+func (r *PreviousBlockHashRunner) releaseClaim() {
+	r.endLease()
+	r.claimed = false
+	r.accepted = false
+	r.claimedBy = ""
+	r.blockIDHash = ""
+}
+
+// releaseExpiredLease releases the claim if its lease is past due and the timer hasn't fired yet. Call with the mutex locked.
+func (r *PreviousBlockHashRunner) releaseExpiredLease() {
+	if r.claimed && !r.leaseExpiresAt.IsZero() && !r.now().Before(r.leaseExpiresAt) {
+		r.releaseClaim()
+	}
+}
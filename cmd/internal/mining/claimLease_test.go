@@ -0,0 +1,203 @@
+package mining
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// leaseSeconds is the claim lease the tests use
+const leaseSeconds = 120
+
+// fakeClock is the clock for the lease tests. Timers only fire when the clock is moved forward.
+type fakeClock struct {
+	time   time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	wasActive := !t.stopped && !t.fired
+	t.stopped = true
+	return wasActive
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.time
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, f func()) leaseTimer {
+	timer := &fakeTimer{at: c.time.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// advance moves the clock forward and fires the timers that are due, like time.AfterFunc would in its own goroutine
+func (c *fakeClock) advance(d time.Duration) {
+	c.time = c.time.Add(d)
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.fired && !c.time.Before(timer.at) {
+			timer.fired = true
+			timer.f()
+		}
+	}
+}
+
+// activeTimers returns how many timers haven't fired or been stopped, the leases still waiting to expire
+func (c *fakeClock) activeTimers() int {
+	active := 0
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.fired {
+			active++
+		}
+	}
+	return active
+}
+
+func newLeaseRunner() (*PreviousBlockHashRunner, *fakeClock) {
+	clock := &fakeClock{time: time.Unix(0, 0)}
+	runner := NewPrevBlockHashRunner(10, leaseSeconds)
+	runner.now = clock.now
+	runner.afterFunc = clock.afterFunc
+	return runner, clock
+}
+
+func TestClaimLeaseExpires(t *testing.T) {
+	lease := time.Duration(leaseSeconds) * time.Second
+	runner, clock := newLeaseRunner()
+	err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", "aaaa", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(lease - time.Second)
+	if !runner.HoldsClaim("node-1", "aaaa") {
+		t.Fatal("the claim was released a second before the lease expired")
+	}
+	clock.advance(time.Second)
+	if runner.HoldsClaim("node-1", "aaaa") {
+		t.Fatal("the claim is still held after the lease expired")
+	}
+	if clock.activeTimers() != 0 {
+		t.Fatalf("%d lease timers are still running", clock.activeTimers())
+	}
+
+	err = runner.SetPrevBlockHashAsClaimedFromSignRequest("node-2", "bbbb", "", 0)
+	if err != nil {
+		t.Fatalf("could not claim the previous hash after the lease expired: %s", err.Error())
+	}
+}
+
+func TestClaimLeaseStatus(t *testing.T) {
+	lease := time.Duration(leaseSeconds) * time.Second
+	runner, clock := newLeaseRunner()
+	err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", "aaaa", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(time.Second)
+	status := runner.GetClaimStatus()
+	if !status.Claimed || status.ClaimedBy != "node-1" || status.BlockHash != "aaaa" {
+		t.Fatalf("the status shows the wrong claim: %+v", status)
+	}
+	if status.LeaseSecondsLeft != (lease - time.Second).Seconds() {
+		t.Fatalf("the status shows %v seconds left on the lease", status.LeaseSecondsLeft)
+	}
+}
+
+func TestClaimLeaseEndsOnAccept(t *testing.T) {
+	lease := time.Duration(leaseSeconds) * time.Second
+	runner, clock := newLeaseRunner()
+	err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", "aaaa", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !runner.AcceptClaim("node-1", "aaaa") {
+		t.Fatal("could not accept the block holding the claim")
+	}
+	if clock.activeTimers() != 0 {
+		t.Fatal("the lease timer is still running after the block was accepted")
+	}
+	clock.advance(2 * lease)
+	if !runner.HoldsClaim("node-1", "aaaa") {
+		t.Fatal("the claim of an accepted block expired before it was written")
+	}
+
+	runner.setPrevBlockHash("aaaa")
+	if claimed, _, _ := runner.GetPrevBlockHashClaimed(); claimed {
+		t.Fatal("writing the block did not release the claim")
+	}
+}
+
+func TestClaimLeaseNotInheritedByBetterClaim(t *testing.T) {
+	lease := time.Duration(leaseSeconds) * time.Second
+	runner, clock := newLeaseRunner()
+	err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", "bbbb", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runner.SetPrevBlockHashAsClaimed("node-2", "aaaa", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if clock.activeTimers() != 0 {
+		t.Fatal("the lease timer of the claim that was taken over is still running")
+	}
+	clock.advance(2 * lease)
+	if !runner.HoldsClaim("node-2", "aaaa") {
+		t.Fatal("the better claim was released by the lease of the claim it took over")
+	}
+}
+
+func TestClaimLeaseReleasedWhenTimerIsLate(t *testing.T) {
+	lease := time.Duration(leaseSeconds) * time.Second
+	runner, clock := newLeaseRunner()
+	err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", "aaaa", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// move the clock without firing the timers
+	clock.time = clock.time.Add(lease)
+	if runner.HoldsClaim("node-1", "aaaa") {
+		t.Fatal("the claim is still held after the lease expired")
+	}
+	if clock.activeTimers() != 0 {
+		t.Fatal("the late lease timer was not stopped")
+	}
+}
+
+func TestClaimLeaseHalvedForRepeatedSignRequests(t *testing.T) {
+	runner, clock := newLeaseRunner()
+
+	// an origin node asks for a claim on the same previous hash with one new block after another, each released when its lease runs out
+	held := time.Duration(0)
+	for repeats := 0; repeats < MaxBlockRetries; repeats++ {
+		blockHash := fmt.Sprintf("block %d", repeats)
+		err := runner.SetPrevBlockHashAsClaimedFromSignRequest("node-1", blockHash, "", repeats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease := runner.leaseExpiresAt.Sub(clock.time)
+		if lease < minRepeatedLease || (repeats > 0 && lease > time.Duration(leaseSeconds)*time.Second/2) {
+			t.Fatalf("sign request %d got a lease of %s", repeats+1, lease)
+		}
+		held += lease
+		clock.advance(lease)
+		if runner.HoldsClaim("node-1", blockHash) {
+			t.Fatalf("the claim of sign request %d is still held after its lease", repeats+1)
+		}
+	}
+	if held > 5*time.Minute {
+		t.Fatalf("the origin node held the claim for %s with %d sign requests", held, MaxBlockRetries)
+	}
+}
@@ -38,6 +38,12 @@ func (b *blockBuilder) getSignaturesAndDistrubute(signBlock *dto.NodeSignatures)
 
 	signBlock.Signatures = append(signBlock.Signatures, accumulateSignatures...)
 
+	// a block with a lower hash may have taken our claim while we were getting signatures,
+	// in which case the other nodes are writing that block and not ours
+	if !b.prevBlockHashRunner.HoldsClaim(signBlock.Block.OriginNodePublicKey, signBlock.Block.ProofOfWorkHash) {
+		return fmt.Errorf("gave up the claim on the previous hash to a block with a lower hash")
+	}
+
 	err = b.distribute(activeLocalHostPorts, signBlock)
 	if err != nil {
 		return err
@@ -104,7 +110,16 @@ func (b *blockBuilder) getSignatures(localHostPorts []string, signBlock *dto.Nod
 		accumulateSignatures = append(accumulateSignatures, newlySignedBlock.Signatures[1])
 	}
 
-	if countRejected*100/len(localHostPorts) != 0 {
+	// the consensus engine decides if we have enough signatures, including our own
+	signerPublicKeys := []string{signBlock.Signatures[0].PublicKey}
+	for _, nodeSig := range accumulateSignatures {
+		signerPublicKeys = append(signerPublicKeys, nodeSig.PublicKey)
+	}
+
+	if !b.engine.IsFinal(signBlock.Block, signerPublicKeys, len(localHostPorts)) {
+		if lastFoundResponseErr == nil {
+			lastFoundResponseErr = fmt.Errorf("not enough signatures, %d nodes rejected the block", countRejected)
+		}
 		return nil, lastFoundResponseErr
 	}
 
@@ -0,0 +1,308 @@
+package pendingpool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+const (
+	// finishedStatusTTL is how long the replaced and cancelled statuses are kept for the status endpoint after the transaction was replaced or cancelled
+	finishedStatusTTL = time.Hour
+	// maxFinishedStatuses is the most replaced and cancelled statuses kept, the oldest are let go first
+	maxFinishedStatuses = 10000
+	// maxCancelledNonces is the most cancelled sender nonces kept, the oldest are let go first
+	maxCancelledNonces = 100000
+)
+
+// ErrAtomicBatchFailed is returned for the transactions that were fine in an atomic batch that could not be added because of another transaction
+var ErrAtomicBatchFailed = errors.New("not added because another transaction in the atomic batch failed")
+
+// PendingPool is the struct that keeps track of the transactions that have been submitted but not written yet, with a mutex lock.
+// The transactions themselves still travel through the tranChan to the block builder,
+// PendingPool only remembers which ones are still wanted so that the block builder can skip the replaced and cancelled ones.
+type PendingPool struct {
+	mx            *sync.Mutex
+	bySenderNonce map[string]*dto.TransactionSubmission
+	statuses      map[string]string
+	pendingCount  int
+	// finished is the replaced and cancelled transactions in the order they finished, so their statuses can be let go after finishedStatusTTL
+	finished []*finishedStatus
+	// cancelledNonces are the sender nonces of the cancelled transactions, so a cancelled transaction can't be sent again.
+	// Once the sender has a higher nonce written, the account state turns the cancelled transaction away too.
+	cancelledNonces map[string]bool
+	// cancelledOrder is the cancelled sender nonces in the order they were cancelled, so the oldest can be let go after maxCancelledNonces
+	cancelledOrder []string
+}
+
+// finishedStatus is when a transaction was replaced or cancelled
+type finishedStatus struct {
+	transactionID string
+	status        string
+	at            time.Time
+}
+
+// NewPendingPool returns a new empty instance of the PendingPool struct.
+func NewPendingPool() *PendingPool {
+	return &PendingPool{
+		mx:              &sync.Mutex{},
+		bySenderNonce:   make(map[string]*dto.TransactionSubmission),
+		statuses:        make(map[string]string),
+		cancelledNonces: make(map[string]bool),
+	}
+}
+
+func senderNonceKey(from string, nonce int64) string {
+	return fmt.Sprintf("%s|%d", from, nonce)
+}
+
+// Add puts the transaction in the pool as pending.
+// If a pending transaction from the same user with the same nonce is already in the pool, the new transaction must have a higher fee,
+// and the original is evicted and marked as replaced. Add returns the ID of the replaced transaction, or "" when nothing was replaced.
+// Transactions without a nonce can't be replaced or cancelled, and a nonce can't be used again after it was cancelled.
+// Add does not limit the size of the pool, so callers should check PendingCount() first.
+func (p *PendingPool) Add(transactionSub *dto.TransactionSubmission) (replacedID string, err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	err = p.checkAdd(transactionSub, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return p.add(transactionSub), nil
+}
+
+// AddBatch adds each transaction the same way as Add and returns the replaced ID and error for each one at the same index.
+// When atomic is true, either every transaction is added or none of them are.
+func (p *PendingPool) AddBatch(transactions []*dto.TransactionSubmission, atomic bool) (replacedIDs []string, errs []error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	replacedIDs = make([]string, len(transactions))
+	errs = make([]error, len(transactions))
+
+	if atomic {
+		// check everything before we change anything
+		inBatch := &batchCheck{
+			ids:           make(map[string]bool),
+			bySenderNonce: make(map[string]*dto.TransactionSubmission),
+		}
+		failed := false
+		for i, transactionSub := range transactions {
+			errs[i] = p.checkAdd(transactionSub, inBatch)
+			if errs[i] != nil {
+				failed = true
+			}
+		}
+		if failed {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = ErrAtomicBatchFailed
+				}
+			}
+			return replacedIDs, errs
+		}
+	}
+
+	for i, transactionSub := range transactions {
+		errs[i] = p.checkAdd(transactionSub, nil)
+		if errs[i] != nil {
+			continue
+		}
+		replacedIDs[i] = p.add(transactionSub)
+	}
+
+	return replacedIDs, errs
+}
+
+// batchCheck is what the transactions checked so far in an atomic batch would add to the pool
+type batchCheck struct {
+	ids           map[string]bool
+	bySenderNonce map[string]*dto.TransactionSubmission
+}
+
+// checkAdd returns an error if the transaction can't be added. Call with the mutex locked.
+// inBatch is for checking a batch before anything is added, and may be nil.
+func (p *PendingPool) checkAdd(transactionSub *dto.TransactionSubmission, inBatch *batchCheck) error {
+	if _, found := p.statuses[transactionSub.ID]; found {
+		return fmt.Errorf("the transaction is already in the pending pool")
+	}
+	if inBatch != nil {
+		if inBatch.ids[transactionSub.ID] {
+			return fmt.Errorf("the transaction is in the batch more than once")
+		}
+		inBatch.ids[transactionSub.ID] = true
+	}
+
+	if transactionSub.Submitted.Nonce == 0 {
+		return nil
+	}
+
+	key := senderNonceKey(transactionSub.Submitted.From, transactionSub.Submitted.Nonce)
+	if p.cancelledNonces[key] {
+		return fmt.Errorf("the transaction with nonce %d was cancelled, send it with a new nonce", transactionSub.Submitted.Nonce)
+	}
+	var original *dto.TransactionSubmission
+	found := false
+	if inBatch != nil {
+		original, found = inBatch.bySenderNonce[key]
+		inBatch.bySenderNonce[key] = transactionSub
+	}
+	if !found {
+		original, found = p.bySenderNonce[key]
+	}
+	if !found {
+		return nil
+	}
+
+	if p.statuses[original.ID] == dto.StatusMining {
+		return fmt.Errorf("the transaction with nonce %d is already in a block being mined", transactionSub.Submitted.Nonce)
+	}
+	if transactionSub.Submitted.Fee <= original.Submitted.Fee {
+		return fmt.Errorf("a replacement for the transaction with nonce %d needs a fee higher than %s", transactionSub.Submitted.Nonce, original.Submitted.Fee)
+	}
+	return nil
+}
+
+// add puts a checked transaction in the pool and returns the ID of the transaction it replaced. Call with the mutex locked.
+func (p *PendingPool) add(transactionSub *dto.TransactionSubmission) (replacedID string) {
+	p.statuses[transactionSub.ID] = dto.StatusPending
+	p.pendingCount++
+	if transactionSub.Submitted.Nonce == 0 {
+		return ""
+	}
+
+	key := senderNonceKey(transactionSub.Submitted.From, transactionSub.Submitted.Nonce)
+	original, found := p.bySenderNonce[key]
+	if found {
+		p.finish(original.ID, dto.StatusReplaced)
+		p.pendingCount--
+		replacedID = original.ID
+	}
+
+	p.bySenderNonce[key] = transactionSub
+	return replacedID
+}
+
+// finish marks the transaction as replaced or cancelled, and lets go of the statuses that finished more than finishedStatusTTL ago
+// or that are past maxFinishedStatuses. Call with the mutex locked.
+func (p *PendingPool) finish(transactionID, status string) {
+	now := time.Now()
+	p.statuses[transactionID] = status
+	p.finished = append(p.finished, &finishedStatus{
+		transactionID: transactionID,
+		status:        status,
+		at:            now,
+	})
+
+	expired := 0
+	for expired < len(p.finished) && (len(p.finished)-expired > maxFinishedStatuses || now.Sub(p.finished[expired].at) > finishedStatusTTL) {
+		oldest := p.finished[expired]
+		// the transaction may have been submitted again since
+		if p.statuses[oldest.transactionID] == oldest.status {
+			delete(p.statuses, oldest.transactionID)
+		}
+		expired++
+	}
+	p.finished = p.finished[expired:]
+}
+
+// Cancel evicts the pending transaction from the user with the nonce and marks it as cancelled. Cancel returns the ID of the cancelled transaction.
+// No other transaction from the user can be added with the nonce after it is cancelled.
+func (p *PendingPool) Cancel(from string, nonce int64) (cancelledID string, err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := senderNonceKey(from, nonce)
+	original, found := p.bySenderNonce[key]
+	if !found {
+		return "", fmt.Errorf("no pending transaction with nonce %d for this user", nonce)
+	}
+	if p.statuses[original.ID] == dto.StatusMining {
+		return "", fmt.Errorf("the transaction with nonce %d is already in a block being mined", nonce)
+	}
+
+	delete(p.bySenderNonce, key)
+	p.finish(original.ID, dto.StatusCancelled)
+	p.pendingCount--
+
+	p.cancelledNonces[key] = true
+	p.cancelledOrder = append(p.cancelledOrder, key)
+	if len(p.cancelledOrder) > maxCancelledNonces {
+		delete(p.cancelledNonces, p.cancelledOrder[0])
+		p.cancelledOrder = p.cancelledOrder[1:]
+	}
+	return original.ID, nil
+}
+
+// IsPending returns if the transaction is still wanted, which is false after it has been replaced or cancelled.
+func (p *PendingPool) IsPending(transactionID string) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.statuses[transactionID] == dto.StatusPending
+}
+
+// TakeForMining filters out the transactions that were replaced or cancelled and marks the rest as being mined,
+// so that they can't be replaced or cancelled while the node is trying to get them into a block.
+func (p *PendingPool) TakeForMining(blockTransactions []*dto.TransactionSubmission) []*dto.TransactionSubmission {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	stillPending := make([]*dto.TransactionSubmission, 0, len(blockTransactions))
+	for _, transactionSub := range blockTransactions {
+		if p.statuses[transactionSub.ID] != dto.StatusPending {
+			continue
+		}
+		p.statuses[transactionSub.ID] = dto.StatusMining
+		stillPending = append(stillPending, transactionSub)
+	}
+	return stillPending
+}
+
+// ReturnFromMining marks requeued transactions as pending again so that they can be replaced or cancelled.
+func (p *PendingPool) ReturnFromMining(transactions []*dto.TransactionSubmission) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for _, transactionSub := range transactions {
+		p.statuses[transactionSub.ID] = dto.StatusPending
+	}
+}
+
+// Remove takes written or dropped transactions out of the pool. Their status comes from the search index after this.
+func (p *PendingPool) Remove(transactions []*dto.TransactionSubmission) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for _, transactionSub := range transactions {
+		status, found := p.statuses[transactionSub.ID]
+		if found && (status == dto.StatusPending || status == dto.StatusMining) {
+			p.pendingCount--
+		}
+		delete(p.statuses, transactionSub.ID)
+		key := senderNonceKey(transactionSub.Submitted.From, transactionSub.Submitted.Nonce)
+		if current, found := p.bySenderNonce[key]; found && current.ID == transactionSub.ID {
+			delete(p.bySenderNonce, key)
+		}
+	}
+}
+
+// GetStatus returns the pool status of the transaction ID, and false if the pool doesn't know about it.
+func (p *PendingPool) GetStatus(transactionID string) (string, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	status, found := p.statuses[transactionID]
+	return status, found
+}
+
+// PendingCount returns the number of transactions that are pending or being mined
+func (p *PendingPool) PendingCount() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.pendingCount
+}
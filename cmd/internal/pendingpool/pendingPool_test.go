@@ -0,0 +1,87 @@
+package pendingpool
+
+import (
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+func sampleTransaction(id string, nonce int64, fee dto.Coin) *dto.TransactionSubmission {
+	return &dto.TransactionSubmission{
+		ID: id,
+		Submitted: &dto.Transaction{
+			From:       "user-1",
+			To:         "user-2",
+			CoinAmount: dto.CoinBaseUnits,
+			Fee:        fee,
+			Nonce:      nonce,
+		},
+	}
+}
+
+func TestReplacedTransactionCanNotComeBack(t *testing.T) {
+	pool := NewPendingPool()
+	_, err := pool.Add(sampleTransaction("original", 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacedID, err := pool.Add(sampleTransaction("replacement", 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacedID != "original" {
+		t.Fatalf("the replacement replaced %q instead of the original", replacedID)
+	}
+
+	// the transaction handler gives the original a new ID when it is sent again, because of the new timestamp
+	_, err = pool.Add(sampleTransaction("original-again", 1, 1))
+	if err == nil {
+		t.Fatal("the original was added again while its replacement is pending")
+	}
+	if pool.PendingCount() != 1 {
+		t.Fatalf("the pool has %d pending transactions instead of the replacement", pool.PendingCount())
+	}
+}
+
+func TestCancelledTransactionCanNotComeBack(t *testing.T) {
+	pool := NewPendingPool()
+	_, err := pool.Add(sampleTransaction("original", 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelledID, err := pool.Cancel("user-1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelledID != "original" {
+		t.Fatalf("cancelled %q instead of the original", cancelledID)
+	}
+
+	_, err = pool.Add(sampleTransaction("original-again", 1, 1))
+	if err == nil {
+		t.Fatal("the cancelled transaction was added again")
+	}
+	_, errs := pool.AddBatch([]*dto.TransactionSubmission{sampleTransaction("original-in-batch", 1, 5)}, false)
+	if errs[0] == nil {
+		t.Fatal("the cancelled transaction was added again in a batch")
+	}
+
+	_, err = pool.Add(sampleTransaction("next", 2, 1))
+	if err != nil {
+		t.Fatalf("the next nonce was turned away after the cancel: %s", err.Error())
+	}
+}
+
+func TestAtomicBatchAddsNothingWhenATransactionRepeats(t *testing.T) {
+	for _, nonce := range []int64{0, 1} {
+		pool := NewPendingPool()
+		transactionSub := sampleTransaction("repeated", nonce, 1)
+		_, errs := pool.AddBatch([]*dto.TransactionSubmission{transactionSub, sampleTransaction("other", 0, 1), transactionSub}, true)
+		if errs[0] != ErrAtomicBatchFailed || errs[1] != ErrAtomicBatchFailed || errs[2] == nil || errs[2] == ErrAtomicBatchFailed {
+			t.Fatalf("with nonce %d the batch errors are %v", nonce, errs)
+		}
+		if pool.PendingCount() != 0 {
+			t.Fatalf("with nonce %d the atomic batch added %d transactions", nonce, pool.PendingCount())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package resources
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/archive"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+// Export writes the chain in the --blockchain-folder-name folder to the --file chain archive, or to stdout when --file is "-".
+// The block store is opened read only, so the folder of a running node can be exported and is left as it is.
+func Export(ctx *cli.Context) error {
+	if ctx.String("block-store") == storage.MemoryBlockStoreName {
+		return fmt.Errorf("the memory block store has no blocks to export once the node stops")
+	}
+
+	blockStore, err := newReadOnlyBlockStore(ctx, ctx.String("blockchain-folder-name"))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if ctx.String("file") != "-" {
+		file, err := os.Create(ctx.String("file"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	manifest, err := archive.ExportChain(blockStore, ctx.String("consensus"), w)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d blocks from %s, tip %s, merkle root %s", manifest.BlockCount, ctx.String("blockchain-folder-name"), manifest.TipHash, manifest.MerkleRoot)
+	return nil
+}
+
+// Import checks each block of the --file chain archive, or of stdin when --file is "-", with the consensus engine picked with the --consensus flag
+// and writes it to the --blockchain-folder-name folder, which can't have any blocks yet
+func Import(ctx *cli.Context) error {
+	if ctx.String("block-store") == storage.MemoryBlockStoreName {
+		return fmt.Errorf("the memory block store would lose the imported blocks as soon as the import is done")
+	}
+
+	engine, err := newConsensusEngine(ctx)
+	if err != nil {
+		return err
+	}
+
+	blockChainOutputPath := ctx.String("blockchain-folder-name")
+	blockStore, err := newBlockStore(ctx, blockChainOutputPath)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if ctx.String("file") != "-" {
+		file, err := os.Open(ctx.String("file"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	manifest, err := archive.ImportChain(r, blockStore, engine)
+	if err != nil {
+		height, _, tipErr := blockStore.Tip()
+		if tipErr == nil && height > 0 && !errors.Is(err, archive.ErrNotEmpty) {
+			return fmt.Errorf("%s. The blocks imported before it, %d of them, are in %s, remove them before importing again", err.Error(), height, blockChainOutputPath)
+		}
+		return err
+	}
+	log.Printf("imported %d blocks into %s, tip %s, merkle root %s", manifest.BlockCount, blockChainOutputPath, manifest.TipHash, manifest.MerkleRoot)
+	return nil
+}
@@ -1,11 +1,21 @@
 package resources
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"path/filepath"
 
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/accountstate"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/autograph"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/blocktree"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/consensus"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/droppedjournal"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/mining"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/pendingpool"
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/searchindexing"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
 
@@ -14,34 +24,260 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// newConsensusEngine returns the consensus engine picked with the --consensus flag
+func newConsensusEngine(ctx *cli.Context) (consensus.Engine, error) {
+	switch ctx.String("consensus") {
+	case consensus.ProofOfWorkName:
+		return consensus.NewProofOfWorkEngine(
+			ctx.Uint64("difficulty"),
+			ctx.Int64("difficulty-adjust-blocks"),
+			ctx.Int64("target-block-seconds"),
+			ctx.Int("pow-workers"),
+		), nil
+	case consensus.ProofOfStakeName:
+		return consensus.NewProofOfStakeEngine(ctx.Int64("slot-seconds")), nil
+	case consensus.ProofOfAuthorityName:
+		if ctx.String("validators-file") == "" {
+			return nil, fmt.Errorf("proof of authority needs --validators-file")
+		}
+		validators, err := consensus.ReadValidatorsFile(ctx.String("validators-file"))
+		if err != nil {
+			return nil, err
+		}
+		return consensus.NewProofOfAuthorityEngine(validators, ctx.Float64("validator-signature-fraction"), ctx.Int64("slot-seconds"))
+	default:
+		return nil, fmt.Errorf("unknown consensus engine %q", ctx.String("consensus"))
+	}
+}
+
+// newBlockStore returns the block store picked with the --block-store flag
+func newBlockStore(ctx *cli.Context, blockChainOutputPath string) (storage.BlockStore, error) {
+	switch ctx.String("block-store") {
+	case storage.FileBlockStoreName:
+		return storage.OpenFileBlockStore(blockChainOutputPath)
+	case storage.MemoryBlockStoreName:
+		return storage.NewMemoryBlockStore(), nil
+	case storage.SegmentBlockStoreName:
+		return storage.OpenSegmentBlockStore(blockChainOutputPath, ctx.Int64("segment-max-bytes"))
+	default:
+		return nil, fmt.Errorf("unknown block store %q", ctx.String("block-store"))
+	}
+}
+
+// newReadOnlyBlockStore returns the block store picked with the --block-store flag opened read only,
+// so the folder of a running node can be read without recovering or renaming anything in it
+func newReadOnlyBlockStore(ctx *cli.Context, blockChainOutputPath string) (storage.BlockStore, error) {
+	switch ctx.String("block-store") {
+	case storage.FileBlockStoreName:
+		return storage.OpenFileBlockStoreReadOnly(blockChainOutputPath)
+	case storage.SegmentBlockStoreName:
+		return storage.OpenSegmentBlockStoreReadOnly(blockChainOutputPath)
+	default:
+		return nil, fmt.Errorf("the %q block store can't be opened read only", ctx.String("block-store"))
+	}
+}
+
+// newAccountState returns the account state with its snapshots saved next to the blocks, or kept in memory along with the blocks with the memory block store
+func newAccountState(ctx *cli.Context, blockChainOutputPath string) (*accountstate.AccountState, error) {
+	if ctx.String("block-store") == storage.MemoryBlockStoreName {
+		return accountstate.NewAccountState("", ctx.Int64("snapshot-interval"))
+	}
+	return accountstate.NewAccountState(filepath.Join(blockChainOutputPath, "state"), ctx.Int64("snapshot-interval"))
+}
+
+// newDroppedJournal returns the dropped journal kept in its own folder next to the blocks, or kept in memory along with the blocks with the memory block store
+func newDroppedJournal(ctx *cli.Context, blockChainOutputPath string) (*droppedjournal.DroppedJournal, error) {
+	if ctx.String("block-store") == storage.MemoryBlockStoreName {
+		return droppedjournal.OpenDroppedJournal("")
+	}
+	return droppedjournal.OpenDroppedJournal(filepath.Join(blockChainOutputPath, "dropped"))
+}
+
+// bootstrapAccountState starts the account state from the latest snapshot of the --snapshot-peer node when this node doesn't have a snapshot of its own.
+// The snapshot has to be signed by one of the nodes in the --snapshot-peer-keys file.
+// The node still starts if the snapshot can't be used, and builds the account state from the first block instead.
+func bootstrapAccountState(ctx *cli.Context, accountState *accountstate.AccountState) {
+	peer := ctx.String("snapshot-peer")
+	if peer == "" || accountState.LatestSnapshot() != nil {
+		return
+	}
+	if ctx.String("snapshot-peer-keys") == "" {
+		log.Println("not starting from the snapshot of", peer, "without --snapshot-peer-keys to trust its signature")
+		return
+	}
+
+	trustedPublicKeys, err := autograph.ReadPublicKeysFile(ctx.String("snapshot-peer-keys"))
+	if err != nil {
+		log.Println("not starting from the snapshot of", peer, err.Error())
+		return
+	}
+	snapshot, err := accountstate.FetchSnapshot(peer)
+	if err == nil {
+		err = accountState.Bootstrap(snapshot, trustedPublicKeys)
+	}
+	if err != nil {
+		log.Println("not starting from the snapshot of", peer, err.Error())
+		return
+	}
+	log.Printf("starting the account state from the snapshot of %s at height %d", peer, snapshot.Height)
+}
+
+// freeLocalHostPort returns the first of the local ports that no node is listening on yet.
+// quick and dirty port handling for localhost. run up to 7 nodes locally
+func freeLocalHostPort() (string, error) {
+	// TBD. Can't get them to talk to each other from the terminal yet.
+	localHostPorts := []string{":8080", ":8081", ":8082", ":8083", ":8084", ":8085", ":8086"}
+	for _, port := range localHostPorts {
+		url := fmt.Sprintf("http://127.0.0.1%s/healthcheck", port)
+		_, err := http.Get(url)
+		if err == nil {
+			continue
+		}
+		return port, nil
+	}
+	return "", fmt.Errorf("a node is already running on every local port")
+}
+
+// logReorgs logs every reorg event as json so the reorgs can be picked out of the node output
+func logReorgs(reorgEvents <-chan *blocktree.ReorgEvent) {
+	for event := range reorgEvents {
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		log.Println("reorg event:", string(eventBytes))
+	}
+}
+
+// checkQueueSizes returns an error when the transaction queue or the pending pool can't hold a transaction.
+// A transaction queue of 0 would hold up the intake until the block builder takes each transaction, a negative one can't be made at all,
+// and a pending pool of 0 or less would answer 503 to every transaction.
+func checkQueueSizes(ctx *cli.Context) error {
+	if ctx.Int("transaction-queue-size") <= 0 {
+		return fmt.Errorf("--transaction-queue-size must be more than 0, got %d", ctx.Int("transaction-queue-size"))
+	}
+	if ctx.Int("max-pending-transactions") <= 0 {
+		return fmt.Errorf("--max-pending-transactions must be more than 0, got %d", ctx.Int("max-pending-transactions"))
+	}
+	return nil
+}
+
 // Serve listens for requests and uses the appropriate handler functions
 func Serve(ctx *cli.Context) error {
-	tranChan := make(chan *dto.TransactionSubmission, 100)
+	err := checkQueueSizes(ctx)
+	if err != nil {
+		return err
+	}
+
+	tranChan := make(chan *dto.TransactionSubmission, ctx.Int("transaction-queue-size"))
 	writeChan := make(chan *dto.BlockRequest, 1)
 
-	prevBlockHashRunner := mining.NewPrevBlockHashRunner()
+	host := ctx.String("host")
+	localHostPort := ""
+	blockChainOutputPath := ctx.String("blockchain-folder-name")
+	if len(host) == 0 {
+		var err error
+		localHostPort, err = freeLocalHostPort()
+		if err != nil {
+			return err
+		}
+		// example output folder "written8080"
+		blockChainOutputPath = blockChainOutputPath + localHostPort[1:]
+	}
+
+	blockStore, err := newBlockStore(ctx, blockChainOutputPath)
+	if err != nil {
+		return err
+	}
+
+	prevBlockHashRunner := mining.NewPrevBlockHashRunner(ctx.Int64("claim-tie-window"), ctx.Int64("claim-lease-seconds"))
+	engine, err := newConsensusEngine(ctx)
+	if err != nil {
+		return err
+	}
+
+	blockTree := blocktree.NewBlockTree()
+	go logReorgs(blockTree.Subscribe())
+
+	searchIndex := searchindexing.NewSearchIndexer(blockStore)
+
+	droppedJournal, err := newDroppedJournal(ctx, blockChainOutputPath)
+	if err != nil {
+		return err
+	}
+
+	accountState, err := newAccountState(ctx, blockChainOutputPath)
+	if err != nil {
+		return err
+	}
 
-	searchIndex := searchindexing.NewSearchIndexer(ctx.String("blockchain-folder-name"))
+	pendingPool := pendingpool.NewPendingPool()
 
-	transactionRunner := handlers.NewTransactionRunner(tranChan)
-	signer, err := handlers.NewBlockSigner(prevBlockHashRunner, searchIndex)
+	transactionRunner := handlers.NewTransactionRunner(
+		tranChan,
+		pendingPool,
+		searchIndex,
+		droppedJournal,
+		accountState,
+		engine,
+		ctx.Int("max-pending-transactions"),
+		ctx.Int64("retry-after"),
+	)
+	signer, err := handlers.NewBlockSigner(
+		prevBlockHashRunner,
+		engine,
+		searchIndex,
+		accountState,
+		ctx.String("node-key-file"),
+		ctx.Int64("sign-request-cache-minutes"),
+		ctx.Int("sign-request-cache-size"),
+		ctx.Int("sign-requests-per-tip"),
+	)
 	if err != nil {
 		return err
 	}
-	acceptor := handlers.NewBlockAcceptor(prevBlockHashRunner, searchIndex, signer.PublicKey, writeChan)
+	acceptor := handlers.NewBlockAcceptor(prevBlockHashRunner, engine, blockTree, searchIndex, accountState, signer.PublicKey, writeChan)
+
+	search := handlers.NewSearcher(searchIndex, droppedJournal)
 
-	search := handlers.NewSearcher(searchIndex)
+	balance := handlers.NewBalanceReporter(accountState)
+
+	chain := handlers.NewChainReporter(blockTree, blockStore, prevBlockHashRunner)
 
 	blockBuilder := mining.NewBlockBuilder(
 		prevBlockHashRunner,
+		engine,
+		blockTree,
+		blockStore,
 		searchIndex,
+		droppedJournal,
+		accountState,
+		pendingPool,
 		writeChan,
 		ctx.Int64("max-transactions"),
 		ctx.Int64("time-limit"),
-		ctx.String("blockchain-folder-name"),
+		ctx.Int64("transaction-retries"),
 		signer.PrivateKey,
 		signer.PublicKey,
 	)
+	blockBuilder.SetMyLocalHostPort(localHostPort)
+	// a pruning node needs the snapshots, the account state can't be built again from the first block once old blocks are pruned
+	if ctx.String("prune") != storage.ArchivalMode && ctx.Int64("snapshot-interval") <= 0 {
+		return fmt.Errorf("--prune %s needs --snapshot-interval to take snapshots", ctx.String("prune"))
+	}
+	err = blockBuilder.SetPruning(ctx.String("prune"), ctx.Int64("prune-retention"))
+	if err != nil {
+		return err
+	}
+	chain.SetPruneMode(ctx.String("prune"), ctx.Int64("prune-retention"))
+
+	accountState.SetNodeKeys(signer.PrivateKey, signer.PublicKey)
+	bootstrapAccountState(ctx, accountState)
+
+	err = blockBuilder.ReplayWrittenBlocks()
+	if err != nil {
+		return err
+	}
 
 	go blockBuilder.BlockTimer()
 	go blockBuilder.BuildNewTransactionsList(tranChan)
@@ -49,39 +285,32 @@ func Serve(ctx *cli.Context) error {
 	go blockBuilder.WriteBlocks()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/healthcheck", func(resp http.ResponseWriter, req *http.Request) { resp.WriteHeader(http.StatusOK) }).Methods("GET")
+	r.HandleFunc("/healthcheck", chain.Healthcheck).Methods("GET")
 	r.HandleFunc("/transaction", transactionRunner.Transaction).Methods("POST")
+	r.HandleFunc("/transactions/batch", transactionRunner.Batch).Methods("POST")
+	r.HandleFunc("/transactions/queue", transactionRunner.Queue).Methods("GET")
+	r.HandleFunc("/transaction/cancel", transactionRunner.Cancel).Methods("POST")
+	r.HandleFunc("/transaction/{transaction_id}/status", transactionRunner.Status).Methods("GET")
 	r.HandleFunc("/block-sign", signer.VerifyAndSign).Methods("POST")
 	r.HandleFunc("/block", acceptor.VerifyAndAppend).Methods("POST")
 	r.HandleFunc("/search/transaction/{transaction_id}", search.Transaction).Methods("POST")
 	r.HandleFunc("/search/key/{keyword}", search.Keyword).Methods("POST")
 	r.HandleFunc("/search/user/{user_publickey_hexencoded}", search.User).Methods("POST")
+	r.HandleFunc("/dropped", search.Dropped).Methods("GET")
+	r.HandleFunc("/dropped/{transaction_id}", search.DroppedTransaction).Methods("GET")
+	r.HandleFunc("/balance/{address}", balance.Balance).Methods("GET")
+	r.HandleFunc("/state/snapshot", balance.Snapshot).Methods("GET")
+	r.HandleFunc("/chain/tip", chain.Tip).Methods("GET")
+	r.HandleFunc("/chain/height/{height}", chain.BlockByHeight).Methods("GET")
+	r.HandleFunc("/chain/block/{block_hash}", chain.BlockByHash).Methods("GET")
+	r.HandleFunc("/chain/reorgs", chain.Reorgs).Methods("GET")
+	r.HandleFunc("/admin/claim", chain.Claim).Methods("GET")
 	// r.HandleFunc("/latest-blocks/{block_id}", blockLibrarian.BlocksAfterBlockID).Methods("POST")
 
-	host := ctx.String("host")
 	http.Handle("/", r)
-	// quick and dirty port handling for localhost. run up to 7 nodes locally
 	if len(host) == 0 {
-		// TBD. Can't get them to talk to each other from the terminal yet.
-		localHostPorts := []string{":8080", ":8081", ":8082", ":8083", ":8084", ":8085", ":8086"}
-		for _, port := range localHostPorts {
-			url := fmt.Sprintf("http://127.0.0.1%s/healthcheck", port)
-			_, err := http.Get(url)
-			if err == nil {
-				continue
-			}
-
-			// this is manipulating data in a goroutine using a pointer.
-			// Usually I wouldn't, but quick and dirty and all. example output folder "written8080"
-			blockBuilder.BlockChainOutputPath = blockBuilder.BlockChainOutputPath + port[1:]
-			searchIndex.BlockChainOutputPath = searchIndex.BlockChainOutputPath + port[1:]
-
-			blockBuilder.SetMyLocalHostPort(port)
-
-			fmt.Println("listening on localhost port", port)
-			http.ListenAndServe(port, nil)
-			break
-		}
+		fmt.Println("listening on localhost port", localHostPort)
+		http.ListenAndServe(localHostPort, nil)
 	} else {
 		fmt.Println("listening on", host)
 		http.ListenAndServe(host, nil)
@@ -0,0 +1,43 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/integrity"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+// Verify checks the block files in the --blockchain-folder-name folder with the consensus engine picked with the --consensus flag,
+// and prints the report as json. Verify returns an error when the chain doesn't pass, so the exit status can fail a CI job.
+func Verify(ctx *cli.Context) error {
+	if ctx.String("block-store") != storage.FileBlockStoreName {
+		return fmt.Errorf("verify reads the block files of the %q block store, not %q", storage.FileBlockStoreName, ctx.String("block-store"))
+	}
+
+	engine, err := newConsensusEngine(ctx)
+	if err != nil {
+		return err
+	}
+
+	blockChainOutputPath := ctx.String("blockchain-folder-name")
+	report, err := integrity.VerifyChain(blockChainOutputPath, engine)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		return err
+	}
+
+	if !report.OK {
+		return fmt.Errorf("the chain in %s did not pass verification", blockChainOutputPath)
+	}
+	return nil
+}
@@ -1,21 +1,21 @@
 package searchindexing
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"sync"
 
 	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/storage"
 )
 
-// SearchIndexer is the struct that keeps track of where transactions have been saved with a mutex lock for the written-to-file blocks
+// SearchIndexer is the struct that keeps track of where transactions have been saved with a mutex lock for the written blocks.
+// The file names in the index are the names the block store gave the blocks.
 type SearchIndexer struct {
-	mx                   *sync.Mutex
-	transactionIDs       map[string]*singleTransactionPath
-	keys                 map[string]map[string][]int
-	users                map[string]map[string][]int
-	BlockChainOutputPath string
+	mx             *sync.Mutex
+	transactionIDs map[string]*singleTransactionPath
+	keys           map[string]map[string][]int
+	users          map[string]map[string][]int
+	blockStore     storage.BlockStore
 }
 
 type singleTransactionPath struct {
@@ -23,14 +23,14 @@ type singleTransactionPath struct {
 	index    int
 }
 
-// NewSearchIndexer returns a new empty instance of the SearchIndexer struct with the file output path set.
-func NewSearchIndexer(blockChainOutputPath string) *SearchIndexer {
+// NewSearchIndexer returns a new empty instance of the SearchIndexer struct that reads the blocks from the block store.
+func NewSearchIndexer(blockStore storage.BlockStore) *SearchIndexer {
 	return &SearchIndexer{
-		mx:                   &sync.Mutex{},
-		transactionIDs:       make(map[string]*singleTransactionPath),
-		keys:                 make(map[string]map[string][]int),
-		users:                make(map[string]map[string][]int),
-		BlockChainOutputPath: blockChainOutputPath,
+		mx:             &sync.Mutex{},
+		transactionIDs: make(map[string]*singleTransactionPath),
+		keys:           make(map[string]map[string][]int),
+		users:          make(map[string]map[string][]int),
+		blockStore:     blockStore,
 	}
 }
 
@@ -120,6 +120,27 @@ func (s *SearchIndexer) SetTransactionPathsByUserID(userID, fileName string, ind
 	s.users[userID][fileName] = append(s.users[userID][fileName], index)
 }
 
+// RemoveBlock takes every transaction path to the block out of the SearchIndexer struct, for when the block is rolled back by a reorg
+func (s *SearchIndexer) RemoveBlock(fileName string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for transactionID, path := range s.transactionIDs {
+		if path.fileName == fileName {
+			delete(s.transactionIDs, transactionID)
+		}
+	}
+
+	for _, paths := range []map[string]map[string][]int{s.keys, s.users} {
+		for key, fileNames := range paths {
+			delete(fileNames, fileName)
+			if len(fileNames) == 0 {
+				delete(paths, key)
+			}
+		}
+	}
+}
+
 // GetTransactionsFromFiles reads files of the written block chain with the given map of file names and returns the transactions specified by the map transaction index
 func (s *SearchIndexer) GetTransactionsFromFiles(fileNames map[string][]int) ([]*dto.TransactionSubmission, error) {
 	transactionList := make([]*dto.TransactionSubmission, 0)
@@ -134,16 +155,9 @@ func (s *SearchIndexer) GetTransactionsFromFiles(fileNames map[string][]int) ([]
 	return transactionList, nil
 }
 
-// GetTransactionsFromSingleFile reads the file specified and returns the transactions from the block in the file specified by transaction indexes
+// GetTransactionsFromSingleFile reads the block with the file name from the block store and returns the transactions from the block specified by transaction indexes
 func (s *SearchIndexer) GetTransactionsFromSingleFile(fileName string, getTransactionsAt []int) ([]*dto.TransactionSubmission, error) {
-	fileBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.json", s.BlockChainOutputPath, fileName))
-	if err != nil {
-		return nil, err
-	}
-
-	block := &dto.BlockRequest{}
-
-	err = json.Unmarshal(fileBytes, block)
+	block, err := s.blockStore.Get(fileName)
 	if err != nil {
 		return nil, err
 	}
@@ -156,32 +170,11 @@ func (s *SearchIndexer) GetTransactionsFromSingleFile(fileName string, getTransa
 	return result, nil
 }
 
-// GetWrittenUserBalance uses the built search index to search for all the transactions for the specified user public key in the blocks that have been written to files,
-// and returns the sum of the coin gains and losses.
-func (s *SearchIndexer) GetWrittenUserBalance(userID string) (userBalance float64, err error) {
-	transactionPaths, err := s.GetTransactionPathsByUserID(userID)
-	if err != nil {
-		return 0, err
+// PrunedHeight returns the height that every block up to and including has had its transaction bodies pruned by the block store, or 0 when none have
+func (s *SearchIndexer) PrunedHeight() int64 {
+	pruner, ok := s.blockStore.(storage.Pruner)
+	if !ok {
+		return 0
 	}
-
-	userBalance = 0
-	for fileName, transactionIndexes := range transactionPaths {
-		fileTransactions, err := s.GetTransactionsFromSingleFile(fileName, transactionIndexes)
-		if err != nil {
-			return 0, err
-		}
-		for _, transaction := range fileTransactions {
-			if transaction.TransactionStatus == dto.StatusDropped {
-				// if the transaction was dropped then ignore its coin amount
-				continue
-			}
-			if userID == transaction.Submitted.From {
-				userBalance -= transaction.Submitted.CoinAmount
-			} else if userID == transaction.Submitted.To {
-				userBalance += transaction.Submitted.CoinAmount
-			}
-		}
-	}
-
-	return userBalance, nil
+	return pruner.PrunedHeight()
 }
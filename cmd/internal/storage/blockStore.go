@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+const (
+	// FileBlockStoreName is the --block-store flag value for writing each block to its own json file
+	FileBlockStoreName = "file"
+	// MemoryBlockStoreName is the --block-store flag value for keeping the blocks in memory
+	MemoryBlockStoreName = "memory"
+	// SegmentBlockStoreName is the --block-store flag value for appending the blocks to segment files with an offset index
+	SegmentBlockStoreName = "segment"
+)
+
+const (
+	// chainNameFormat is the name of a block on the chain, from its height and block hash. The height is zero padded so the names sort in order.
+	chainNameFormat = "%012d_%s"
+	// droppedNamePrefix is in front of the hash of the json of a dropped block for its name.
+	// Dropped blocks were written to the block store before the dropped transactions were kept in the dropped journal.
+	droppedNamePrefix = "dropped_"
+)
+
+// ErrBlockNotFound is returned when the block store doesn't have the block that was asked for
+var ErrBlockNotFound = errors.New("block not found in the block store")
+
+// ErrReadOnly is returned by the methods that change the blocks of a block store that was opened read only
+var ErrReadOnly = errors.New("the block store was opened read only")
+
+// ErrDroppedBlock is returned by Put for a dropped block, since the dropped transactions are kept in the dropped journal
+var ErrDroppedBlock = errors.New("dropped transactions go in the dropped journal, not the block store")
+
+// BlockStore is where the node keeps the blocks it has written.
+// The blocks on the main chain have a height, starting at 1 for the first block.
+// Dropped blocks written before the dropped journal can still be read, so they can be moved to the journal, but they aren't on the chain.
+type BlockStore interface {
+	// Put writes the block and returns the name the search index can find it by again.
+	// The block has to build on the tip, and becomes the new tip.
+	Put(block *dto.BlockRequest) (name string, err error)
+
+	// Get returns the block written under the name
+	Get(name string) (*dto.BlockRequest, error)
+
+	// GetByHash returns the block on the chain with the block hash
+	GetByHash(blockHash string) (*dto.BlockRequest, error)
+
+	// GetByHeight returns the block on the chain at the height
+	GetByHeight(height int64) (*dto.BlockRequest, error)
+
+	// Iterate calls f with each block on the chain from height from to height to, both included, and stops at the first error from f.
+	Iterate(from, to int64, f func(height int64, block *dto.BlockRequest) error) error
+
+	// Tip returns the height of the last block on the chain and the block. The height is 0 and the block is nil before the first block.
+	Tip() (height int64, block *dto.BlockRequest, err error)
+
+	// RemoveTip takes the last block off the chain when a reorg rolls it back, and returns the name it was written under.
+	RemoveTip() (name string, err error)
+
+	// IterateWritten calls f with every block written and not rolled back, in the order they were written.
+	// This is for putting the blocks back in the search index and the block tree when the node restarts.
+	IterateWritten(f func(name string, block *dto.BlockRequest) error) error
+
+	// IterateDropped calls f with each dropped block that was written before the dropped journal, in the order they were read.
+	IterateDropped(f func(name string, block *dto.BlockRequest) error) error
+
+	// RemoveDropped removes the dropped block once its transactions are in the dropped journal
+	RemoveDropped(name string) error
+}
+
+// chainIndex is the part of a block store that keeps track of which written blocks are on the chain, with a mutex lock.
+type chainIndex struct {
+	mx *sync.Mutex
+	// names are the names of the blocks on the chain, by height - 1
+	names  []string
+	hashes []string
+	byHash map[string]string
+	// dropped is the names of the dropped blocks written before the dropped journal
+	dropped []string
+}
+
+func newChainIndex() *chainIndex {
+	return &chainIndex{
+		mx:      &sync.Mutex{},
+		names:   make([]string, 0),
+		hashes:  make([]string, 0),
+		byHash:  make(map[string]string),
+		dropped: make([]string, 0),
+	}
+}
+
+// checkPut returns an error if the block can't go on the chain. Call with the mutex locked.
+func (c *chainIndex) checkPut(block *dto.BlockRequest) error {
+	if block.ProofOfWorkHash == dto.StatusDropped {
+		return ErrDroppedBlock
+	}
+
+	tipHash := ""
+	if len(c.hashes) > 0 {
+		tipHash = c.hashes[len(c.hashes)-1]
+	}
+	if block.Header.PrevBlockHash != tipHash {
+		return fmt.Errorf("block %s does not build on the tip %s of the block store", block.ProofOfWorkHash, tipHash)
+	}
+	// blocks written before the header had a height take the height of where they are on the chain
+	if block.Header.Height != 0 && block.Header.Height != int64(len(c.names))+1 {
+		return fmt.Errorf("block %s has height %d but the tip of the block store is at height %d", block.ProofOfWorkHash, block.Header.Height, len(c.names))
+	}
+	return nil
+}
+
+// blockName returns the name to write the block under. Call with the mutex locked after checkPut.
+// A block on the chain is named by its height and block hash, so the same chain has the same names on every node.
+func (c *chainIndex) blockName(block *dto.BlockRequest) string {
+	return fmt.Sprintf(chainNameFormat, len(c.names)+1, block.ProofOfWorkHash)
+}
+
+// droppedName returns the name of a dropped block read back from before the dropped journal.
+// Dropped blocks aren't on the chain, so they are named by the hash of their json instead and don't take a height.
+func droppedName(blockBytes []byte) string {
+	return fmt.Sprintf("%s%x", droppedNamePrefix, sha256.Sum256(blockBytes))
+}
+
+// put adds the written block to the chain. Call with the mutex locked after checkPut.
+func (c *chainIndex) put(block *dto.BlockRequest, name string) {
+	c.names = append(c.names, name)
+	c.hashes = append(c.hashes, block.ProofOfWorkHash)
+	c.byHash[block.ProofOfWorkHash] = name
+}
+
+// nameByHeight returns the name of the block at the height on the chain. Call with the mutex locked.
+func (c *chainIndex) nameByHeight(height int64) (string, error) {
+	if height < 1 || height > int64(len(c.names)) {
+		return "", ErrBlockNotFound
+	}
+	return c.names[height-1], nil
+}
+
+// removeTip takes the last block off the chain and returns its name. Call with the mutex locked.
+func (c *chainIndex) removeTip() (string, error) {
+	if len(c.names) == 0 {
+		return "", ErrBlockNotFound
+	}
+	name := c.names[len(c.names)-1]
+	delete(c.byHash, c.hashes[len(c.hashes)-1])
+	c.names = c.names[:len(c.names)-1]
+	c.hashes = c.hashes[:len(c.hashes)-1]
+	return name, nil
+}
+
+// putDropped adds a dropped block read back from before the dropped journal. Call with the mutex locked.
+func (c *chainIndex) putDropped(name string) {
+	c.dropped = append(c.dropped, name)
+}
+
+// isDropped returns if the name is a dropped block read back from before the dropped journal. Call with the mutex locked.
+func (c *chainIndex) isDropped(name string) bool {
+	for _, droppedName := range c.dropped {
+		if droppedName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeDropped forgets the dropped block. Call with the mutex locked.
+func (c *chainIndex) removeDropped(name string) error {
+	for i, droppedName := range c.dropped {
+		if droppedName == name {
+			c.dropped = append(c.dropped[:i], c.dropped[i+1:]...)
+			return nil
+		}
+	}
+	return ErrBlockNotFound
+}
+
+// iterate calls f for each block on the chain in the height range, reading them with get.
+// The names are copied first so get and f are called without the mutex locked.
+func (c *chainIndex) iterate(from, to int64, get func(name string) (*dto.BlockRequest, error), f func(height int64, block *dto.BlockRequest) error) error {
+	c.mx.Lock()
+	if from < 1 {
+		from = 1
+	}
+	if to > int64(len(c.names)) {
+		to = int64(len(c.names))
+	}
+	names := make([]string, 0)
+	if from <= to {
+		names = append(names, c.names[from-1:to]...)
+	}
+	c.mx.Unlock()
+
+	for i, name := range names {
+		block, err := get(name)
+		if err != nil {
+			return err
+		}
+		err = f(from+int64(i), block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterateWritten calls f for each block on the chain in the order they were written, reading them with get.
+func (c *chainIndex) iterateWritten(get func(name string) (*dto.BlockRequest, error), f func(name string, block *dto.BlockRequest) error) error {
+	c.mx.Lock()
+	names := append([]string{}, c.names...)
+	c.mx.Unlock()
+	return iterateNames(names, get, f)
+}
+
+// iterateDropped calls f for each dropped block written before the dropped journal, reading them with get.
+func (c *chainIndex) iterateDropped(get func(name string) (*dto.BlockRequest, error), f func(name string, block *dto.BlockRequest) error) error {
+	c.mx.Lock()
+	names := append([]string{}, c.dropped...)
+	c.mx.Unlock()
+	return iterateNames(names, get, f)
+}
+
+// iterateNames calls f for each of the names, reading the blocks with get. Call without the mutex locked.
+func iterateNames(names []string, get func(name string) (*dto.BlockRequest, error), f func(name string, block *dto.BlockRequest) error) error {
+	for _, name := range names {
+		block, err := get(name)
+		if err != nil {
+			return err
+		}
+		err = f(name, block)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tip returns the height and name of the last block on the chain, and "" before the first block
+func (c *chainIndex) tip() (int64, string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if len(c.names) == 0 {
+		return 0, ""
+	}
+	return int64(len(c.names)), c.names[len(c.names)-1]
+}
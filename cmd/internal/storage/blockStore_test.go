@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// testSegmentMaxBytes is the --segment-max-bytes default
+const testSegmentMaxBytes = 64 << 20
+
+// testStores are the block stores the tests and benchmarks run against. persistent is set for the stores that can be opened again.
+var testStores = []struct {
+	name       string
+	persistent bool
+	open       func(path string) (BlockStore, error)
+}{
+	{FileBlockStoreName, true, func(path string) (BlockStore, error) { return OpenFileBlockStore(path) }},
+	{SegmentBlockStoreName, true, func(path string) (BlockStore, error) { return OpenSegmentBlockStore(path, testSegmentMaxBytes) }},
+	{MemoryBlockStoreName, false, func(path string) (BlockStore, error) { return NewMemoryBlockStore(), nil }},
+}
+
+// sampleChain returns a chain of the number of blocks, each with the number of transactions
+func sampleChain(blocks, transactions int) []*dto.BlockRequest {
+	chain := make([]*dto.BlockRequest, 0, blocks)
+	prevBlockHash := ""
+	for i := 0; i < blocks; i++ {
+		block := &dto.BlockRequest{
+			OriginNodePublicKey: "benchmark",
+			ProofOfWorkHash:     fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.Itoa(i)))),
+			Header: &dto.BlockHeader{
+				PrevBlockHash:    prevBlockHash,
+				TransactionsHash: fmt.Sprintf("%x", sha256.Sum256([]byte("transactions"+strconv.Itoa(i)))),
+				Time:             strconv.FormatInt(time.Now().Unix(), 10),
+				Difficulty:       1,
+				Height:           int64(i + 1),
+			},
+			Transactions: make([]*dto.TransactionSubmission, 0, transactions),
+		}
+		for j := 0; j < transactions; j++ {
+			block.Transactions = append(block.Transactions, &dto.TransactionSubmission{
+				ID:                fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%d-%d", i, j)))),
+				Timestamp:         block.Header.Time,
+				TransactionStatus: dto.StatusWritten,
+				BodySigned:        fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("signed %d-%d", i, j)))),
+				Submitted: &dto.Transaction{
+					Key:        "benchmark",
+					Value:      strconv.Itoa(j),
+					From:       "sender",
+					To:         "receiver",
+					CoinAmount: 1,
+					Nonce:      int64(i*transactions + j + 1),
+				},
+			})
+		}
+		chain = append(chain, block)
+		prevBlockHash = block.ProofOfWorkHash
+	}
+	return chain
+}
+
+// tempDir returns a new temporary folder and a func that removes it
+func tempDir(tb testing.TB) (string, func()) {
+	path, err := ioutil.TempDir("", "block-store")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(path) }
+}
+
+// putChain writes every block of the chain to the block store
+func putChain(tb testing.TB, blockStore BlockStore, chain []*dto.BlockRequest) {
+	for _, block := range chain {
+		_, err := blockStore.Put(block)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// checkTip fails the test unless the tip of the block store is the block of the chain at the height
+func checkTip(tb testing.TB, blockStore BlockStore, chain []*dto.BlockRequest, height int64) {
+	tipHeight, tip, err := blockStore.Tip()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if tipHeight != height {
+		tb.Fatalf("the tip is at height %d, expected %d", tipHeight, height)
+	}
+	if height > 0 && tip.ProofOfWorkHash != chain[height-1].ProofOfWorkHash {
+		tb.Fatalf("the tip is block %s, expected %s", tip.ProofOfWorkHash, chain[height-1].ProofOfWorkHash)
+	}
+}
+
+func TestBlockStores(t *testing.T) {
+	chain := sampleChain(5, 2)
+
+	for _, store := range testStores {
+		t.Run(store.name, func(t *testing.T) {
+			path, remove := tempDir(t)
+			defer remove()
+			blockStore, err := store.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTip(t, blockStore, chain, 0)
+
+			names := make([]string, 0, len(chain))
+			for _, block := range chain {
+				name, err := blockStore.Put(block)
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, name)
+			}
+			checkTip(t, blockStore, chain, 5)
+
+			for i, block := range chain {
+				byName, err := blockStore.Get(names[i])
+				if err != nil || byName.ProofOfWorkHash != block.ProofOfWorkHash {
+					t.Fatalf("Get(%s) returned %v, %v", names[i], byName, err)
+				}
+				byHeight, err := blockStore.GetByHeight(int64(i + 1))
+				if err != nil || byHeight.ProofOfWorkHash != block.ProofOfWorkHash {
+					t.Fatalf("GetByHeight(%d) returned %v, %v", i+1, byHeight, err)
+				}
+				byHash, err := blockStore.GetByHash(block.ProofOfWorkHash)
+				if err != nil || byHash.Header.Height != int64(i+1) {
+					t.Fatalf("GetByHash(%s) returned %v, %v", block.ProofOfWorkHash, byHash, err)
+				}
+			}
+			for _, height := range []int64{0, 6} {
+				if _, err = blockStore.GetByHeight(height); err != ErrBlockNotFound {
+					t.Fatalf("GetByHeight(%d) returned %v, expected ErrBlockNotFound", height, err)
+				}
+			}
+			if _, err = blockStore.GetByHash("unknown"); err != ErrBlockNotFound {
+				t.Fatalf("GetByHash of an unknown hash returned %v, expected ErrBlockNotFound", err)
+			}
+
+			// a block read back is a copy, changing it doesn't change the stored block
+			readBack, _ := blockStore.GetByHeight(1)
+			readBack.Transactions[0].Submitted.Value = "changed"
+			readBack, _ = blockStore.GetByHeight(1)
+			if readBack.Transactions[0].Submitted.Value == "changed" {
+				t.Fatal("changing a block read back changed the stored block")
+			}
+
+			heights := make([]int64, 0)
+			err = blockStore.Iterate(2, 4, func(height int64, block *dto.BlockRequest) error {
+				if block.ProofOfWorkHash != chain[height-1].ProofOfWorkHash {
+					t.Fatalf("Iterate gave block %s at height %d", block.ProofOfWorkHash, height)
+				}
+				heights = append(heights, height)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(heights) != "[2 3 4]" {
+				t.Fatalf("Iterate(2, 4) gave the heights %v", heights)
+			}
+
+			if _, err = blockStore.Put(chain[2]); err == nil {
+				t.Fatal("Put wrote a block that doesn't build on the tip")
+			}
+			if _, err = blockStore.Put(&dto.BlockRequest{ProofOfWorkHash: dto.StatusDropped}); err != ErrDroppedBlock {
+				t.Fatalf("Put of a dropped block returned %v, expected ErrDroppedBlock", err)
+			}
+
+			removedName, err := blockStore.RemoveTip()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removedName != names[4] {
+				t.Fatalf("RemoveTip removed %s, expected %s", removedName, names[4])
+			}
+			checkTip(t, blockStore, chain, 4)
+			if _, err = blockStore.GetByHash(chain[4].ProofOfWorkHash); err != ErrBlockNotFound {
+				t.Fatalf("GetByHash of the removed tip returned %v, expected ErrBlockNotFound", err)
+			}
+
+			written := make([]string, 0)
+			err = blockStore.IterateWritten(func(name string, block *dto.BlockRequest) error {
+				written = append(written, name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(written) != fmt.Sprint(names[:4]) {
+				t.Fatalf("IterateWritten gave %v, expected %v", written, names[:4])
+			}
+
+			if !store.persistent {
+				return
+			}
+			blockStore, err = store.open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTip(t, blockStore, chain, 4)
+			putChain(t, blockStore, chain[4:])
+			checkTip(t, blockStore, chain, 5)
+		})
+	}
+}
+
+func BenchmarkBlockStorePut(b *testing.B) {
+	for _, store := range testStores {
+		b.Run(store.name, func(b *testing.B) {
+			path, remove := tempDir(b)
+			defer remove()
+			blockStore, err := store.open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			chain := sampleChain(b.N, 10)
+
+			b.ResetTimer()
+			putChain(b, blockStore, chain)
+		})
+	}
+}
+
+// benchmarkBlockStoreRead writes a sample chain to each store, then reads b.N blocks from it in a random order with read
+func benchmarkBlockStoreRead(b *testing.B, read func(blockStore BlockStore, chain []*dto.BlockRequest, i int) error) {
+	const blocks = 1000
+	chain := sampleChain(blocks, 10)
+
+	for _, store := range testStores {
+		b.Run(store.name, func(b *testing.B) {
+			path, remove := tempDir(b)
+			defer remove()
+			blockStore, err := store.open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putChain(b, blockStore, chain)
+			random := rand.New(rand.NewSource(1))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = read(blockStore, chain, random.Intn(blocks))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBlockStoreGetByHeight(b *testing.B) {
+	benchmarkBlockStoreRead(b, func(blockStore BlockStore, chain []*dto.BlockRequest, i int) error {
+		_, err := blockStore.GetByHeight(int64(i + 1))
+		return err
+	})
+}
+
+func BenchmarkBlockStoreGetByHash(b *testing.B) {
+	benchmarkBlockStoreRead(b, func(blockStore BlockStore, chain []*dto.BlockRequest, i int) error {
+		_, err := blockStore.GetByHash(chain[i].ProofOfWorkHash)
+		return err
+	})
+}
+
+// BenchmarkBlockStoreReopen times reading a sample chain back when the node restarts
+func BenchmarkBlockStoreReopen(b *testing.B) {
+	const blocks = 1000
+	chain := sampleChain(blocks, 10)
+
+	for _, store := range testStores {
+		if !store.persistent {
+			continue
+		}
+		b.Run(store.name, func(b *testing.B) {
+			path, remove := tempDir(b)
+			defer remove()
+			blockStore, err := store.open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putChain(b, blockStore, chain)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				blockStore, err = store.open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			checkTip(b, blockStore, chain, blocks)
+			files, _ := filepath.Glob(filepath.Join(path, "*"))
+			b.ReportMetric(float64(len(files)), "files")
+		})
+	}
+}
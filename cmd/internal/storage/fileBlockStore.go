@@ -0,0 +1,451 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// orphanedFolder is the folder in the block chain output path that the files of rolled back blocks are moved to
+const orphanedFolder = "orphaned"
+
+// fileBlockStore writes each block as a json file in the block chain output path.
+// The file name for a block on the chain is its height and block hash.
+// Dropped blocks written before the dropped journal are named by the hash of their json after "dropped_", and are removed once they are moved to the journal.
+// Each change to the files is recorded in the write ahead file first, and block files are written as a temp file that is renamed into place,
+// so a node that stops part way through writing a block can finish or undo it when it starts again.
+type fileBlockStore struct {
+	*chainIndex
+	blockChainOutputPath string
+	// prunedHeight is the height that every block up to and including is pruned, see pruning.go
+	prunedHeight int64
+	// readOnly is set for a store opened with OpenFileBlockStoreReadOnly, which never changes the files
+	readOnly bool
+}
+
+// OpenFileBlockStore returns the block store that writes each block to its own json file in blockChainOutputPath.
+// A change to the files that was cut short when the node stopped is finished or undone, and the block files already in blockChainOutputPath are read back in height order.
+// Block files named the old way, by the hash of the block json and the number of blocks written, are renamed by their height and block hash.
+func OpenFileBlockStore(blockChainOutputPath string) (BlockStore, error) {
+	err := os.MkdirAll(blockChainOutputPath, 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileBlockStore{
+		chainIndex:           newChainIndex(),
+		blockChainOutputPath: blockChainOutputPath,
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err = s.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OpenFileBlockStoreReadOnly returns the file block store in blockChainOutputPath for reading the blocks while a node may still be writing to it.
+// Nothing is recovered, temp files and the write ahead file are left alone, block files named the old way keep their names,
+// and the methods that change the blocks return ErrReadOnly. A block being written when the store is opened is read if its file is already in place.
+func OpenFileBlockStoreReadOnly(blockChainOutputPath string) (BlockStore, error) {
+	_, err := os.Stat(blockChainOutputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileBlockStore{
+		chainIndex:           newChainIndex(),
+		blockChainOutputPath: blockChainOutputPath,
+		readOnly:             true,
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// recover finishes or undoes the change in the write ahead file and cleans up temp files. Call with the mutex locked.
+func (s *fileBlockStore) recover() error {
+	record, err := readWriteAhead(s.blockChainOutputPath)
+	if err != nil {
+		return err
+	}
+
+	if record != nil {
+		switch record.Op {
+		case writeAheadPut:
+			// the block was committed if its file made it into place, the temp file is removed below either way
+			_, err = os.Stat(s.fileName(record.Name))
+			if err == nil {
+				log.Printf("recovered the write of block file %s", record.Name)
+			} else {
+				log.Printf("undid the write of block file %s that was cut short", record.Name)
+			}
+		case writeAheadRemoveTip:
+			_, err = os.Stat(s.fileName(record.Name))
+			if err == nil {
+				err = s.moveToOrphaned(record.Name)
+				if err != nil {
+					return err
+				}
+			}
+			log.Printf("recovered the roll back of block file %s", record.Name)
+		}
+	}
+
+	tempFiles, err := filepath.Glob(filepath.Join(s.blockChainOutputPath, "*"+tempFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, tempFile := range tempFiles {
+		err = os.Remove(tempFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a record that was only partly written is removed too
+	return endWriteAhead(s.blockChainOutputPath)
+}
+
+// load reads the block files on the chain back in height order, and keeps the names of the dropped block files so they can be moved to the dropped journal.
+// Call with the mutex locked.
+func (s *fileBlockStore) load() error {
+	fileNames, err := filepath.Glob(filepath.Join(s.blockChainOutputPath, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	// the heights are zero padded so the file names sort in height order.
+	// the old names come after them, which is where a rename of the old names that was cut short left off
+	chainNames := make([]string, 0, len(fileNames))
+	legacyNames := make([]string, 0)
+	droppedNames := make([]string, 0)
+	for _, fileName := range fileNames {
+		name := strings.TrimSuffix(filepath.Base(fileName), ".json")
+		if strings.HasPrefix(name, droppedNamePrefix) {
+			droppedNames = append(droppedNames, name)
+			continue
+		}
+		if isChainName(name) {
+			chainNames = append(chainNames, name)
+			continue
+		}
+		err = checkLegacyName(name)
+		if err != nil {
+			return err
+		}
+		legacyNames = append(legacyNames, name)
+	}
+	sort.Strings(chainNames)
+	sort.Strings(legacyNames)
+
+	for _, name := range chainNames {
+		block, err := s.Get(name)
+		if err != nil {
+			return err
+		}
+		err = s.loadBlock(name, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the number written at the end of the old names starts over each time the node starts, so the old names are put in order by following the previous block hashes instead
+	children := make(map[string][]string)
+	legacyBlocks := make(map[string]*dto.BlockRequest)
+	for _, name := range legacyNames {
+		block, err := s.Get(name)
+		if err != nil {
+			return err
+		}
+		if block.ProofOfWorkHash == dto.StatusDropped {
+			// an old name of a dropped block, which stays as it is until the block is moved to the dropped journal
+			droppedNames = append(droppedNames, name)
+			continue
+		}
+		children[block.Header.PrevBlockHash] = append(children[block.Header.PrevBlockHash], name)
+		legacyBlocks[name] = block
+	}
+	for {
+		tipHash := ""
+		if len(s.hashes) > 0 {
+			tipHash = s.hashes[len(s.hashes)-1]
+		}
+		next := children[tipHash]
+		if len(next) == 0 {
+			break
+		}
+		// the old names of blocks forking off the chain are left over and turned away below, the name that sorts first is on the chain
+		delete(children, tipHash)
+		err = s.loadBlock(next[0], legacyBlocks[next[0]])
+		if err != nil {
+			return err
+		}
+		delete(legacyBlocks, next[0])
+	}
+	for _, name := range legacyNames {
+		if legacyBlocks[name] != nil {
+			return fmt.Errorf("block file %s does not link back to the first block of the chain, move %s out of the way to start a new chain", name, s.blockChainOutputPath)
+		}
+	}
+
+	sort.Strings(droppedNames)
+	for _, name := range droppedNames {
+		s.putDropped(name)
+	}
+	return nil
+}
+
+// loadBlock puts the block read back from the block file onto the chain, and renames the file by its height and block hash. Call with the mutex locked.
+func (s *fileBlockStore) loadBlock(name string, block *dto.BlockRequest) error {
+	err := s.checkPut(block)
+	if err != nil {
+		return fmt.Errorf("block file %s can't be read back onto the chain, move %s out of the way to start a new chain: %s", name, s.blockChainOutputPath, err.Error())
+	}
+	chainName := fmt.Sprintf(chainNameFormat, len(s.names)+1, block.ProofOfWorkHash)
+	if s.readOnly {
+		chainName = name
+	}
+	if name != chainName {
+		err = s.rename(name, chainName)
+		if err != nil {
+			return err
+		}
+	}
+	s.put(block, chainName)
+	if block.Pruned && s.prunedHeight == int64(len(s.names))-1 {
+		s.prunedHeight++
+	}
+	return nil
+}
+
+// isChainName returns if the block file name is the height and block hash of a block on the chain
+func isChainName(name string) bool {
+	separator := strings.Index(name, "_")
+	if separator != 12 {
+		return false
+	}
+	_, err := strconv.ParseInt(name[:separator], 10, 64)
+	return err == nil
+}
+
+// checkLegacyName returns an error unless the block file is named the old way, by the hash of the block json and the number of blocks written
+func checkLegacyName(name string) error {
+	separator := strings.LastIndex(name, "_")
+	_, err := strconv.Atoi(name[separator+1:])
+	if separator < 0 || err != nil {
+		return fmt.Errorf("block file %s.json is not named <height>_<block hash>, dropped_<hash> or <hash>_<number written>", name)
+	}
+	return nil
+}
+
+// rename renames the block file from the old name to the new one
+func (s *fileBlockStore) rename(oldName, newName string) error {
+	err := os.Rename(s.fileName(oldName), s.fileName(newName))
+	if err != nil {
+		return err
+	}
+	log.Printf("renamed block file %s to %s", oldName, newName)
+	return syncDir(s.blockChainOutputPath)
+}
+
+func (s *fileBlockStore) Put(block *dto.BlockRequest) (string, error) {
+	blockBytes, err := json.Marshal(block)
+	if err != nil {
+		return "", err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+	err = s.checkPut(block)
+	if err != nil {
+		return "", err
+	}
+
+	name := s.blockName(block)
+
+	err = beginWriteAhead(s.blockChainOutputPath, &writeAheadRecord{
+		Op:   writeAheadPut,
+		Name: name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = WriteFileAtomic(s.fileName(name), blockBytes)
+	if err != nil {
+		return "", err
+	}
+
+	err = endWriteAhead(s.blockChainOutputPath)
+	if err != nil {
+		return "", err
+	}
+
+	s.put(block, name)
+	return name, nil
+}
+
+func (s *fileBlockStore) Get(name string) (*dto.BlockRequest, error) {
+	fileBytes, err := ioutil.ReadFile(s.fileName(name))
+	if os.IsNotExist(err) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block := &dto.BlockRequest{}
+	err = dto.UnmarshalBlock(fileBytes, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (s *fileBlockStore) GetByHash(blockHash string) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, found := s.byHash[blockHash]
+	s.mx.Unlock()
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+	return s.Get(name)
+}
+
+func (s *fileBlockStore) GetByHeight(height int64) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, err := s.nameByHeight(height)
+	s.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(name)
+}
+
+func (s *fileBlockStore) Iterate(from, to int64, f func(height int64, block *dto.BlockRequest) error) error {
+	return s.iterate(from, to, s.Get, f)
+}
+
+func (s *fileBlockStore) IterateWritten(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateWritten(s.Get, f)
+}
+
+func (s *fileBlockStore) IterateDropped(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateDropped(s.Get, f)
+}
+
+// RemoveDropped removes the file of the dropped block
+func (s *fileBlockStore) RemoveDropped(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if !s.isDropped(name) {
+		return ErrBlockNotFound
+	}
+
+	err := os.Remove(s.fileName(name))
+	if err != nil {
+		return err
+	}
+	err = syncDir(s.blockChainOutputPath)
+	if err != nil {
+		return err
+	}
+	return s.removeDropped(name)
+}
+
+func (s *fileBlockStore) Tip() (int64, *dto.BlockRequest, error) {
+	height, name := s.tip()
+	if height == 0 {
+		return 0, nil, nil
+	}
+	block, err := s.Get(name)
+	return height, block, err
+}
+
+// RemoveTip moves the file of the rolled back block to the orphaned folder, so the block files are only the main chain
+// but the rolled back blocks can still be looked at
+func (s *fileBlockStore) RemoveTip() (string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.readOnly {
+		return "", ErrReadOnly
+	}
+
+	name, err := s.nameByHeight(int64(len(s.names)))
+	if err != nil {
+		return "", err
+	}
+
+	err = beginWriteAhead(s.blockChainOutputPath, &writeAheadRecord{
+		Op:   writeAheadRemoveTip,
+		Name: name,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.moveToOrphaned(name)
+	if err != nil {
+		return "", err
+	}
+
+	err = endWriteAhead(s.blockChainOutputPath)
+	if err != nil {
+		return "", err
+	}
+
+	if s.prunedHeight > int64(len(s.names))-1 {
+		s.prunedHeight = int64(len(s.names)) - 1
+	}
+	return s.removeTip()
+}
+
+func (s *fileBlockStore) moveToOrphaned(name string) error {
+	orphanedPath := filepath.Join(s.blockChainOutputPath, orphanedFolder)
+	err := os.MkdirAll(orphanedPath, 0744)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(s.fileName(name), filepath.Join(orphanedPath, name+".json"))
+	if err != nil {
+		return err
+	}
+	return syncDir(s.blockChainOutputPath)
+}
+
+func (s *fileBlockStore) fileName(name string) string {
+	return fmt.Sprintf("%s/%s.json", s.blockChainOutputPath, name)
+}
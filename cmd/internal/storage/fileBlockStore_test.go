@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// writeLegacyFile writes the block the old way, named by the hash of the block json and the number of blocks written
+func writeLegacyFile(t *testing.T, path string, block *dto.BlockRequest, count int) {
+	blockBytes, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(path, fmt.Sprintf("%x_%d.json", sha256.Sum256(blockBytes), count)), blockBytes, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenLegacyBlockFilesWithRepeatedCounts(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+
+	// the blocks were written before the header had a height, and the number written started over when the node restarted after the third block
+	chain := sampleChain(5, 1)
+	for _, block := range chain {
+		block.Header.Height = 0
+	}
+	for i, count := range []int{1, 2, 3, 1, 2} {
+		writeLegacyFile(t, path, chain[i], count)
+	}
+
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 5)
+	for i, block := range chain {
+		_, err = os.Stat(filepath.Join(path, fmt.Sprintf(chainNameFormat+".json", i+1, block.ProofOfWorkHash)))
+		if err != nil {
+			t.Fatalf("block %d was not renamed by its height and block hash: %s", i+1, err.Error())
+		}
+	}
+
+	// an old name that doesn't link back to the first block is turned away
+	unlinked := sampleChain(1, 1)[0]
+	unlinked.ProofOfWorkHash = fmt.Sprintf("%x", sha256.Sum256([]byte("unlinked")))
+	unlinked.Header.PrevBlockHash = fmt.Sprintf("%x", sha256.Sum256([]byte("missing")))
+	unlinked.Header.Height = 0
+	writeLegacyFile(t, path, unlinked, 1)
+	_, err = OpenFileBlockStore(path)
+	if err == nil {
+		t.Fatal("a block file that doesn't link back to the first block was read onto the chain")
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// memoryBlockStore keeps the blocks in memory, for trying out nodes and the tests. Everything is gone when the node stops.
+// The blocks are kept as json like the files are, so a block read back is a copy the same as with the file block store.
+type memoryBlockStore struct {
+	*chainIndex
+	blocks map[string][]byte
+}
+
+// NewMemoryBlockStore returns the block store that keeps the blocks in memory.
+func NewMemoryBlockStore() BlockStore {
+	return &memoryBlockStore{
+		chainIndex: newChainIndex(),
+		blocks:     make(map[string][]byte),
+	}
+}
+
+func (s *memoryBlockStore) Put(block *dto.BlockRequest) (string, error) {
+	blockBytes, err := json.Marshal(block)
+	if err != nil {
+		return "", err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err = s.checkPut(block)
+	if err != nil {
+		return "", err
+	}
+
+	name := s.blockName(block)
+	s.blocks[name] = blockBytes
+	s.put(block, name)
+	return name, nil
+}
+
+func (s *memoryBlockStore) Get(name string) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	blockBytes, found := s.blocks[name]
+	s.mx.Unlock()
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+
+	block := &dto.BlockRequest{}
+	err := dto.UnmarshalBlock(blockBytes, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (s *memoryBlockStore) GetByHash(blockHash string) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, found := s.byHash[blockHash]
+	s.mx.Unlock()
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+	return s.Get(name)
+}
+
+func (s *memoryBlockStore) GetByHeight(height int64) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, err := s.nameByHeight(height)
+	s.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(name)
+}
+
+func (s *memoryBlockStore) Iterate(from, to int64, f func(height int64, block *dto.BlockRequest) error) error {
+	return s.iterate(from, to, s.Get, f)
+}
+
+func (s *memoryBlockStore) IterateWritten(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateWritten(s.Get, f)
+}
+
+// IterateDropped never calls f, since dropped blocks can't be put in a block store and the memory block store starts out empty
+func (s *memoryBlockStore) IterateDropped(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateDropped(s.Get, f)
+}
+
+func (s *memoryBlockStore) RemoveDropped(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.removeDropped(name)
+	if err != nil {
+		return err
+	}
+	delete(s.blocks, name)
+	return nil
+}
+
+func (s *memoryBlockStore) Tip() (int64, *dto.BlockRequest, error) {
+	height, name := s.tip()
+	if height == 0 {
+		return 0, nil, nil
+	}
+	block, err := s.Get(name)
+	return height, block, err
+}
+
+// RemoveTip forgets the rolled back block
+func (s *memoryBlockStore) RemoveTip() (string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	name, err := s.removeTip()
+	if err != nil {
+		return "", err
+	}
+	delete(s.blocks, name)
+	return name, nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+const (
+	// ArchivalMode is the --prune flag value for keeping every block whole
+	ArchivalMode = "archival"
+	// PruneDeleteMode is the --prune flag value for deleting the transaction bodies of old blocks
+	PruneDeleteMode = "delete"
+	// PruneGzipMode is the --prune flag value for moving the whole of each old block to a gzip archive before its transaction bodies are pruned
+	PruneGzipMode = "gzip"
+)
+
+// prunedArchiveFolder is the folder in the block chain output path that the gzip archives of the pruned blocks are kept in
+const prunedArchiveFolder = "pruned"
+
+// Pruner is a block store that can prune the transaction bodies of the old blocks on the chain. Only the file block store is a Pruner.
+type Pruner interface {
+	// Prune rewrites each block on the chain up to and including the height as a pruned block, see dto.PruneBlock, and returns how many it pruned.
+	// The blocks that are already pruned are left as they are. With gzipArchive the whole block is first saved gzipped in the pruned folder.
+	Prune(height int64, gzipArchive bool) (pruned int, err error)
+
+	// PrunedHeight returns the height that every block up to and including is pruned, or 0 when no block is pruned
+	PrunedHeight() int64
+}
+
+// Prune rewrites the block files up to the height as pruned blocks.
+// Each block file is replaced with a temp file that is renamed into place, so a node that stops part way has the block either whole or pruned.
+func (s *fileBlockStore) Prune(height int64, gzipArchive bool) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if height > int64(len(s.names)) {
+		height = int64(len(s.names))
+	}
+
+	pruned := 0
+	for ; s.prunedHeight < height; s.prunedHeight++ {
+		name := s.names[s.prunedHeight]
+		fileBytes, err := ioutil.ReadFile(s.fileName(name))
+		if err != nil {
+			return pruned, err
+		}
+
+		block := &dto.BlockRequest{}
+		err = dto.UnmarshalBlock(fileBytes, block)
+		if err != nil {
+			return pruned, err
+		}
+		if block.Pruned {
+			continue
+		}
+
+		if gzipArchive {
+			err = s.archivePruned(name, fileBytes)
+			if err != nil {
+				return pruned, err
+			}
+		}
+
+		prunedBlock, err := dto.PruneBlock(block)
+		if err != nil {
+			return pruned, err
+		}
+		prunedBytes, err := json.Marshal(prunedBlock)
+		if err != nil {
+			return pruned, err
+		}
+		err = WriteFileAtomic(s.fileName(name), prunedBytes)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+func (s *fileBlockStore) PrunedHeight() int64 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.prunedHeight
+}
+
+// archivePruned writes the whole block file gzipped to the pruned folder, flushed to disk, before the block is pruned. Call with the mutex locked.
+func (s *fileBlockStore) archivePruned(name string, fileBytes []byte) error {
+	archivePath := filepath.Join(s.blockChainOutputPath, prunedArchiveFolder)
+	err := os.MkdirAll(archivePath, 0744)
+	if err != nil {
+		return err
+	}
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err = gzipWriter.Write(fileBytes)
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filepath.Join(archivePath, fmt.Sprintf("%s.json.gz", name)), gzipped.Bytes())
+}
@@ -0,0 +1,445 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+const (
+	// segmentFileFormat is the file name of each segment in the block chain output path, numbered from 1
+	segmentFileFormat = "segment_%06d.log"
+	// recordHeaderSize is the 4 byte length and the 4 byte crc32 checksum in front of every record body
+	recordHeaderSize = 8
+)
+
+// The first byte of a record body says what the record is.
+const (
+	// recordPut is followed by the json of the written block
+	recordPut byte = 1
+	// recordRemoveTip rolls back the last block on the chain, and has nothing after it
+	recordRemoveTip byte = 2
+	// recordRemoveDropped is followed by the name of a dropped block that was moved to the dropped journal
+	recordRemoveDropped byte = 3
+)
+
+// segmentOffset is where the record of a written block is in the segment files
+type segmentOffset struct {
+	segment int
+	offset  int64
+	length  uint32
+}
+
+// segmentBlockStore appends the blocks to rolling segment files instead of writing a file per block.
+// Each record is the length of the record body, a crc32 checksum of the body, and the body.
+// Reorgs append a remove tip record, so the segment files are only ever appended to.
+// The offsets of the blocks are kept in memory and are rebuilt by reading the segments when the store is opened.
+type segmentBlockStore struct {
+	*chainIndex
+	blockChainOutputPath string
+	maxSegmentBytes      int64
+	segments             []*os.File
+	// tailSize is the size of the last segment, where the next record is written
+	tailSize int64
+	offsets  map[string]*segmentOffset
+	// readOnly is set for a store opened with OpenSegmentBlockStoreReadOnly, which never changes the segment files
+	readOnly bool
+}
+
+// OpenSegmentBlockStore returns the block store that appends the blocks to segment files in blockChainOutputPath,
+// starting a new segment file when the last one would go over maxSegmentBytes.
+// The blocks already in the segment files are read back, and a record that was only partly written when the node stopped is cut off the end.
+func OpenSegmentBlockStore(blockChainOutputPath string, maxSegmentBytes int64) (BlockStore, error) {
+	if maxSegmentBytes <= recordHeaderSize {
+		return nil, fmt.Errorf("the max segment size has to be more than %d bytes", recordHeaderSize)
+	}
+
+	err := os.MkdirAll(blockChainOutputPath, 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	return openSegmentBlockStore(blockChainOutputPath, maxSegmentBytes, false)
+}
+
+// OpenSegmentBlockStoreReadOnly returns the segment block store in blockChainOutputPath for reading the blocks while a node may still be writing to it.
+// The segment files are opened read only, a record at the end of the last segment that is still being written is skipped instead of cut off,
+// and the methods that change the blocks return ErrReadOnly.
+func OpenSegmentBlockStoreReadOnly(blockChainOutputPath string) (BlockStore, error) {
+	_, err := os.Stat(blockChainOutputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return openSegmentBlockStore(blockChainOutputPath, 0, true)
+}
+
+func openSegmentBlockStore(blockChainOutputPath string, maxSegmentBytes int64, readOnly bool) (BlockStore, error) {
+	s := &segmentBlockStore{
+		chainIndex:           newChainIndex(),
+		blockChainOutputPath: blockChainOutputPath,
+		maxSegmentBytes:      maxSegmentBytes,
+		segments:             make([]*os.File, 0),
+		offsets:              make(map[string]*segmentOffset),
+		readOnly:             readOnly,
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// the segment numbers are zero padded so the file names sort in order
+	fileNames, err := filepath.Glob(filepath.Join(blockChainOutputPath, "segment_*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fileNames)
+
+	for i, fileName := range fileNames {
+		if fileName != s.segmentFileName(i) {
+			return nil, fmt.Errorf("segment file %s is missing", s.segmentFileName(i))
+		}
+		openFlag := os.O_RDWR
+		if readOnly {
+			openFlag = os.O_RDONLY
+		}
+		segmentFile, err := os.OpenFile(fileName, openFlag, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segmentFile)
+
+		err = s.recoverSegment(i, i == len(fileNames)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segments) == 0 && !readOnly {
+		err = s.startSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *segmentBlockStore) segmentFileName(segment int) string {
+	return filepath.Join(s.blockChainOutputPath, fmt.Sprintf(segmentFileFormat, segment+1))
+}
+
+// recoverSegment reads the records of the segment back into the chain index.
+// A record in the last segment that is cut short or doesn't match its checksum was being written when the node stopped,
+// so the segment is truncated there, or for a read only store the rest of the segment is skipped. Anywhere else it means the segment file is corrupt.
+func (s *segmentBlockStore) recoverSegment(segment int, last bool) error {
+	segmentFile := s.segments[segment]
+	info, err := segmentFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	for offset < info.Size() {
+		body, err := readRecord(segmentFile, offset, info.Size())
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment file %s is corrupt at offset %d: %s", segmentFile.Name(), offset, err.Error())
+			}
+			if s.readOnly {
+				log.Printf("skipping the torn tail of segment file %s at offset %d: %s", segmentFile.Name(), offset, err.Error())
+				break
+			}
+			log.Printf("truncating the torn tail of segment file %s at offset %d: %s", segmentFile.Name(), offset, err.Error())
+			err = segmentFile.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		err = s.applyRecord(body, &segmentOffset{
+			segment: segment,
+			offset:  offset,
+			length:  uint32(len(body)),
+		})
+		if err != nil {
+			return fmt.Errorf("segment file %s at offset %d: %s", segmentFile.Name(), offset, err.Error())
+		}
+		offset += recordHeaderSize + int64(len(body))
+	}
+
+	if last {
+		s.tailSize = offset
+	}
+	return nil
+}
+
+// applyRecord updates the chain index with a record read back from a segment. Call with the mutex locked.
+func (s *segmentBlockStore) applyRecord(body []byte, at *segmentOffset) error {
+	switch body[0] {
+	case recordPut:
+		block := &dto.BlockRequest{}
+		err := dto.UnmarshalBlock(body[1:], block)
+		if err != nil {
+			return err
+		}
+		if block.ProofOfWorkHash == dto.StatusDropped {
+			// a dropped block appended before the dropped journal, waiting to be moved to the journal
+			name := droppedName(body[1:])
+			s.offsets[name] = at
+			s.putDropped(name)
+			return nil
+		}
+		err = s.checkPut(block)
+		if err != nil {
+			return err
+		}
+		s.putWritten(block, at)
+		return nil
+	case recordRemoveTip:
+		name, err := s.removeTip()
+		if err != nil {
+			return err
+		}
+		delete(s.offsets, name)
+		return nil
+	case recordRemoveDropped:
+		name := string(body[1:])
+		err := s.removeDropped(name)
+		if err != nil {
+			return err
+		}
+		delete(s.offsets, name)
+		return nil
+	default:
+		return fmt.Errorf("unknown record type %d", body[0])
+	}
+}
+
+// putWritten names the written block and adds it to the chain index. Call with the mutex locked after checkPut.
+// The blocks are named the same as with the file block store.
+func (s *segmentBlockStore) putWritten(block *dto.BlockRequest, at *segmentOffset) string {
+	name := s.blockName(block)
+	s.offsets[name] = at
+	s.put(block, name)
+	return name
+}
+
+// readRecord reads the record body at the offset and checks it against its length and checksum
+func readRecord(segmentFile *os.File, offset, size int64) ([]byte, error) {
+	if offset+recordHeaderSize > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, recordHeaderSize)
+	_, err := segmentFile.ReadAt(header, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 || offset+recordHeaderSize+int64(length) > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, length)
+	_, err = segmentFile.ReadAt(body, offset+recordHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("record checksum does not match")
+	}
+	return body, nil
+}
+
+// startSegment creates the next segment file for the records to be appended to. Call with the mutex locked.
+func (s *segmentBlockStore) startSegment() error {
+	segmentFile, err := os.OpenFile(s.segmentFileName(len(s.segments)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, segmentFile)
+	s.tailSize = 0
+	return syncDir(s.blockChainOutputPath)
+}
+
+// appendRecord writes the record body to the end of the last segment, starting a new segment if it would go over the max size.
+// Call with the mutex locked.
+func (s *segmentBlockStore) appendRecord(body []byte) (*segmentOffset, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	recordSize := recordHeaderSize + int64(len(body))
+	if s.tailSize > 0 && s.tailSize+recordSize > s.maxSegmentBytes {
+		err := s.startSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	copy(record[recordHeaderSize:], body)
+
+	// if the write fails part way, the next record is written over it
+	at := &segmentOffset{
+		segment: len(s.segments) - 1,
+		offset:  s.tailSize,
+		length:  uint32(len(body)),
+	}
+	_, err := s.segments[at.segment].WriteAt(record, at.offset)
+	if err != nil {
+		return nil, err
+	}
+	// the record is committed once it is flushed to disk, a crash before then leaves a torn tail that is cut off on restart
+	err = s.segments[at.segment].Sync()
+	if err != nil {
+		return nil, err
+	}
+	s.tailSize += recordSize
+	return at, nil
+}
+
+func (s *segmentBlockStore) Put(block *dto.BlockRequest) (string, error) {
+	blockBytes, err := json.Marshal(block)
+	if err != nil {
+		return "", err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err = s.checkPut(block)
+	if err != nil {
+		return "", err
+	}
+
+	at, err := s.appendRecord(append([]byte{recordPut}, blockBytes...))
+	if err != nil {
+		return "", err
+	}
+
+	return s.putWritten(block, at), nil
+}
+
+func (s *segmentBlockStore) Get(name string) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	at, found := s.offsets[name]
+	var segmentFile *os.File
+	if found {
+		segmentFile = s.segments[at.segment]
+	}
+	s.mx.Unlock()
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+
+	body, err := readRecord(segmentFile, at.offset, at.offset+recordHeaderSize+int64(at.length))
+	if err != nil {
+		return nil, err
+	}
+	if body[0] != recordPut {
+		return nil, fmt.Errorf("record of block %s is not a block", name)
+	}
+
+	block := &dto.BlockRequest{}
+	err = dto.UnmarshalBlock(body[1:], block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (s *segmentBlockStore) GetByHash(blockHash string) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, found := s.byHash[blockHash]
+	s.mx.Unlock()
+	if !found {
+		return nil, ErrBlockNotFound
+	}
+	return s.Get(name)
+}
+
+func (s *segmentBlockStore) GetByHeight(height int64) (*dto.BlockRequest, error) {
+	s.mx.Lock()
+	name, err := s.nameByHeight(height)
+	s.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(name)
+}
+
+func (s *segmentBlockStore) Iterate(from, to int64, f func(height int64, block *dto.BlockRequest) error) error {
+	return s.iterate(from, to, s.Get, f)
+}
+
+func (s *segmentBlockStore) IterateWritten(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateWritten(s.Get, f)
+}
+
+func (s *segmentBlockStore) IterateDropped(f func(name string, block *dto.BlockRequest) error) error {
+	return s.iterateDropped(s.Get, f)
+}
+
+// RemoveDropped appends a remove dropped record. Like a rolled back block, the record of the dropped block stays in its segment.
+func (s *segmentBlockStore) RemoveDropped(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if !s.isDropped(name) {
+		return ErrBlockNotFound
+	}
+
+	_, err := s.appendRecord(append([]byte{recordRemoveDropped}, name...))
+	if err != nil {
+		return err
+	}
+
+	err = s.removeDropped(name)
+	if err != nil {
+		return err
+	}
+	delete(s.offsets, name)
+	return nil
+}
+
+func (s *segmentBlockStore) Tip() (int64, *dto.BlockRequest, error) {
+	height, name := s.tip()
+	if height == 0 {
+		return 0, nil, nil
+	}
+	block, err := s.Get(name)
+	return height, block, err
+}
+
+// RemoveTip appends a remove tip record. The record of the rolled back block stays in its segment but can't be read through the store anymore.
+func (s *segmentBlockStore) RemoveTip() (string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	_, err := s.nameByHeight(int64(len(s.names)))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.appendRecord([]byte{recordRemoveTip})
+	if err != nil {
+		return "", err
+	}
+
+	name, err := s.removeTip()
+	if err != nil {
+		return "", err
+	}
+	delete(s.offsets, name)
+	return name, nil
+}
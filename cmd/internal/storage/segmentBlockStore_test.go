@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// segmentSize returns the size of the segment file
+func segmentSize(t *testing.T, path string, segment int) int64 {
+	info, err := os.Stat(filepath.Join(path, fmt.Sprintf(segmentFileFormat, segment+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// writeTornTail writes the chain to a new segment store and cuts the last record in half, like a node stopping part way through the write.
+// writeTornTail returns the size of the segment before the last record.
+func writeTornTail(t *testing.T, path string, blocks int) int64 {
+	chain := sampleChain(blocks, 2)
+	blockStore, err := OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChain(t, blockStore, chain[:blocks-1])
+	sizeBefore := segmentSize(t, path, 0)
+	putChain(t, blockStore, chain[blocks-1:])
+	sizeAfter := segmentSize(t, path, 0)
+
+	err = os.Truncate(filepath.Join(path, fmt.Sprintf(segmentFileFormat, 1)), sizeBefore+(sizeAfter-sizeBefore)/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sizeBefore
+}
+
+func TestSegmentBlockStoreTruncatesTornTail(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(4, 2)
+	sizeBefore := writeTornTail(t, path, 4)
+
+	blockStore, err := OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 3)
+	if size := segmentSize(t, path, 0); size != sizeBefore {
+		t.Fatalf("the segment is %d bytes after the torn tail was cut off, expected %d", size, sizeBefore)
+	}
+
+	// the block that was cut off can be written again in its place
+	putChain(t, blockStore, chain[3:])
+	blockStore, err = OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 4)
+}
+
+func TestSegmentBlockStoreTruncatesBadChecksum(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(3, 2)
+	blockStore, err := OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChain(t, blockStore, chain[:2])
+	sizeBefore := segmentSize(t, path, 0)
+	putChain(t, blockStore, chain[2:])
+
+	// flip the last byte of the last record body
+	segmentFile, err := os.OpenFile(filepath.Join(path, fmt.Sprintf(segmentFileFormat, 1)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastByte := make([]byte, 1)
+	size := segmentSize(t, path, 0)
+	_, err = segmentFile.ReadAt(lastByte, size-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastByte[0] ^= 0xff
+	_, err = segmentFile.WriteAt(lastByte, size-1)
+	segmentFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err = OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 2)
+	if size := segmentSize(t, path, 0); size != sizeBefore {
+		t.Fatalf("the segment is %d bytes after the bad record was cut off, expected %d", size, sizeBefore)
+	}
+}
+
+func TestSegmentBlockStoreReadOnlySkipsTornTail(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(4, 2)
+	writeTornTail(t, path, 4)
+	tornSize := segmentSize(t, path, 0)
+
+	blockStore, err := OpenSegmentBlockStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 3)
+	if size := segmentSize(t, path, 0); size != tornSize {
+		t.Fatalf("the read only store changed the segment from %d to %d bytes", tornSize, size)
+	}
+	if _, err = blockStore.Put(chain[3]); err != ErrReadOnly {
+		t.Fatalf("Put on the read only store returned %v, expected ErrReadOnly", err)
+	}
+}
+
+func TestSegmentBlockStoreCorruptEarlierSegment(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(4, 2)
+	// small enough that every block starts a new segment
+	blockStore, err := OpenSegmentBlockStore(path, recordHeaderSize+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChain(t, blockStore, chain)
+
+	err = os.Truncate(filepath.Join(path, fmt.Sprintf(segmentFileFormat, 1)), segmentSize(t, path, 0)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenSegmentBlockStore(path, recordHeaderSize+1)
+	if err == nil {
+		t.Fatal("a cut short record in a segment that isn't the last was not reported as corrupt")
+	}
+}
+
+func TestSegmentBlockStoreReplaysRemoveTip(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(3, 2)
+	blockStore, err := OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChain(t, blockStore, chain)
+	_, err = blockStore.RemoveTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err = OpenSegmentBlockStore(path, testSegmentMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 2)
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeAheadFileName is the file in the block chain output path that records the block file change being made, until it is done
+const writeAheadFileName = "commit.wal"
+
+// tempFileSuffix is added to the name of a file while it is being written, before it is renamed into place
+const tempFileSuffix = ".tmp"
+
+const (
+	// writeAheadPut is recorded before a block file is written
+	writeAheadPut = "put"
+	// writeAheadRemoveTip is recorded before the file of a rolled back block is moved to the orphaned folder
+	writeAheadRemoveTip = "remove-tip"
+)
+
+// writeAheadRecord is the change to the block files that is being made.
+// If the node stops part way, the record says what to finish or undo when it starts again.
+type writeAheadRecord struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+}
+
+// writeSynced writes the file and flushes it to disk before returning
+func writeSynced(fileName string, fileBytes []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(fileBytes)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// WriteFileAtomic writes the file as a temp file, flushes it to disk and renames it into place,
+// so the file is either all there or not there at all
+func WriteFileAtomic(fileName string, fileBytes []byte) error {
+	err := writeSynced(fileName+tempFileSuffix, fileBytes)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(fileName+tempFileSuffix, fileName)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fileName))
+}
+
+// syncDir flushes the folder to disk, so files created, renamed or removed in it stay that way after a crash
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	closeErr := dir.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// beginWriteAhead records the change that is about to be made in the folder
+func beginWriteAhead(dirName string, record *writeAheadRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = writeSynced(filepath.Join(dirName, writeAheadFileName), recordBytes)
+	if err != nil {
+		return err
+	}
+	return syncDir(dirName)
+}
+
+// endWriteAhead removes the record once the change is done
+func endWriteAhead(dirName string) error {
+	err := os.Remove(filepath.Join(dirName, writeAheadFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(dirName)
+}
+
+// readWriteAhead returns the change that was being made when the node stopped, or nil if there wasn't one.
+// A record that was only partly written is also nil, because nothing was changed before the record was on disk.
+func readWriteAhead(dirName string) (*writeAheadRecord, error) {
+	recordBytes, err := ioutil.ReadFile(filepath.Join(dirName, writeAheadFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &writeAheadRecord{}
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		return nil, nil
+	}
+
+	switch record.Op {
+	case writeAheadPut, writeAheadRemoveTip:
+		return record, nil
+	default:
+		return nil, fmt.Errorf("unknown write ahead record op %q in %s", record.Op, writeAheadFileName)
+	}
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joncherry/blockchain-miniproject/cmd/internal/dto"
+)
+
+// blockFileName returns the file the file block store writes the block at the height to
+func blockFileName(path string, block *dto.BlockRequest) string {
+	return filepath.Join(path, fmt.Sprintf(chainNameFormat, block.Header.Height, block.ProofOfWorkHash)+".json")
+}
+
+// checkRecovered fails the test if the write ahead file or a temp file is left in the folder
+func checkRecovered(t *testing.T, path string) {
+	if _, err := os.Stat(filepath.Join(path, writeAheadFileName)); !os.IsNotExist(err) {
+		t.Fatalf("the write ahead file is still there: %v", err)
+	}
+	tempFiles, err := filepath.Glob(filepath.Join(path, "*"+tempFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempFiles) != 0 {
+		t.Fatalf("the temp files %v are still there", tempFiles)
+	}
+}
+
+// openWithChain writes the chain to a new file block store in the folder
+func openWithChain(t *testing.T, path string, chain []*dto.BlockRequest) {
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putChain(t, blockStore, chain)
+}
+
+func TestWriteAheadUndoesPutCutShort(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(4, 2)
+	openWithChain(t, path, chain[:3])
+
+	// the node stopped part way through writing the temp file of the 4th block
+	err := beginWriteAhead(path, &writeAheadRecord{Op: writeAheadPut, Name: fmt.Sprintf(chainNameFormat, 4, chain[3].ProofOfWorkHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(blockFileName(path, chain[3])+tempFileSuffix, []byte(`{"originNodePublicKey":`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 3)
+	checkRecovered(t, path)
+	putChain(t, blockStore, chain[3:])
+	checkTip(t, blockStore, chain, 4)
+}
+
+func TestWriteAheadFinishesPutRenamedIntoPlace(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(4, 2)
+	openWithChain(t, path, chain[:3])
+
+	// the node stopped after the block file was renamed into place but before the record was removed
+	err := beginWriteAhead(path, &writeAheadRecord{Op: writeAheadPut, Name: fmt.Sprintf(chainNameFormat, 4, chain[3].ProofOfWorkHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockBytes, err := json.Marshal(chain[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteFileAtomic(blockFileName(path, chain[3]), blockBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 4)
+	checkRecovered(t, path)
+}
+
+func TestWriteAheadFinishesRemoveTip(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(3, 2)
+	openWithChain(t, path, chain)
+
+	// the node stopped after recording the roll back but before the block file was moved
+	err := beginWriteAhead(path, &writeAheadRecord{Op: writeAheadRemoveTip, Name: fmt.Sprintf(chainNameFormat, 3, chain[2].ProofOfWorkHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 2)
+	checkRecovered(t, path)
+	if _, err = os.Stat(filepath.Join(path, orphanedFolder, filepath.Base(blockFileName(path, chain[2])))); err != nil {
+		t.Fatalf("the rolled back block file was not moved to the orphaned folder: %s", err.Error())
+	}
+}
+
+func TestWriteAheadIgnoresTornRecord(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(3, 2)
+	openWithChain(t, path, chain)
+
+	// nothing is changed before the record is on disk, so a record that was cut short is only removed
+	err := ioutil.WriteFile(filepath.Join(path, writeAheadFileName), []byte(`{"op":"remove-t`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 3)
+	checkRecovered(t, path)
+}
+
+func TestWriteAheadLeftAloneReadOnly(t *testing.T) {
+	path, remove := tempDir(t)
+	defer remove()
+	chain := sampleChain(3, 2)
+	openWithChain(t, path, chain)
+
+	err := beginWriteAhead(path, &writeAheadRecord{Op: writeAheadRemoveTip, Name: fmt.Sprintf(chainNameFormat, 3, chain[2].ProofOfWorkHash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockStore, err := OpenFileBlockStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTip(t, blockStore, chain, 3)
+	if _, err = os.Stat(filepath.Join(path, writeAheadFileName)); err != nil {
+		t.Fatalf("the read only store removed the write ahead file: %v", err)
+	}
+}
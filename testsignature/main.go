@@ -19,6 +19,21 @@ type Transaction struct {
 	From       string  `json:"from"`
 	To         string  `json:"to"`
 	CoinAmount float64 `json:"coinAmount"`
+	Nonce      int64   `json:"nonce,omitempty"`
+	Fee        float64 `json:"fee,omitempty"`
+	Type       string  `json:"type,omitempty"`
+}
+
+// ApprovalBody defines the values and json that a validator node signs to approve a governance transaction
+type ApprovalBody struct {
+	Submitted          *Transaction `json:"submit"`
+	ValidatorSetHeight int64        `json:"validatorSetHeight"`
+}
+
+// Cancel defines the values and json of the message the from-user signs to cancel their pending transaction with the nonce
+type Cancel struct {
+	From  string `json:"from"`
+	Nonce int64  `json:"nonce"`
 }
 
 func main() {
@@ -30,11 +45,17 @@ func main() {
 	var privateKey *rsa.PrivateKey
 	var publicKey *rsa.PublicKey
 	var body string
+	var cancel bool
+	var approve bool
+	var validatorSetHeight int64
 
 	// flags
 	flag.StringVar(&body, "body", "", "The body to sign")
 	flag.StringVar(&privateKeyStr, "private-key", "", "The private key to sign with")
 	flag.StringVar(&publicKeyStr, "public-key", "", "The public key matching the private key to sign with")
+	flag.BoolVar(&cancel, "cancel", false, "Sign the body as a cancel message instead of a transaction")
+	flag.BoolVar(&approve, "approve", false, "Sign the governance transaction in the body as a validator approval for the validator set height")
+	flag.Int64Var(&validatorSetHeight, "validator-set-height", 0, "The height of the last block that changed the validators, for -approve")
 
 	flag.Parse()
 
@@ -42,14 +63,28 @@ func main() {
 		fmt.Println("body is empty")
 		return
 	}
+	if cancel && approve {
+		fmt.Println("a cancel message can't be signed as an approval")
+		return
+	}
 
-	unmarshalBody := &Transaction{}
+	var unmarshalBody interface{} = &Transaction{}
+	if cancel {
+		unmarshalBody = &Cancel{}
+	}
 	err = json.Unmarshal([]byte(body), unmarshalBody)
 	if err != nil {
 		fmt.Println("error json unmarshalling the body for formatting", err)
 		return
 	}
 
+	if approve {
+		unmarshalBody = &ApprovalBody{
+			Submitted:          unmarshalBody.(*Transaction),
+			ValidatorSetHeight: validatorSetHeight,
+		}
+	}
+
 	formattedBody, err := json.Marshal(unmarshalBody)
 	if err != nil {
 		fmt.Println("error json marshalling the body for formatting", err)